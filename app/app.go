@@ -27,8 +27,6 @@ import (
 	"github.com/leonlau/mqant/v2/selector/cache"
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
-	"hash/crc32"
-	"math"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -81,14 +79,27 @@ func NewApp(opts ...module.Option) module.App {
 	app.opts = options
 	options.Selector.Init(selector.SetWatcher(app.Watcher))
 	app.routes = map[string]func(app module.App, Type string, hash string) module.ServerSession{}
+	balancer := selector.NewHashBalancer(0, 0)
 	app.defaultRoutes = func(app module.App, Type string, hash string) module.ServerSession {
-		//默认使用第一个Server
+		//按hash一致性哈希选择Server,扩缩容时只有少量hash换到其他Server
 		servers := app.GetServersByType(Type)
 		if len(servers) == 0 {
 			return nil
 		}
-		index := int(math.Abs(float64(crc32.ChecksumIEEE([]byte(hash))))) % len(servers)
-		return servers[index]
+		nodes := make([]*registry.Node, 0, len(servers))
+		for _, server := range servers {
+			nodes = append(nodes, server.GetNode())
+		}
+		node, err := balancer.Get(Type, hash, nodes)
+		if err != nil {
+			return nil
+		}
+		for _, server := range servers {
+			if server.GetNode() == node {
+				return server
+			}
+		}
+		return nil
 	}
 	app.rpcserializes = map[string]module.RPCSerialize{}
 	return app
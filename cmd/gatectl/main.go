@@ -0,0 +1,180 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/**
+网关管理命令行工具,通过nats和consul调用网关的管理接口
+
+	gatectl [flags] list   <serverId> [Userid=..] [IP=..] [Network=..] [ConnectedAfter=..] [ConnectedBefore=..]
+	gatectl [flags] stats  <serverId> <Sessionid>
+	gatectl [flags] kick-user <Userid> [reason]
+	gatectl [flags] kick-ip   <ip|cidr> [reason]
+	gatectl [flags] drain  [window秒] [message]
+
+kick-user,kick-ip,drain默认作用于-type类型的所有网关,指定-server时只作用于该网关
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonlau/mqant/v2"
+	"github.com/leonlau/mqant/v2/conf"
+	"github.com/leonlau/mqant/v2/gate/base"
+	"github.com/leonlau/mqant/v2/module"
+	"github.com/leonlau/mqant/v2/registry"
+	"github.com/nats-io/nats.go"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: gatectl [flags] <command> [args]
+
+Commands:
+  list <serverId> [key=value ...]  list sessions, keys: Userid IP Network ConnectedAfter ConnectedBefore
+  stats <serverId> <Sessionid>     show the agent stats of a session
+  kick-user <Userid> [reason]      kick all sessions of a user
+  kick-ip <ip|cidr> [reason]       kick all sessions in the ip range
+  drain [window] [message]         drain the gates, window in seconds
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	natsAddr := flag.String("nats", nats.DefaultURL, "nats server address")
+	consulAddr := flag.String("consul", "127.0.0.1:8500", "consul address")
+	gateType := flag.String("type", "gate", "gate module type")
+	serverId := flag.String("server", "", "only the gate with this server id")
+	offset := flag.Int64("offset", 0, "list offset")
+	limit := flag.Int64("limit", 100, "list limit")
+	expired := flag.Int("timeout", 5, "rpc timeout in seconds")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	nc, err := nats.Connect(*natsAddr)
+	if err != nil {
+		fail(err.Error())
+	}
+	defer nc.Close()
+	app := mqant.CreateApp(
+		module.Nats(nc),
+		module.Registry(registry.NewRegistry(registry.Addrs(*consulAddr))),
+	)
+	app.Configure(conf.Config{
+		Rpc: conf.Rpc{
+			RpcExpired: *expired,
+		},
+	})
+	admin := basegate.NewGateAdmin(app, *gateType)
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list":
+		if len(args) < 1 {
+			fail("list requires <serverId>")
+		}
+		filter, err := parseFilter(args[1:])
+		if err != nil {
+			fail(err.Error())
+		}
+		result, e := admin.ListSessions(args[0], filter, *offset, *limit)
+		if e != "" {
+			fail(e)
+		}
+		output(result)
+	case "stats":
+		if len(args) < 2 {
+			fail("stats requires <serverId> <Sessionid>")
+		}
+		result, e := admin.AgentStats(args[0], args[1])
+		if e != "" {
+			fail(e)
+		}
+		output(result)
+	case "kick-user", "kick-ip":
+		if len(args) < 1 {
+			fail(cmd + " requires a target")
+		}
+		reason := ""
+		if len(args) > 1 {
+			reason = strings.Join(args[1:], " ")
+		}
+		var count int64
+		var e string
+		if cmd == "kick-user" {
+			count, e = admin.KickUser(*serverId, args[0], reason)
+		} else {
+			count, e = admin.KickIP(*serverId, args[0], reason)
+		}
+		if e != "" {
+			fail(e)
+		}
+		fmt.Printf("kicked %d sessions\n", count)
+	case "drain":
+		var window int64
+		message := ""
+		if len(args) > 0 {
+			window, err = strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				fail(fmt.Sprintf("invalid window %q", args[0]))
+			}
+		}
+		if len(args) > 1 {
+			message = strings.Join(args[1:], " ")
+		}
+		if e := admin.Drain(*serverId, time.Duration(window)*time.Second, message); e != "" {
+			fail(e)
+		}
+		fmt.Println("draining")
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+/**
+解析list命令的key=value过滤条件
+*/
+func parseFilter(args []string) (map[string]string, error) {
+	filter := map[string]string{}
+	for _, kv := range args {
+		s := strings.SplitN(kv, "=", 2)
+		if len(s) != 2 || s[0] == "" {
+			return nil, fmt.Errorf("invalid filter %q", kv)
+		}
+		filter[s[0]] = s[1]
+	}
+	return filter, nil
+}
+
+func output(v interface{}) {
+	b, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(b))
+}
+
+func fail(msg string) {
+	fmt.Fprintln(os.Stderr, "gatectl:", msg)
+	os.Exit(1)
+}
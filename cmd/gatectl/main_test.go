@@ -0,0 +1,46 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		args []string
+		want map[string]string
+		err  bool
+	}{
+		{args: nil, want: map[string]string{}},
+		{args: []string{"Userid=u1", "IP=10.0.0.0/24"}, want: map[string]string{"Userid": "u1", "IP": "10.0.0.0/24"}},
+		{args: []string{"Userid="}, want: map[string]string{"Userid": ""}},
+		{args: []string{"Userid=a=b"}, want: map[string]string{"Userid": "a=b"}},
+		{args: []string{"Userid"}, err: true},
+		{args: []string{"=u1"}, err: true},
+	}
+	for _, test := range tests {
+		filter, err := parseFilter(test.args)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseFilter(%q) = %v, want error", test.args, filter)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(filter, test.want) {
+			t.Errorf("parseFilter(%q) = %v %v, want %v", test.args, filter, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+	"github.com/leonlau/mqant/v2/module"
+	"github.com/leonlau/mqant/v2/network"
+	"github.com/leonlau/mqant/v2/rpc/util"
+	"github.com/leonlau/mqant/v2/selector"
+	"github.com/leonlau/mqant/v2/utils"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+各种协议的agent共用的部分: Session,并发控制,消息路由和存储心跳
+具体的协议只需要实现握手,读取消息和WriteMsg
+*/
+type baseAgent struct {
+	self                             gate.Agent //具体协议的agent,用于回写消息
+	module                           module.RPCModule
+	session                          gate.Session
+	conn                             network.Conn
+	gate                             gate.Gate
+	ch                               chan int //控制模块可同时开启的最大协程数
+	isclose                          bool
+	lock                             sync.Mutex
+	last_storage_heartbeat_data_time time.Duration //上一次发送存储心跳时间
+	rev_num                          int64
+	send_num                         int64
+	conn_time                        time.Time
+	bucket                           *tokenBucket   //连接的消息限流
+	out                              *outQueue      //发送队列
+	compress                         bool           //是否协商了负载压缩
+	cipher                           *payloadCipher //密钥交换后的负载加密
+	payloadLock                      sync.RWMutex
+	sealLock                         sync.Mutex
+}
+
+/**
+由网关实现,同一个IP的所有连接共享限流
+*/
+type ipLimiter interface {
+	ipBucket(ip string) *tokenBucket
+}
+
+func (this *baseAgent) init(self gate.Agent, gate gate.Gate, conn network.Conn) {
+	this.self = self
+	this.ch = make(chan int, gate.Options().ConcurrentTasks)
+	this.conn = conn
+	this.gate = gate
+	this.isclose = false
+	this.rev_num = 0
+	this.send_num = 0
+	this.last_storage_heartbeat_data_time = time.Duration(time.Now().UnixNano())
+	if gate.Options().SessionRateLimit > 0 {
+		this.bucket = newTokenBucket(gate.Options().SessionRateLimit, gate.Options().SessionRateBurst)
+	}
+}
+
+/**
+创建发送队列,write为具体协议写入连接的函数,只会在队列的协程中调用
+*/
+func (this *baseAgent) startQueue(write func(topic string, body []byte) error) {
+	this.out = newOutQueue(this.gate.Options(), write, func() {
+		//慢速客户端,直接断开连接
+		log.Warnf("Gate outbound queue overflow, disconnect %s", this.conn.RemoteAddr().String())
+		go this.conn.Close()
+	})
+}
+
+/**
+握手时已经确定身份的连接,例如websocket升级前鉴权
+*/
+type identityConn interface {
+	Identity() interface{}
+}
+
+/**
+mTLS连接,可以取得已验证的客户端证书主题
+*/
+type peerSubjectConn interface {
+	PeerSubject() string
+}
+
+/**
+为新的连接创建Session,握手时确定的Userid和Settings会带到新的Session中
+mTLS时客户端证书主题保存在Settings的gate.TLSSubjectKey中
+*/
+func (this *baseAgent) newSession() (gate.Session, error) {
+	data := map[string]interface{}{
+		"Sessionid": utils.GenerateID().String(),
+		"Network":   this.conn.RemoteAddr().Network(),
+		"IP":        this.conn.RemoteAddr().String(),
+		"Serverid":  this.module.GetServerId(),
+		"Settings":  make(map[string]string),
+	}
+	if conn, ok := this.conn.(identityConn); ok {
+		if identity, ok := conn.Identity().(gate.Session); ok {
+			data["Userid"] = identity.GetUserId()
+			if identity.GetSettings() != nil {
+				data["Settings"] = identity.GetSettings()
+			}
+		}
+	}
+	if conn, ok := this.conn.(peerSubjectConn); ok {
+		if subject := conn.PeerSubject(); subject != "" {
+			data["Settings"].(map[string]string)[gate.TLSSubjectKey] = subject
+		}
+	}
+	return NewSessionByMap(this.module.GetApp(), data)
+}
+
+func (a *baseAgent) IsClosed() bool {
+	return a.isclose
+}
+
+func (a *baseAgent) GetSession() gate.Session {
+	return a.session
+}
+
+func (a *baseAgent) Wait() error {
+	// 如果ch满了则会处于阻塞，从而达到限制最大协程的功能
+	select {
+	case a.ch <- 1:
+	//do nothing
+	default:
+		//warnning!
+		return fmt.Errorf("the work queue is full!")
+	}
+	return nil
+}
+func (a *baseAgent) Finish() {
+	// 完成则从ch推出数据
+	<-a.ch
+}
+
+func (a *baseAgent) QueueDepth() int {
+	return a.out.depth()
+}
+
+func (a *baseAgent) DroppedNum() int64 {
+	return a.out.droppedNum()
+}
+
+func (a *baseAgent) RevNum() int64 {
+	return a.rev_num
+}
+func (a *baseAgent) SendNum() int64 {
+	return a.send_num
+}
+func (a *baseAgent) ConnTime() time.Time {
+	return a.conn_time
+}
+
+/**
+入站消息限流,返回false时这条消息不再处理
+reply 用于RateLimitReply策略回复客户端
+*/
+func (a *baseAgent) allow(reply func(Error string)) bool {
+	var ip *tokenBucket
+	if l, ok := a.gate.(ipLimiter); ok {
+		ip = l.ipBucket(hostOf(a.session.GetIP()))
+	}
+	//连接和IP的限额都满足时才消耗令牌,被IP限流的消息不占用连接的限额
+	if takeTokens(a.bucket, ip) {
+		return true
+	}
+	switch a.gate.Options().RateLimitAction {
+	case gate.RateLimitReply:
+		reply("rate limit exceeded")
+	case gate.RateLimitDisconnect:
+		log.Warnf("Gate rate limit exceeded, disconnect %s", a.session.GetIP())
+		a.self.Close()
+	}
+	return false
+}
+
+func (a *baseAgent) toResult(Topic string, Result interface{}, Error string) error {
+	switch v2 := Result.(type) {
+	case module.ProtocolMarshal:
+		return a.self.WriteMsg(Topic, v2.GetData())
+	}
+	b, err := a.module.GetApp().ProtocolMarshal(a.session.TraceId(), Result, Error)
+	if err == "" {
+		return a.self.WriteMsg(Topic, b.GetData())
+	} else {
+		log.Error(err)
+		br, _ := a.module.GetApp().ProtocolMarshal(a.session.TraceId(), nil, err)
+		return a.self.WriteMsg(Topic, br.GetData())
+	}
+}
+
+/**
+将客户端的消息路由到后端模块
+先查网关的路由表,没有匹配的路由时按topic路由
+topic 格式为 [moduleType@moduleID]/[handler]|[moduleType@moduleID]/[handler]/[msgid],有msgid时需要回复客户端
+reply 回复客户端
+*/
+func (a *baseAgent) route(topic string, msg []byte, reply func(Result interface{}, Error string)) {
+	a.lock.Lock()
+	a.rev_num = a.rev_num + 1
+	a.lock.Unlock()
+	topics := strings.Split(topic, "/")
+	a.session.CreateTrace()
+	if m, ok := a.gate.(routeMatcher); ok {
+		if r, needreturn, ok := m.matchRoute(topic); ok {
+			if a.dispatch(r.Module, r.Func, a.routeKey(r.Module, r.Hash, msg), topic, msg, needreturn, reply) {
+				a.heartbeat()
+			}
+			return
+		}
+	}
+	if a.gate.GetRouteHandler() != nil {
+		needreturn, result, err := a.gate.GetRouteHandler().OnRoute(a.session, topic, msg)
+		if err != nil {
+			if needreturn {
+				reply(result, err.Error())
+			}
+			return
+		} else {
+			if needreturn {
+				reply(result, "")
+			}
+		}
+	} else {
+		var msgid string
+		if len(topics) < 2 {
+			errorstr := "Topic must be [moduleType@moduleID]/[handler]|[moduleType@moduleID]/[handler]/[msgid]"
+			log.Error(errorstr)
+			reply(nil, errorstr)
+			return
+		} else if len(topics) == 3 {
+			msgid = topics[2]
+		}
+		startsWith := strings.HasPrefix(topics[1], "HD_")
+		if !startsWith {
+			if msgid != "" {
+				reply(nil, fmt.Sprintf("Method(%s) must begin with 'HD_'", topics[1]))
+			}
+			return
+		}
+		//if (a.gate.GetTracingHandler() != nil) && a.gate.GetTracingHandler().OnRequestTracing(a.session, *pub.GetTopic(), pub.GetMsg()) {
+		//	a.session.CreateRootSpan("gate")
+		//}
+		if !a.dispatch(topics[0], topics[1], a.routeKey(topics[0], "", msg), topic, msg, msgid != "", reply) {
+			return
+		}
+	}
+	a.heartbeat()
+}
+
+/**
+本次请求的路由key,source为空时使用网关为moduleType配置的key来源
+取不到key时使用Userid,没有Userid时使用网关的ServerId,没有配置key来源时返回空字符串
+*/
+func (a *baseAgent) routeKey(moduleType string, source string, msg []byte) string {
+	if source == "" {
+		source = a.gate.Options().RouteKeys[moduleType]
+	}
+	if source == "" {
+		return ""
+	}
+	if key := routeKey(source, a.session, msg); key != "" {
+		return key
+	}
+	if a.session.GetUserId() != "" {
+		return a.session.GetUserId()
+	}
+	return a.module.GetServerId()
+}
+
+/**
+按key一致性哈希选择模块实例的选项
+*/
+func (a *baseAgent) keyOptions(key string) []selector.SelectOption {
+	if r, ok := a.gate.(keyRouter); ok {
+		return r.keyOptions(key)
+	}
+	return []selector.SelectOption{selector.WithStrategy(selector.ConsistentHash(nil, key))}
+}
+
+/**
+调用moduleType模块的_func,按key一致性哈希选择模块实例,key为空时使用Userid,都为空时随机选择
+needreturn 为true时等待结果并回复客户端
+*/
+func (a *baseAgent) dispatch(moduleType string, _func string, key string, topic string, msg []byte, needreturn bool, reply func(Result interface{}, Error string)) bool {
+	hash := key
+	if hash == "" {
+		hash = a.session.GetUserId()
+	}
+	var opts []selector.SelectOption
+	//指定了模块ID(moduleType@moduleID)时不使用
+	if hash != "" && !strings.Contains(moduleType, "@") {
+		opts = a.keyOptions(hash)
+	}
+	if hash == "" {
+		hash = a.module.GetServerId()
+	}
+	serverSession, err := a.module.GetRouteServer(moduleType, hash, opts...)
+	if err != nil {
+		if needreturn {
+			reply(nil, fmt.Sprintf("Service(type:%s) not found", moduleType))
+		}
+		return false
+	}
+	a.session.SetTopic(topic)
+	ArgsType, args, errstr := routeArgs(a.session, msg)
+	if errstr != "" {
+		if needreturn {
+			reply(nil, errstr)
+		}
+		return false
+	}
+	if needreturn {
+		result, e := serverSession.CallArgs(_func, ArgsType, args)
+		reply(result, e)
+	} else {
+		e := serverSession.CallNRArgs(_func, ArgsType, args)
+		if e != nil {
+			log.Warnf("Gate RPC %s", e.Error())
+		}
+	}
+	return true
+}
+
+/**
+把客户端消息打包成后端handler的参数 (session, msg)
+msg是JSON对象时以map传递,否则以[]byte传递
+*/
+func routeArgs(session gate.Session, msg []byte) (ArgsType []string, args [][]byte, err string) {
+	ArgsType = make([]string, 2)
+	args = make([][]byte, 2)
+	if len(msg) > 0 && msg[0] == '{' && msg[len(msg)-1] == '}' {
+		//尝试解析为json为map
+		var obj interface{} // var obj map[string]interface{}
+		err := json.Unmarshal(msg, &obj)
+		if err != nil {
+			return nil, nil, "The JSON format is incorrect"
+		}
+		ArgsType[1] = argsutil.MAP
+		args[1] = msg
+	} else {
+		ArgsType[1] = argsutil.BYTES
+		args[1] = msg
+	}
+	ArgsType[0] = RPC_PARAM_SESSION_TYPE
+	b, e := session.Serializable()
+	if e != nil {
+		return nil, nil, e.Error()
+	}
+	args[0] = b
+	return ArgsType, args, ""
+}
+
+/**
+每隔Options.Heartbeat调用一次StorageHandler.Heartbeat
+*/
+func (a *baseAgent) heartbeat() {
+	//if a.GetSession().GetUserId() != "" {
+	//这个链接已经绑定Userid
+	a.lock.Lock()
+	interval := int64(a.last_storage_heartbeat_data_time) + int64(a.gate.Options().Heartbeat) //单位纳秒
+	a.lock.Unlock()
+	if interval < time.Now().UnixNano() {
+		if a.gate.GetStorageHandler() != nil {
+			a.lock.Lock()
+			a.last_storage_heartbeat_data_time = time.Duration(time.Now().UnixNano())
+			a.lock.Unlock()
+			a.gate.GetStorageHandler().Heartbeat(a.GetSession())
+		}
+	}
+	//}
+}
+
+/**
+worker结束时调用,释放并发名额并且捕获panic
+*/
+func (a *baseAgent) recoverDone() {
+	if r := recover(); r != nil {
+		buff := make([]byte, 4096)
+		runtime.Stack(buff, false)
+		log.Errorf("Gate recoverworker error [%v] stack : %v", r, string(buff))
+	}
+	a.Finish()
+}
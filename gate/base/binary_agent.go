@@ -0,0 +1,156 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"bufio"
+	"github.com/leonlau/mqant/v2/conf"
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+	"github.com/leonlau/mqant/v2/module"
+	"github.com/leonlau/mqant/v2/network"
+	"runtime"
+	"sync"
+	"time"
+)
+
+/**
+长度前缀的二进制协议agent
+没有握手过程,连接建立后即创建Session,帧格式由gate.FrameCodec决定
+*/
+type binaryAgent struct {
+	baseAgent
+	codec gate.FrameCodec
+	r     *bufio.Reader
+	w     *bufio.Writer
+	wlock sync.Mutex
+}
+
+func NewBinaryAgent(module module.RPCModule, codec gate.FrameCodec) *binaryAgent {
+	a := &binaryAgent{
+		codec: codec,
+	}
+	a.module = module
+	return a
+}
+
+func (this *binaryAgent) OnInit(gate gate.Gate, conn network.Conn) error {
+	this.init(this, gate, conn)
+	if this.codec == nil {
+		this.codec = NewTopicCodec(0)
+	}
+	this.r = bufio.NewReaderSize(conn, gate.Options().BufSize)
+	this.w = bufio.NewWriterSize(conn, gate.Options().BufSize)
+	this.startQueue(this.write)
+	return nil
+}
+
+func (a *binaryAgent) Run() (err error) {
+	defer func() {
+		if err := recover(); err != nil {
+			buff := make([]byte, 4096)
+			runtime.Stack(buff, false)
+			log.Errorf("conn.serve() panic(%v)\n info:%s", err, string(buff))
+		}
+		a.Close()
+	}()
+	a.session, err = a.newSession()
+	if err != nil {
+		log.Errorf("gate create agent fail %v", err)
+		return
+	}
+	a.session.JudgeGuest(a.gate.GetJudgeGuest())
+	a.session.CreateTrace()             //代码跟踪
+	a.gate.GetAgentLearner().Connect(a) //发送连接成功的事件
+	a.conn_time = time.Now()
+
+	alive := conf.Conf.Mqtt.ReadTimeout
+	if alive < 1 {
+		alive = 60
+	}
+	for {
+		a.conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(float64(alive)*1.5)))
+		topic, body, e := a.codec.ReadFrame(a.r)
+		if e != nil {
+			return nil
+		}
+		if topic == "" {
+			//客户端发送的心跳包,原样回复
+			a.heartbeat()
+			if e := a.WriteMsg("", nil); e != nil {
+				return nil
+			}
+			continue
+		}
+		if a.control(topic, body) {
+			continue
+		}
+		if body, e = a.decodePayload(topic, body); e != nil {
+			a.toResult(topic, nil, e.Error())
+			continue
+		}
+		if !a.allow(func(Error string) {
+			a.toResult(topic, nil, Error)
+		}) {
+			continue
+		}
+		if e := a.Wait(); e != nil {
+			log.Warnf("Gate OnRecover error [%v]", e)
+			a.toResult(topic, nil, e.Error())
+			continue
+		}
+		go a.recoverworker(topic, body)
+	}
+}
+
+func (a *binaryAgent) recoverworker(topic string, body []byte) {
+	defer a.recoverDone()
+	a.route(topic, body, func(Result interface{}, Error string) {
+		a.toResult(topic, Result, Error)
+	})
+}
+
+func (a *binaryAgent) OnClose() error {
+	a.isclose = true
+	a.gate.GetAgentLearner().DisConnect(a) //发送连接断开的事件
+	return nil
+}
+
+func (a *binaryAgent) WriteMsg(topic string, body []byte) error {
+	return a.push(topic, body)
+}
+
+func (a *binaryAgent) write(topic string, body []byte) error {
+	a.wlock.Lock()
+	defer a.wlock.Unlock()
+	if conf.Conf.Mqtt.WriteTimeout > 0 {
+		a.conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(conf.Conf.Mqtt.WriteTimeout)))
+	}
+	if err := a.codec.WriteFrame(a.w, topic, body); err != nil {
+		return err
+	}
+	if topic != "" {
+		a.send_num++
+	}
+	return a.w.Flush()
+}
+
+func (a *binaryAgent) Close() {
+	a.out.close(time.Second)
+	a.conn.Close()
+}
+
+func (a *binaryAgent) Destroy() {
+	a.conn.Destroy()
+}
@@ -0,0 +1,202 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/leonlau/mqant/v2/gate"
+	"io"
+	"strconv"
+)
+
+// 默认单帧最大长度
+const DefaultMaxFrameSize = 1 << 20
+
+func readFrame(r *bufio.Reader, maxSize uint32) ([]byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(head[:])
+	if size > maxSize {
+		return nil, fmt.Errorf("frame size %d exceeds limit %d", size, maxSize)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+/**
+以topic寻址的帧
+[4字节长度][2字节topic长度][topic][body] 整数均为大端序,长度不包含自身
+*/
+type topicCodec struct {
+	maxSize uint32
+}
+
+/**
+创建以topic寻址的编解码器,maxSize为0时使用DefaultMaxFrameSize
+*/
+func NewTopicCodec(maxSize uint32) gate.FrameCodec {
+	if maxSize == 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	return &topicCodec{maxSize: maxSize}
+}
+
+func (c *topicCodec) ReadFrame(r *bufio.Reader) (topic string, body []byte, err error) {
+	frame, err := readFrame(r, c.maxSize)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(frame) < 2 {
+		return "", nil, fmt.Errorf("frame too short")
+	}
+	tl := int(binary.BigEndian.Uint16(frame))
+	if len(frame) < 2+tl {
+		return "", nil, fmt.Errorf("topic length %d out of range", tl)
+	}
+	return string(frame[2 : 2+tl]), frame[2+tl:], nil
+}
+
+func (c *topicCodec) WriteFrame(w *bufio.Writer, topic string, body []byte) error {
+	if len(topic) > 0xFFFF {
+		return &gate.FrameEncodeError{Topic: topic, Err: fmt.Errorf("topic too long")}
+	}
+	size := 2 + len(topic) + len(body)
+	if uint32(size) > c.maxSize {
+		return &gate.FrameEncodeError{Topic: topic, Err: fmt.Errorf("frame size %d exceeds limit %d", size, c.maxSize)}
+	}
+	var head [6]byte
+	binary.BigEndian.PutUint32(head[:4], uint32(size))
+	binary.BigEndian.PutUint16(head[4:], uint16(len(topic)))
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	if _, err := w.WriteString(topic); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+/**
+以数字消息号寻址的帧
+[4字节长度][4字节msgid][body] 整数均为大端序,长度不包含自身
+msgid为0表示心跳包
+*/
+type msgIdCodec struct {
+	maxSize uint32
+	topics  map[uint32]string
+	ids     map[string]uint32
+}
+
+/**
+创建以数字消息号寻址的编解码器
+topics 消息号与topic的对应关系,例如 1001:"login/HD_Login/1",回复和推送的topic也必须在表中
+不在表中的topic(包括$gate/kick等网关的控制消息)无法发送给客户端,发送时丢弃
+*/
+func NewMsgIdCodec(topics map[uint32]string, maxSize uint32) gate.FrameCodec {
+	if maxSize == 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	c := &msgIdCodec{
+		maxSize: maxSize,
+		topics:  map[uint32]string{},
+		ids:     map[string]uint32{},
+	}
+	for id, topic := range topics {
+		c.topics[id] = topic
+		c.ids[topic] = id
+	}
+	return c
+}
+
+func (c *msgIdCodec) ReadFrame(r *bufio.Reader) (topic string, body []byte, err error) {
+	frame, err := readFrame(r, c.maxSize)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(frame) < 4 {
+		return "", nil, fmt.Errorf("frame too short")
+	}
+	id := binary.BigEndian.Uint32(frame)
+	if id == 0 {
+		return "", frame[4:], nil
+	}
+	topic, ok := c.topics[id]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown msg id %d", id)
+	}
+	return topic, frame[4:], nil
+}
+
+func (c *msgIdCodec) WriteFrame(w *bufio.Writer, topic string, body []byte) error {
+	var id uint32
+	if topic != "" {
+		var ok bool
+		id, ok = c.ids[topic]
+		if !ok {
+			return &gate.FrameEncodeError{Topic: topic, Err: fmt.Errorf("topic has no msg id")}
+		}
+	}
+	size := 4 + len(body)
+	if uint32(size) > c.maxSize {
+		return &gate.FrameEncodeError{Topic: topic, Err: fmt.Errorf("frame size %d exceeds limit %d", size, c.maxSize)}
+	}
+	var head [8]byte
+	binary.BigEndian.PutUint32(head[:4], uint32(size))
+	binary.BigEndian.PutUint32(head[4:], id)
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+/**
+根据网关配置创建帧编解码器
+"FrameCodec":"topic"(默认) 或 "msgid"
+"FrameTopics":{"1001":"login/HD_Login/1"} msgid格式的消息号与topic的对应关系
+"MaxFrameSize":65536 单帧最大长度
+*/
+func parseFrameCodec(name string, topics map[string]interface{}, maxSize uint32) (gate.FrameCodec, error) {
+	switch name {
+	case "", "topic":
+		return NewTopicCodec(maxSize), nil
+	case "msgid":
+		if len(topics) == 0 {
+			return nil, fmt.Errorf("msgid requires FrameTopics")
+		}
+		ids := map[uint32]string{}
+		for id, topic := range topics {
+			n, err := strconv.ParseUint(id, 10, 32)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("invalid msgid %q", id)
+			}
+			t, ok := topic.(string)
+			if !ok || t == "" {
+				return nil, fmt.Errorf("msgid %s: topic must be a non-empty string", id)
+			}
+			ids[uint32(n)] = t
+		}
+		return NewMsgIdCodec(ids, maxSize), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+}
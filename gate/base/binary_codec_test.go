@@ -0,0 +1,142 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/network"
+)
+
+func TestMsgIdCodec(t *testing.T) {
+	c := NewMsgIdCodec(map[uint32]string{1001: "login/HD_Login"}, 16)
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := c.WriteFrame(w, "login/HD_Login", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []struct {
+		topic string
+		body  []byte
+	}{
+		{"$gate/kick", nil},
+		{"login/HD_Login", make([]byte, 16)},
+	} {
+		err := c.WriteFrame(w, m.topic, m.body)
+		if _, ok := err.(*gate.FrameEncodeError); !ok {
+			t.Fatalf("WriteFrame(%q) = %v, want FrameEncodeError", m.topic, err)
+		}
+	}
+	w.Flush()
+	topic, body, err := c.ReadFrame(bufio.NewReader(&buf))
+	if err != nil || topic != "login/HD_Login" || string(body) != "hi" {
+		t.Fatalf("ReadFrame = %q %q %v", topic, body, err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unencodable messages should write nothing, %d bytes left", buf.Len())
+	}
+}
+
+type idleAgent struct {
+	closed chan struct{}
+}
+
+func (a *idleAgent) Run() error {
+	<-a.closed
+	return nil
+}
+
+func (a *idleAgent) OnClose() error {
+	return nil
+}
+
+func TestBinaryAgentUnmappedTopic(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	agents := make(chan *binaryAgent, 1)
+	idle := &idleAgent{closed: make(chan struct{})}
+	server := &network.TCPServer{Addr: addr}
+	server.NewAgent = func(conn *network.TCPConn) network.Agent {
+		a := NewBinaryAgent(nil, NewMsgIdCodec(map[uint32]string{1: "chat/say"}, 0))
+		a.OnInit(&testGate{&Gate{opts: gate.NewOptions()}}, conn)
+		agents <- a
+		return idle
+	}
+	server.Start()
+	defer server.Close()
+	defer close(idle.closed)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	a := <-agents
+	//不在消息号表中的推送只丢弃这一条,连接继续可用
+	if err := a.WriteMsg("$gate/kick", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteMsg("chat/say", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	topic, body, err := a.codec.ReadFrame(bufio.NewReader(conn))
+	if err != nil || topic != "chat/say" || string(body) != "hi" {
+		t.Fatalf("ReadFrame = %q %q %v", topic, body, err)
+	}
+	if n := a.out.droppedNum(); n != 1 {
+		t.Fatalf("dropped %d messages, want 1", n)
+	}
+}
+
+func TestParseFrameCodec(t *testing.T) {
+	codec, err := parseFrameCodec("msgid", map[string]interface{}{"1001": "login/HD_Login"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := codec.WriteFrame(w, "login/HD_Login", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if want := []byte{0, 0, 0, 6, 0, 0, 0x03, 0xe9, 'h', 'i'}; !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("msgid frame % x, want % x", buf.Bytes(), want)
+	}
+	if _, err := parseFrameCodec("", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		topics map[string]interface{}
+	}{
+		{"msgid", nil},
+		{"msgid", map[string]interface{}{"abc": "login/HD_Login"}},
+		{"msgid", map[string]interface{}{"0": "login/HD_Login"}},
+		{"msgid", map[string]interface{}{"1001": 1}},
+		{"protobuf", nil},
+	} {
+		if _, err := parseFrameCodec(c.name, c.topics, 0); err == nil {
+			t.Fatalf("parseFrameCodec(%q, %v) should fail", c.name, c.topics)
+		}
+	}
+}
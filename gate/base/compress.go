@@ -0,0 +1,81 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+/**
+mqtt/binary协议的负载压缩协商
+客户端发送 CompressTopic 消息体为 "deflate",网关回复 "deflate" 表示同意,"none" 表示不支持
+收到同意的回复之后双方的消息体前都增加一个字节的标记:
+	PayloadRaw     消息体未压缩
+	PayloadDeflate 消息体为raw deflate(RFC 1951)压缩
+网关只压缩不小于Options.CompressThreshold的消息,回复本身不带标记
+*/
+const CompressTopic = "$gate/compress"
+
+const (
+	PayloadRaw     byte = 0
+	PayloadDeflate byte = 1
+)
+
+//解压后的消息最大长度
+const maxInflateSize = DefaultMaxFrameSize
+
+//按压缩级别复用flate.Writer
+var deflaters sync.Map
+
+func deflate(level int, body []byte) ([]byte, error) {
+	pool, _ := deflaters.LoadOrStore(level, &sync.Pool{})
+	var buf bytes.Buffer
+	buf.WriteByte(PayloadDeflate)
+	w, _ := pool.(*sync.Pool).Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		w, err = flate.NewWriter(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	pool.(*sync.Pool).Put(w)
+	return buf.Bytes(), nil
+}
+
+func inflate(body []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(body))
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxInflateSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxInflateSize {
+		return nil, fmt.Errorf("inflated payload exceeds %d bytes", maxInflateSize)
+	}
+	return b, nil
+}
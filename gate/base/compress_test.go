@@ -0,0 +1,106 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"bytes"
+	"compress/flate"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+)
+
+/**
+只有发送队列的agent,记录写入连接的消息
+*/
+func newPayloadAgent(opts ...gate.Option) (*baseAgent, func() []outMessage) {
+	a := &baseAgent{}
+	a.gate = &testGate{&Gate{opts: gate.NewOptions(opts...)}}
+	var lock sync.Mutex
+	var sent []outMessage
+	a.out = newOutQueue(a.gate.Options(), func(topic string, body []byte) error {
+		lock.Lock()
+		sent = append(sent, outMessage{topic: topic, body: body})
+		lock.Unlock()
+		return nil
+	}, nil)
+	return a, func() []outMessage {
+		a.out.close(time.Second)
+		lock.Lock()
+		defer lock.Unlock()
+		return sent
+	}
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	a, sent := newPayloadAgent()
+	if !a.control(CompressTopic, []byte("deflate")) || a.compress {
+		t.Fatal("compression must be refused unless PayloadCompression is set")
+	}
+	if msgs := sent(); len(msgs) != 1 || string(msgs[0].body) != "none" {
+		t.Fatalf("reply %v, want none", msgs)
+	}
+
+	a, sent = newPayloadAgent(gate.PayloadCompression(16, flate.BestSpeed))
+	a.control(CompressTopic, []byte("gzip"))
+	if a.compress {
+		t.Fatal("unknown algorithms must be refused")
+	}
+	a.control(CompressTopic, []byte("deflate"))
+	if !a.compress {
+		t.Fatal("deflate should be accepted")
+	}
+	small := []byte("hi")
+	large := bytes.Repeat([]byte("0123456789"), 100)
+	a.push("t", small)
+	a.push("t", large)
+	msgs := sent()
+	if len(msgs) != 4 || string(msgs[0].body) != "none" || string(msgs[1].body) != "deflate" {
+		t.Fatalf("replies %v, want none,deflate", msgs)
+	}
+	//小于阈值的消息只加标记
+	if !bytes.Equal(msgs[2].body, append([]byte{PayloadRaw}, small...)) {
+		t.Fatalf("small message % x", msgs[2].body)
+	}
+	if msgs[3].body[0] != PayloadDeflate || len(msgs[3].body) >= len(large) {
+		t.Fatalf("large message not compressed, %d bytes", len(msgs[3].body))
+	}
+	//客户端的消息格式相同
+	for i, want := range [][]byte{small, large} {
+		got, err := a.decodePayload("t", msgs[2+i].body)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("decodePayload = %d bytes %v", len(got), err)
+		}
+	}
+}
+
+func TestInflateLimit(t *testing.T) {
+	body, err := deflate(flate.BestSpeed, make([]byte, maxInflateSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := inflate(body[1:]); err != nil || len(b) != maxInflateSize {
+		t.Fatalf("inflate %d bytes %v", len(b), err)
+	}
+	//解压后超过上限的消息拒绝,避免压缩炸弹
+	body, _ = deflate(flate.BestSpeed, make([]byte, maxInflateSize+1))
+	if _, err := inflate(body[1:]); err == nil {
+		t.Fatal("inflate should reject payloads over maxInflateSize")
+	}
+	if _, err := inflate([]byte("not deflate")); err == nil {
+		t.Fatal("inflate should reject corrupt payloads")
+	}
+}
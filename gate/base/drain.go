@@ -0,0 +1,123 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"fmt"
+	"github.com/leonlau/mqant/v2/log"
+	"os"
+	"os/signal"
+	"time"
+)
+
+/**
+可以停止接受新连接的监听
+*/
+type acceptStopper interface {
+	StopAccept()
+}
+
+func (this *Gate) addListener(l acceptStopper) {
+	this.drainLock.Lock()
+	this.listeners = append(this.listeners, l)
+	this.drainLock.Unlock()
+}
+
+/**
+是否正在排空或者已经排空
+*/
+func (this *Gate) Draining() bool {
+	this.drainLock.Lock()
+	defer this.drainLock.Unlock()
+	return this.draining
+}
+
+/**
+排空网关,用于不停服发布:
+1. 停止接受新连接
+2. 从服务发现中注销,后端不再把新用户路由到这个网关
+3. 向所有客户端推送 Options.DrainTopic {"Message":message},通知客户端重连到其他网关
+4. 在window时间内逐步关闭所有连接
+window<=0时使用Options.DrainWindow,message为空时使用Options.DrainMessage
+排空完成后返回,同一个网关只能排空一次
+*/
+func (this *Gate) Drain(window time.Duration, message string) error {
+	this.drainLock.Lock()
+	if this.draining {
+		this.drainLock.Unlock()
+		return fmt.Errorf("the gate is already draining")
+	}
+	this.draining = true
+	listeners := this.listeners
+	this.drainLock.Unlock()
+	defer close(this.drained)
+
+	if window <= 0 {
+		window = this.opts.DrainWindow
+	}
+	if message == "" {
+		message = this.opts.DrainMessage
+	}
+	log.Infof("Gate %s start draining", this.GetServerId())
+	for _, l := range listeners {
+		l.StopAccept()
+	}
+	if err := this.GetServer().ServiceDeregister(); err != nil {
+		log.Warnf("Gate drain deregister error: %v", err)
+	}
+	var body []byte
+	b, e := this.App.ProtocolMarshal("", map[string]interface{}{
+		"Message": message,
+	}, "")
+	if e == "" {
+		body = b.GetData()
+	} else {
+		log.Warnf("Gate drain message marshal error: %s", e)
+	}
+	this.opts.GateHandler.OnDrain(this.opts.DrainTopic, body, window)
+	log.Infof("Gate %s drained", this.GetServerId())
+	return nil
+}
+
+/**
+RPC: 排空网关,window单位为秒
+排空在后台进行,调用立即返回
+*/
+func (this *Gate) drain(span log.TraceSpan, window int64, message string) (result string, err string) {
+	if this.Draining() {
+		return "", "the gate is already draining"
+	}
+	go this.Drain(time.Duration(window)*time.Second, message)
+	return "success", ""
+}
+
+/**
+收到Options.DrainSignal时排空网关
+*/
+func (this *Gate) watchDrainSignal(stop chan struct{}) {
+	if this.opts.DrainSignal == nil {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, this.opts.DrainSignal)
+	go func() {
+		defer signal.Stop(c)
+		select {
+		case <-c:
+			log.Infof("Gate drain by signal %v", this.opts.DrainSignal)
+			this.Drain(0, "")
+		case <-stop:
+		}
+	}()
+}
@@ -0,0 +1,344 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+	"github.com/leonlau/mqant/v2/module"
+	"github.com/leonlau/mqant/v2/utils"
+)
+
+//ListSessions每页默认/最大返回的Session数
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+/**
+解析IP段,支持单个IP和CIDR
+*/
+func parseIPRange(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		return ipnet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+/**
+ListSessions的过滤条件
+*/
+type sessionFilter struct {
+	userid string
+	ip     *net.IPNet
+	net    string
+	after  time.Time
+	before time.Time
+}
+
+func newSessionFilter(filter map[string]string) (*sessionFilter, error) {
+	f := &sessionFilter{
+		userid: filter["Userid"],
+		net:    filter["Network"],
+	}
+	if s := filter["IP"]; s != "" {
+		ipnet, err := parseIPRange(s)
+		if err != nil {
+			return nil, err
+		}
+		f.ip = ipnet
+	}
+	if s := filter["ConnectedAfter"]; s != "" {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ConnectedAfter %q", s)
+		}
+		f.after = time.Unix(sec, 0)
+	}
+	if s := filter["ConnectedBefore"]; s != "" {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ConnectedBefore %q", s)
+		}
+		f.before = time.Unix(sec, 0)
+	}
+	return f, nil
+}
+
+func (f *sessionFilter) match(a gate.Agent) bool {
+	session := a.GetSession()
+	if f.userid != "" && session.GetUserId() != f.userid {
+		return false
+	}
+	if f.net != "" && session.GetNetwork() != f.net {
+		return false
+	}
+	if f.ip != nil {
+		ip := net.ParseIP(hostOf(session.GetIP()))
+		if ip == nil || !f.ip.Contains(ip) {
+			return false
+		}
+	}
+	if !f.after.IsZero() && a.ConnTime().Before(f.after) {
+		return false
+	}
+	if !f.before.IsZero() && a.ConnTime().After(f.before) {
+		return false
+	}
+	return true
+}
+
+func agentStats(a gate.Agent) map[string]interface{} {
+	session := a.GetSession()
+	stats := map[string]interface{}{
+		"Sessionid": session.GetSessionId(),
+		"Userid":    session.GetUserId(),
+		"IP":        session.GetIP(),
+		"Network":   session.GetNetwork(),
+		"ConnTime":  a.ConnTime().Unix(),
+		"RevNum":    a.RevNum(),
+		"SendNum":   a.SendNum(),
+	}
+	if queued, ok := a.(gate.QueuedAgent); ok {
+		stats["QueueDepth"] = queued.QueueDepth()
+		stats["Dropped"] = queued.DroppedNum()
+	}
+	return stats
+}
+
+/**
+ *分页查询本网关的Session,按连接时间排序
+ *filter可选 Userid,IP(单个IP或CIDR),Network,ConnectedAfter/ConnectedBefore(unix秒)
+ *返回 {"Total":符合条件的总数,"Sessions":[AgentStats,...]}
+ */
+func (h *handler) ListSessions(span log.TraceSpan, filter map[string]string, offset int64, limit int64) (result map[string]interface{}, err string) {
+	f, e := newSessionFilter(filter)
+	if e != nil {
+		err = e.Error()
+		return
+	}
+	if limit <= 0 {
+		limit = defaultListLimit
+	} else if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	agents := make([]gate.Agent, 0)
+	h.sessions.Range(func(key, agent interface{}) bool {
+		if f.match(agent.(gate.Agent)) {
+			agents = append(agents, agent.(gate.Agent))
+		}
+		return true
+	})
+	sort.Slice(agents, func(i, j int) bool {
+		ti, tj := agents[i].ConnTime(), agents[j].ConnTime()
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return agents[i].GetSession().GetSessionId() < agents[j].GetSession().GetSessionId()
+	})
+	sessions := make([]map[string]interface{}, 0)
+	for i := offset; i < int64(len(agents)) && i < offset+limit; i++ {
+		sessions = append(sessions, agentStats(agents[i]))
+	}
+	result = map[string]interface{}{
+		"Total":    len(agents),
+		"Sessions": sessions,
+	}
+	return
+}
+
+/**
+ *查询Session的连接统计 RevNum,SendNum,ConnTime(unix秒),QueueDepth,Dropped等
+ */
+func (h *handler) AgentStats(span log.TraceSpan, Sessionid string) (result map[string]interface{}, err string) {
+	agent, ok := h.sessions.Load(Sessionid)
+	if !ok || agent == nil {
+		err = "No Sesssion found"
+		return
+	}
+	result = agentStats(agent.(gate.Agent))
+	return
+}
+
+/**
+ *踢掉Userid在本网关的所有Session,返回被踢的Session数
+ */
+func (h *handler) KickUser(span log.TraceSpan, Userid string, reason string) (int64, string) {
+	var count int64 = 0
+	for _, agent := range h.userAgents(Userid) {
+		if _, err := h.Kick(span, agent.GetSession().GetSessionId(), reason); err == "" {
+			count++
+		}
+	}
+	return count, ""
+}
+
+/**
+ *踢掉IP段(单个IP或CIDR)内的所有Session,返回被踢的Session数
+ */
+func (h *handler) KickIP(span log.TraceSpan, ipRange string, reason string) (int64, string) {
+	ipnet, e := parseIPRange(ipRange)
+	if e != nil {
+		return 0, e.Error()
+	}
+	f := &sessionFilter{ip: ipnet}
+	sessionids := make([]string, 0)
+	h.sessions.Range(func(key, agent interface{}) bool {
+		if f.match(agent.(gate.Agent)) {
+			sessionids = append(sessionids, key.(string))
+		}
+		return true
+	})
+	var count int64 = 0
+	for _, sessionid := range sessionids {
+		if _, err := h.Kick(span, sessionid, reason); err == "" {
+			count++
+		}
+	}
+	return count, ""
+}
+
+/**
+网关管理接口的调用方,供其他模块或命令行工具使用
+serverId为空时作用于gateType类型的所有网关
+*/
+type GateAdmin struct {
+	app      module.App
+	gateType string
+}
+
+func NewGateAdmin(app module.App, gateType string) *GateAdmin {
+	return &GateAdmin{
+		app:      app,
+		gateType: gateType,
+	}
+}
+
+func (this *GateAdmin) trace() log.TraceSpan {
+	return log.CreateTrace(utils.GenerateID().String(), utils.GenerateID().String())
+}
+
+func (this *GateAdmin) servers(serverId string) ([]module.ServerSession, string) {
+	if serverId == "" {
+		return this.app.GetServersByType(this.gateType), ""
+	}
+	server, err := this.app.GetServerById(serverId)
+	if err != nil {
+		return nil, err.Error()
+	}
+	return []module.ServerSession{server}, ""
+}
+
+/**
+分页查询指定网关的Session,结果同ListSessions
+*/
+func (this *GateAdmin) ListSessions(serverId string, filter map[string]string, offset int64, limit int64) (map[string]interface{}, string) {
+	server, err := this.app.GetServerById(serverId)
+	if err != nil {
+		return nil, err.Error()
+	}
+	if filter == nil {
+		filter = map[string]string{}
+	}
+	result, e := server.Call("ListSessions", this.trace(), filter, offset, limit)
+	if e != "" {
+		return nil, e
+	}
+	return result.(map[string]interface{}), ""
+}
+
+/**
+查询指定网关上Session的连接统计
+*/
+func (this *GateAdmin) AgentStats(serverId string, Sessionid string) (map[string]interface{}, string) {
+	server, err := this.app.GetServerById(serverId)
+	if err != nil {
+		return nil, err.Error()
+	}
+	result, e := server.Call("AgentStats", this.trace(), Sessionid)
+	if e != "" {
+		return nil, e
+	}
+	return result.(map[string]interface{}), ""
+}
+
+/**
+踢掉用户的所有Session,返回被踢的Session数
+*/
+func (this *GateAdmin) KickUser(serverId string, Userid string, reason string) (int64, string) {
+	return this.kick(serverId, "KickUser", Userid, reason)
+}
+
+/**
+踢掉IP段(单个IP或CIDR)内的所有Session,返回被踢的Session数
+*/
+func (this *GateAdmin) KickIP(serverId string, ipRange string, reason string) (int64, string) {
+	return this.kick(serverId, "KickIP", ipRange, reason)
+}
+
+func (this *GateAdmin) kick(serverId string, _func string, target string, reason string) (int64, string) {
+	servers, err := this.servers(serverId)
+	if err != "" {
+		return 0, err
+	}
+	var count int64 = 0
+	for _, server := range servers {
+		result, e := server.Call(_func, this.trace(), target, reason)
+		if e != "" {
+			if serverId != "" {
+				return count, e
+			}
+			log.Warnf("GateAdmin %s %s error: %s", _func, server.GetId(), e)
+			continue
+		}
+		count += result.(int64)
+	}
+	return count, ""
+}
+
+/**
+排空网关,window为逐步关闭连接的时间,0使用网关的默认配置
+*/
+func (this *GateAdmin) Drain(serverId string, window time.Duration, message string) string {
+	servers, err := this.servers(serverId)
+	if err != "" {
+		return err
+	}
+	for _, server := range servers {
+		if _, e := server.Call("Drain", this.trace(), int64(window/time.Second), message); e != "" {
+			return e
+		}
+	}
+	return ""
+}
@@ -0,0 +1,241 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAdminAgent(t *testing.T, Sessionid string, Userid string, ip string, network string, conn int64) *fakeAgent {
+	session, err := NewSessionByMap(nil, map[string]interface{}{
+		"Sessionid": Sessionid,
+		"Userid":    Userid,
+		"IP":        ip,
+		"Network":   network,
+		"Serverid":  "gate@1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeAgent{session: session, conn: time.Unix(conn, 0)}
+}
+
+/**
+s1..s5按连接时间排序
+*/
+func newAdminHandler(t *testing.T) (*handler, map[string]*fakeAgent) {
+	h := newTestHandler()
+	agents := map[string]*fakeAgent{}
+	for _, a := range []*fakeAgent{
+		newAdminAgent(t, "s3", "u2", "10.0.1.1:5000", "tcp", 300),
+		newAdminAgent(t, "s1", "u1", "10.0.0.1:5000", "tcp", 100),
+		newAdminAgent(t, "s5", "", "[2001:db8::1]:5000", "ws", 500),
+		newAdminAgent(t, "s2", "u1", "10.0.0.2:5000", "ws", 200),
+		newAdminAgent(t, "s4", "u3", "192.168.1.1:5000", "kcp", 400),
+	} {
+		h.Connect(a)
+		agents[a.GetSession().GetSessionId()] = a
+	}
+	return h, agents
+}
+
+func sessionIds(result map[string]interface{}) string {
+	ids := make([]string, 0)
+	for _, stats := range result["Sessions"].([]map[string]interface{}) {
+		ids = append(ids, stats["Sessionid"].(string))
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestParseIPRange(t *testing.T) {
+	tests := []struct {
+		in       string
+		contains string
+		excludes string
+		err      bool
+	}{
+		{in: "10.0.0.1", contains: "10.0.0.1", excludes: "10.0.0.2"},
+		{in: "10.0.0.0/24", contains: "10.0.0.255", excludes: "10.0.1.0"},
+		{in: "2001:db8::1", contains: "2001:db8::1", excludes: "2001:db8::2"},
+		{in: "2001:db8::/32", contains: "2001:db8:ffff::1", excludes: "2001:db9::1"},
+		{in: "::ffff:10.0.0.1", contains: "10.0.0.1", excludes: "10.0.0.2"},
+		{in: "10.0.0", err: true},
+		{in: "10.0.0.0/33", err: true},
+		{in: "", err: true},
+	}
+	for _, test := range tests {
+		ipnet, err := parseIPRange(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseIPRange(%q) = %v, want error", test.in, ipnet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseIPRange(%q): %v", test.in, err)
+			continue
+		}
+		if !ipnet.Contains(net.ParseIP(test.contains)) {
+			t.Errorf("parseIPRange(%q) must contain %s", test.in, test.contains)
+		}
+		if ipnet.Contains(net.ParseIP(test.excludes)) {
+			t.Errorf("parseIPRange(%q) must not contain %s", test.in, test.excludes)
+		}
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	h, _ := newAdminHandler(t)
+	tests := []struct {
+		filter map[string]string
+		offset int64
+		limit  int64
+		total  int
+		ids    string
+		err    bool
+	}{
+		{filter: nil, total: 5, ids: "s1,s2,s3,s4,s5"},
+		{filter: map[string]string{"Userid": "u1"}, total: 2, ids: "s1,s2"},
+		{filter: map[string]string{"Network": "ws"}, total: 2, ids: "s2,s5"},
+		{filter: map[string]string{"IP": "10.0.0.0/24"}, total: 2, ids: "s1,s2"},
+		{filter: map[string]string{"IP": "10.0.1.1"}, total: 1, ids: "s3"},
+		{filter: map[string]string{"IP": "2001:db8::/32"}, total: 1, ids: "s5"},
+		{filter: map[string]string{"ConnectedAfter": "200", "ConnectedBefore": "400"}, total: 3, ids: "s2,s3,s4"},
+		{filter: map[string]string{"Userid": "u1", "Network": "tcp"}, total: 1, ids: "s1"},
+		{filter: map[string]string{"Userid": "nobody"}, total: 0, ids: ""},
+		//分页
+		{offset: 1, limit: 2, total: 5, ids: "s2,s3"},
+		{offset: 4, limit: 2, total: 5, ids: "s5"},
+		{offset: 10, limit: 2, total: 5, ids: ""},
+		{offset: -1, limit: 1, total: 5, ids: "s1"},
+		{filter: map[string]string{"IP": "bad"}, err: true},
+		{filter: map[string]string{"ConnectedAfter": "yesterday"}, err: true},
+		{filter: map[string]string{"ConnectedBefore": "1.5"}, err: true},
+	}
+	for _, test := range tests {
+		result, err := h.ListSessions(nil, test.filter, test.offset, test.limit)
+		if test.err {
+			if err == "" {
+				t.Errorf("ListSessions(%v) = %v, want error", test.filter, result)
+			}
+			continue
+		}
+		if err != "" {
+			t.Errorf("ListSessions(%v): %s", test.filter, err)
+			continue
+		}
+		if result["Total"] != test.total {
+			t.Errorf("ListSessions(%v, %d, %d) Total = %v, want %d", test.filter, test.offset, test.limit, result["Total"], test.total)
+		}
+		if ids := sessionIds(result); ids != test.ids {
+			t.Errorf("ListSessions(%v, %d, %d) = %q, want %q", test.filter, test.offset, test.limit, ids, test.ids)
+		}
+	}
+}
+
+func TestListSessionsLimit(t *testing.T) {
+	h := newTestHandler()
+	for i := 0; i < maxListLimit+10; i++ {
+		a := newAdminAgent(t, fmt.Sprintf("s%04d", i), "", "10.0.0.1:5000", "tcp", int64(i))
+		h.sessions.Store(a.GetSession().GetSessionId(), a)
+	}
+	tests := []struct {
+		limit int64
+		want  int
+	}{
+		{limit: 0, want: defaultListLimit},
+		{limit: -1, want: defaultListLimit},
+		{limit: 10, want: 10},
+		{limit: maxListLimit + 1, want: maxListLimit},
+	}
+	for _, test := range tests {
+		result, err := h.ListSessions(nil, nil, 0, test.limit)
+		if err != "" {
+			t.Fatal(err)
+		}
+		if n := len(result["Sessions"].([]map[string]interface{})); n != test.want {
+			t.Errorf("ListSessions limit %d returned %d sessions, want %d", test.limit, n, test.want)
+		}
+	}
+}
+
+func TestAgentStats(t *testing.T) {
+	h, agents := newAdminHandler(t)
+	agents["s2"].WriteMsg("a", nil)
+	stats, err := h.AgentStats(nil, "s2")
+	if err != "" {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"Sessionid": "s2",
+		"Userid":    "u1",
+		"IP":        "10.0.0.2:5000",
+		"Network":   "ws",
+		"ConnTime":  int64(200),
+		"SendNum":   int64(1),
+	}
+	for k, v := range want {
+		if stats[k] != v {
+			t.Errorf("AgentStats[%s] = %v, want %v", k, stats[k], v)
+		}
+	}
+	if _, err := h.AgentStats(nil, "nobody"); err == "" {
+		t.Fatal("AgentStats of an unknown session must fail")
+	}
+}
+
+func TestKickCount(t *testing.T) {
+	tests := []struct {
+		kick   func(h *handler) (int64, string)
+		count  int64
+		kicked string
+		err    bool
+	}{
+		{kick: func(h *handler) (int64, string) { return h.KickUser(nil, "u1", "") }, count: 2, kicked: "s1,s2"},
+		{kick: func(h *handler) (int64, string) { return h.KickUser(nil, "nobody", "") }, count: 0, kicked: ""},
+		{kick: func(h *handler) (int64, string) { return h.KickIP(nil, "10.0.0.0/16", "") }, count: 3, kicked: "s1,s2,s3"},
+		{kick: func(h *handler) (int64, string) { return h.KickIP(nil, "192.168.1.1", "") }, count: 1, kicked: "s4"},
+		{kick: func(h *handler) (int64, string) { return h.KickIP(nil, "2001:db8::1", "") }, count: 1, kicked: "s5"},
+		{kick: func(h *handler) (int64, string) { return h.KickIP(nil, "172.16.0.0/12", "") }, count: 0, kicked: ""},
+		{kick: func(h *handler) (int64, string) { return h.KickIP(nil, "bad", "") }, err: true},
+	}
+	for i, test := range tests {
+		h, agents := newAdminHandler(t)
+		count, err := test.kick(h)
+		if test.err {
+			if err == "" {
+				t.Errorf("#%d: want error", i)
+			}
+			continue
+		}
+		if err != "" || count != test.count {
+			t.Errorf("#%d: kicked %d %q, want %d", i, count, err, test.count)
+		}
+		kicked := make([]string, 0)
+		for _, id := range []string{"s1", "s2", "s3", "s4", "s5"} {
+			agents[id].lock.Lock()
+			if agents[id].closed {
+				kicked = append(kicked, id)
+			}
+			agents[id].lock.Unlock()
+		}
+		if got := strings.Join(kicked, ","); got != test.kicked {
+			t.Errorf("#%d: closed %q, want %q", i, got, test.kicked)
+		}
+	}
+}
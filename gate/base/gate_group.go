@@ -0,0 +1,152 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+)
+
+/**
+网关内的分组(房间/牌桌等),连接断开时自动退出所有分组
+断线暂存的会话记住所在的分组,恢复后重新加入,期间的分组广播缓存到待发送消息
+*/
+type groups struct {
+	lock    sync.RWMutex
+	members map[string]map[string]gate.Agent //group->Sessionid->Agent
+	joined  map[string]map[string]bool       //Sessionid->group
+}
+
+func (g *groups) join(group string, a gate.Agent) {
+	Sessionid := a.GetSession().GetSessionId()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.members == nil {
+		g.members = map[string]map[string]gate.Agent{}
+		g.joined = map[string]map[string]bool{}
+	}
+	if _, ok := g.members[group]; !ok {
+		g.members[group] = map[string]gate.Agent{}
+	}
+	g.members[group][Sessionid] = a
+	if _, ok := g.joined[Sessionid]; !ok {
+		g.joined[Sessionid] = map[string]bool{}
+	}
+	g.joined[Sessionid][group] = true
+}
+
+func (g *groups) leave(group string, Sessionid string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if members, ok := g.members[group]; ok {
+		delete(members, Sessionid)
+		if len(members) == 0 {
+			delete(g.members, group)
+		}
+	}
+	if joined, ok := g.joined[Sessionid]; ok {
+		delete(joined, group)
+		if len(joined) == 0 {
+			delete(g.joined, Sessionid)
+		}
+	}
+}
+
+func (g *groups) leaveAll(Sessionid string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for group := range g.joined[Sessionid] {
+		if members, ok := g.members[group]; ok {
+			delete(members, Sessionid)
+			if len(members) == 0 {
+				delete(g.members, group)
+			}
+		}
+	}
+	delete(g.joined, Sessionid)
+}
+
+func (g *groups) joinedGroups(Sessionid string) []string {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	groups := make([]string, 0, len(g.joined[Sessionid]))
+	for group := range g.joined[Sessionid] {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func (g *groups) agents(group string) []gate.Agent {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	agents := make([]gate.Agent, 0, len(g.members[group]))
+	for _, a := range g.members[group] {
+		agents = append(agents, a)
+	}
+	return agents
+}
+
+/**
+ *Session加入分组
+ */
+func (h *handler) JoinGroup(span log.TraceSpan, Sessionid string, group string) (result interface{}, err string) {
+	agent, ok := h.sessions.Load(Sessionid)
+	if !ok || agent == nil {
+		err = "No Sesssion found"
+		return
+	}
+	h.groups.join(group, agent.(gate.Agent))
+	result = "success"
+	return
+}
+
+/**
+ *Session退出分组
+ */
+func (h *handler) LeaveGroup(span log.TraceSpan, Sessionid string, group string) (result interface{}, err string) {
+	h.groups.leave(group, Sessionid)
+	result = "success"
+	return
+}
+
+/**
+ *分组在本网关的所有Session,sessionid之间用,分割
+ */
+func (h *handler) GroupMembers(span log.TraceSpan, group string) (string, string) {
+	agents := h.groups.agents(group)
+	sessionids := make([]string, 0, len(agents))
+	for _, agent := range agents {
+		sessionids = append(sessionids, agent.GetSession().GetSessionId())
+	}
+	return strings.Join(sessionids, ","), ""
+}
+
+/**
+ *广播消息给分组在本网关的所有Session
+ */
+func (h *handler) GroupBroadCast(span log.TraceSpan, group string, topic string, body []byte) (int64, string) {
+	var count int64 = 0
+	for _, agent := range h.groupAgents(group, topic, body) {
+		e := agent.WriteMsg(topic, body)
+		if e != nil {
+			log.Warnf("WriteMsg error: %v", e.Error())
+		} else {
+			count++
+		}
+	}
+	return count, ""
+}
@@ -0,0 +1,73 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+)
+
+func TestGroups(t *testing.T) {
+	h := newTestHandler()
+	a := newTestAgent(t, "s1", "")
+	b := newTestAgent(t, "s2", "")
+	h.Connect(a)
+	h.Connect(b)
+	h.JoinGroup(nil, "s1", "room")
+	h.JoinGroup(nil, "s2", "room")
+	h.JoinGroup(nil, "s2", "hall")
+	if _, err := h.JoinGroup(nil, "s3", "room"); err == "" {
+		t.Fatal("unknown session should not join a group")
+	}
+	if count, _ := h.GroupBroadCast(nil, "room", "a", nil); count != 2 {
+		t.Fatalf("GroupBroadCast reached %d sessions, want 2", count)
+	}
+	h.LeaveGroup(nil, "s1", "room")
+	if members, _ := h.GroupMembers(nil, "room"); members != "s2" {
+		t.Fatalf("GroupMembers = %q", members)
+	}
+	h.DisConnect(b)
+	if count, _ := h.GroupBroadCast(nil, "hall", "b", nil); count != 0 {
+		t.Fatal("disconnected session should leave all groups")
+	}
+	if a.sent() != "a" || b.sent() != "a" {
+		t.Fatalf("messages delivered as %q %q", a.sent(), b.sent())
+	}
+}
+
+func TestGroupsResume(t *testing.T) {
+	h := newTestHandler(gate.SessionResumeTTL(time.Minute))
+	a := newTestAgent(t, "s1", "")
+	h.Connect(a)
+	h.JoinGroup(nil, "s1", "room")
+	//与agent.OnClose相同的顺序:先暂存会话再断开
+	h.Detach("c1", "token", a.GetSession(), nil, nil)
+	h.DisConnect(a)
+	h.GroupBroadCast(nil, "room", "a", nil)
+	ds := h.Resume("c1", "token", false)
+	if ds == nil {
+		t.Fatal("session should be resumed")
+	}
+	resumed := &fakeAgent{session: ds.Session}
+	h.Connect(resumed)
+	h.GroupBroadCast(nil, "room", "b", nil)
+	if got := resumed.sent(); got != "a,b" {
+		t.Fatalf("resumed session received %q, want a,b", got)
+	}
+	if members, _ := h.GroupMembers(nil, "room"); members != "s1" {
+		t.Fatalf("GroupMembers after resume = %q", members)
+	}
+}
@@ -14,34 +14,207 @@
 package basegate
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"github.com/leonlau/mqant/v2/gate"
 	"github.com/leonlau/mqant/v2/log"
 	"github.com/pkg/errors"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+type detachedSession struct {
+	gate.DetachedSession
+	token   string   //恢复令牌
+	resumed bool     //已被新连接取回,等待新连接注册
+	groups  []string //断开前加入的分组,新连接注册时重新加入
+	timer   *time.Timer
+}
+
+type userLogin struct {
+	agent gate.Agent
+	loc   gate.Location
+}
+
 type handler struct {
 	//gate.AgentLearner
 	//gate.GateHandler
 	gate     gate.Gate
 	sessions sync.Map //连接列表
 	agentNum int
+
+	detachLock sync.Mutex
+	detached   map[string]*detachedSession //断线暂存的会话 ClientId->detachedSession
+	detachedId map[string]*detachedSession //Sessionid->detachedSession
+
+	offlineLock sync.Mutex
+	offline     map[string]map[string]*time.Timer //已断开连接的Session Userid->Sessionid->过期定时器,用于将消息转存到离线消息
+	offlineId   map[string]string                 //Sessionid->Userid
+
+	userLock sync.RWMutex
+	users    map[string]map[string]*userLogin //本网关的用户索引 Userid->Sessionid->userLogin
+	kicked   sync.Map                         //被踢下线的Sessionid,断开后不再保留会话
+	groups   groups
+
+	settingsLock sync.Mutex //修改Session Settings时检查并递增版本
 }
 
 func NewGateHandler(gate gate.Gate) *handler {
 	handler := &handler{
-		gate: gate,
+		gate:       gate,
+		detached:   map[string]*detachedSession{},
+		detachedId: map[string]*detachedSession{},
+		offline:    map[string]map[string]*time.Timer{},
+		offlineId:  map[string]string{},
 	}
 	return handler
 }
 
+/**
+ *Session绑定了Userid,更新本网关的用户索引和集群在线索引
+ */
+func (h *handler) bindUser(a gate.Agent, Userid string) {
+	Sessionid := a.GetSession().GetSessionId()
+	h.userLock.Lock()
+	if h.users == nil {
+		h.users = map[string]map[string]*userLogin{}
+	}
+	logins, ok := h.users[Userid]
+	if !ok {
+		logins = map[string]*userLogin{}
+		h.users[Userid] = logins
+	}
+	login, ok := logins[Sessionid]
+	if !ok {
+		login = &userLogin{
+			agent: a,
+			loc: gate.Location{
+				Userid:    Userid,
+				Serverid:  a.GetSession().GetServerId(),
+				Sessionid: Sessionid,
+				LoginAt:   time.Now().UnixNano() / int64(time.Millisecond),
+			},
+		}
+		logins[Sessionid] = login
+	}
+	h.userLock.Unlock()
+	if presence := h.gate.GetPresenceHandler(); presence != nil {
+		if err := presence.Online(login.loc); err != nil {
+			log.Warnf("gate presence online failure : %s", err.Error())
+		}
+	}
+}
+
+/**
+ *Session解绑Userid或连接断开
+ */
+func (h *handler) unbindUser(a gate.Agent, Userid string) {
+	Sessionid := a.GetSession().GetSessionId()
+	h.userLock.Lock()
+	login, ok := h.users[Userid][Sessionid]
+	if ok {
+		delete(h.users[Userid], Sessionid)
+		if len(h.users[Userid]) == 0 {
+			delete(h.users, Userid)
+		}
+	}
+	h.userLock.Unlock()
+	if !ok {
+		return
+	}
+	if presence := h.gate.GetPresenceHandler(); presence != nil {
+		if err := presence.Offline(login.loc); err != nil {
+			log.Warnf("gate presence offline failure : %s", err.Error())
+		}
+	}
+}
+
+/**
+ *为本网关所有已绑定Userid的Session续期在线索引,网关崩溃后不再续期的记录自动过期
+ */
+func (h *handler) refreshPresence() {
+	presence := h.gate.GetPresenceHandler()
+	if presence == nil {
+		return
+	}
+	h.userLock.RLock()
+	locs := make([]gate.Location, 0, len(h.users))
+	for _, logins := range h.users {
+		for _, login := range logins {
+			locs = append(locs, login.loc)
+		}
+	}
+	h.userLock.RUnlock()
+	for _, loc := range locs {
+		if err := presence.Online(loc); err != nil {
+			log.Warnf("gate presence refresh failure : %s", err.Error())
+			return
+		}
+	}
+}
+
+/**
+ *本网关中Userid的所有连接
+ */
+func (h *handler) userAgents(Userid string) []gate.Agent {
+	h.userLock.RLock()
+	defer h.userLock.RUnlock()
+	agents := make([]gate.Agent, 0, len(h.users[Userid]))
+	for _, login := range h.users[Userid] {
+		agents = append(agents, login.agent)
+	}
+	return agents
+}
+
+/**
+ *本网关中Userid的所有登录记录
+ */
+func (h *handler) userLogins(Userid string) []gate.Location {
+	h.userLock.RLock()
+	defer h.userLock.RUnlock()
+	locs := make([]gate.Location, 0, len(h.users[Userid]))
+	for _, login := range h.users[Userid] {
+		locs = append(locs, login.loc)
+	}
+	return locs
+}
+
 //当连接建立  并且MQTT协议握手成功
 func (h *handler) Connect(a gate.Agent) {
 	if a.GetSession() != nil {
-		h.sessions.Store(a.GetSession().GetSessionId(), a)
+		Sessionid := a.GetSession().GetSessionId()
+		resumed := false
+		h.detachLock.Lock()
+		if ds, ok := h.detachedId[Sessionid]; ok && ds.resumed {
+			resumed = true
+			//先补发断线期间未送达的消息,再注册连接,保证新消息排在后面
+			delete(h.detachedId, Sessionid)
+			for _, msg := range ds.Pending {
+				if e := a.WriteMsg(msg.Topic, msg.Body); e != nil {
+					log.Warnf("Gate resume session WriteMsg error: %v", e.Error())
+					break
+				}
+			}
+			for _, group := range ds.groups {
+				h.groups.join(group, a)
+			}
+		}
+		h.sessions.Store(Sessionid, a)
+		h.detachLock.Unlock()
 		h.agentNum++
+		if Userid := a.GetSession().GetUserId(); Userid != "" {
+			if resumed {
+				//恢复的会话已经绑定过Userid,离线期间的消息已经在Pending中补发
+				h.bindUser(a, Userid)
+			} else if err := h.bind(log.CreateTrace(a.GetSession().TraceId(), a.GetSession().SpanId()), a, "", Userid); err != "" {
+				//握手时设置的Userid与Bind一样检查登录数
+				log.Warnf("Gate bind %s error: %s", Userid, err)
+				a.Close()
+			}
+		}
 	}
 	if h.gate.GetSessionLearner() != nil {
 		h.gate.GetSessionLearner().Connect(a.GetSession())
@@ -53,18 +226,339 @@ func (h *handler) DisConnect(a gate.Agent) {
 	if a.GetSession() != nil {
 		h.sessions.Delete(a.GetSession().GetSessionId())
 		h.agentNum--
+		h.kicked.Delete(a.GetSession().GetSessionId())
+		h.groups.leaveAll(a.GetSession().GetSessionId())
+		if a.GetSession().GetUserId() != "" {
+			h.unbindUser(a, a.GetSession().GetUserId())
+		}
+		if h.gate.GetMailboxStorage() != nil && a.GetSession().GetUserId() != "" && !h.draining() {
+			//在离线消息有效期内发给这个Session的消息都转存到离线消息
+			//排空的网关即将下线,不再记录,发给用户的消息由UserRouter转存
+			h.addOffline(a.GetSession().GetSessionId(), a.GetSession().GetUserId())
+		}
+		h.notify(gate.SessionEvent{
+			Type:      gate.SessionDisconnect,
+			Sessionid: a.GetSession().GetSessionId(),
+			Userid:    a.GetSession().GetUserId(),
+			Version:   a.GetSession().GetVersion(),
+		})
 	}
 	if h.gate.GetSessionLearner() != nil {
 		h.gate.GetSessionLearner().DisConnect(a.GetSession())
 	}
 }
 
+/**
+ *关闭连接时最多等待的时间,慢速客户端的Close会等待发送队列写完
+ */
+const destroyTimeout = 3 * time.Second
+
 func (h *handler) OnDestroy() {
+	//并行关闭,所有连接共用destroyTimeout
+	var wg sync.WaitGroup
 	h.sessions.Range(func(key, value interface{}) bool {
-		value.(gate.Agent).Close()
+		wg.Add(1)
+		go func(a gate.Agent) {
+			defer wg.Done()
+			a.Close()
+		}(value.(gate.Agent))
 		h.sessions.Delete(key)
 		return true
 	})
+	closed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(destroyTimeout):
+		log.Warnf("Gate close connections timeout after %v", destroyTimeout)
+	}
+	h.detachLock.Lock()
+	for Sessionid, ds := range h.detachedId {
+		ds.timer.Stop()
+		delete(h.detached, ds.ClientId)
+		delete(h.detachedId, Sessionid)
+	}
+	h.detachLock.Unlock()
+	h.offlineLock.Lock()
+	for Userid, sessions := range h.offline {
+		for _, timer := range sessions {
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+		delete(h.offline, Userid)
+	}
+	h.offlineId = map[string]string{}
+	h.offlineLock.Unlock()
+}
+
+/**
+ *排空网关,先通知所有客户端重连到其他网关,再在window时间内均匀地关闭连接
+ *避免所有客户端同时重连
+ */
+func (h *handler) OnDrain(topic string, body []byte, window time.Duration) {
+	var agents []gate.Agent
+	h.sessions.Range(func(key, value interface{}) bool {
+		agents = append(agents, value.(gate.Agent))
+		return true
+	})
+	for _, agent := range agents {
+		if err := agent.WriteMsg(topic, body); err != nil {
+			log.Warnf("WriteMsg error: %v", err.Error())
+		}
+	}
+	log.Infof("Gate draining %d connections in %v", len(agents), window)
+	start := time.Now()
+	for i, agent := range agents {
+		if d := time.Until(start.Add(window * time.Duration(i) / time.Duration(len(agents)))); d > 0 {
+			time.Sleep(d)
+		}
+		agent.Close()
+	}
+}
+
+/**
+ *网关是否正在排空
+ */
+func (h *handler) draining() bool {
+	d, ok := h.gate.(interface{ Draining() bool })
+	return ok && d.Draining()
+}
+
+/**
+ *连接断开但保留会话,等待客户端以相同ClientId和恢复令牌重连
+ *网关正在排空时不保留会话,未送达的消息直接存入离线消息,客户端在其他网关Bind时取回
+ */
+func (h *handler) Detach(clientId string, token string, session gate.Session, topics map[string]byte, pending []gate.PendingMessage) {
+	ttl := h.gate.Options().SessionResumeTTL
+	if ttl <= 0 || clientId == "" || token == "" || session == nil {
+		return
+	}
+	if _, ok := h.kicked.Load(session.GetSessionId()); ok {
+		//被踢下线的会话不需要恢复
+		h.kicked.Delete(session.GetSessionId())
+		return
+	}
+	if h.draining() {
+		h.mailboxAll(session.GetUserId(), pending)
+		return
+	}
+	h.detachLock.Lock()
+	defer h.detachLock.Unlock()
+	if old, ok := h.detachedId[session.GetSessionId()]; ok {
+		//会话取回之后新连接还没有注册就断开了,之前缓存的消息排在前面
+		old.timer.Stop()
+		delete(h.detached, old.ClientId)
+		pending = append(old.Pending, pending...)
+	}
+	if old, ok := h.detached[clientId]; ok {
+		old.timer.Stop()
+		delete(h.detachedId, old.Session.GetSessionId())
+	}
+	ds := &detachedSession{
+		DetachedSession: gate.DetachedSession{
+			ClientId: clientId,
+			Session:  session,
+			Topics:   topics,
+		},
+		token:  token,
+		groups: h.groups.joinedGroups(session.GetSessionId()),
+	}
+	ds.timer = time.AfterFunc(ttl, func() {
+		h.detachLock.Lock()
+		if cur, ok := h.detachedId[session.GetSessionId()]; ok && cur == ds {
+			delete(h.detached, clientId)
+			delete(h.detachedId, session.GetSessionId())
+		}
+		h.detachLock.Unlock()
+	})
+	h.detached[clientId] = ds
+	h.detachedId[session.GetSessionId()] = ds
+	for _, msg := range pending {
+		h.appendPending(ds, msg)
+	}
+}
+
+/**
+ *客户端重连时取回暂存的会话,令牌不匹配时不恢复
+ *取回的会话在新连接Connect之前仍然缓存发给它的消息,由Connect补发
+ */
+func (h *handler) Resume(clientId string, token string, cleanSession bool) *gate.DetachedSession {
+	if clientId == "" {
+		return nil
+	}
+	h.detachLock.Lock()
+	defer h.detachLock.Unlock()
+	ds, ok := h.detached[clientId]
+	if !ok {
+		return nil
+	}
+	if cleanSession {
+		//客户端要求一个全新的会话,丢弃之前暂存的
+		ds.timer.Stop()
+		delete(h.detached, clientId)
+		delete(h.detachedId, ds.Session.GetSessionId())
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(ds.token), []byte(token)) != 1 {
+		return nil
+	}
+	delete(h.detached, clientId)
+	ds.resumed = true
+	//新连接没有在有效期内注册时丢弃
+	ds.timer.Reset(h.gate.Options().SessionResumeTTL)
+	return &ds.DetachedSession
+}
+
+/**
+ *记录已断开连接的Session,MailboxTTL为0时离线消息不过期,记录保留到用户重新Bind
+ */
+func (h *handler) addOffline(Sessionid string, Userid string) {
+	var timer *time.Timer
+	if ttl := h.gate.Options().MailboxTTL; ttl > 0 {
+		timer = time.AfterFunc(ttl, func() {
+			h.removeOffline(Sessionid)
+		})
+	}
+	h.offlineLock.Lock()
+	defer h.offlineLock.Unlock()
+	sessions, ok := h.offline[Userid]
+	if !ok {
+		sessions = map[string]*time.Timer{}
+		h.offline[Userid] = sessions
+	}
+	sessions[Sessionid] = timer
+	h.offlineId[Sessionid] = Userid
+}
+
+func (h *handler) removeOffline(Sessionid string) {
+	h.offlineLock.Lock()
+	defer h.offlineLock.Unlock()
+	Userid, ok := h.offlineId[Sessionid]
+	if !ok {
+		return
+	}
+	delete(h.offlineId, Sessionid)
+	if timer := h.offline[Userid][Sessionid]; timer != nil {
+		timer.Stop()
+	}
+	delete(h.offline[Userid], Sessionid)
+	if len(h.offline[Userid]) == 0 {
+		delete(h.offline, Userid)
+	}
+}
+
+/**
+ *用户重新Bind之后不再需要为之前断开的Session转存消息
+ */
+func (h *handler) clearOffline(Userid string) {
+	h.offlineLock.Lock()
+	defer h.offlineLock.Unlock()
+	for Sessionid, timer := range h.offline[Userid] {
+		if timer != nil {
+			timer.Stop()
+		}
+		delete(h.offlineId, Sessionid)
+	}
+	delete(h.offline, Userid)
+}
+
+/**
+ *用户已断开连接,消息存入离线消息等待下一次Bind时发送
+ */
+func (h *handler) mailbox(Sessionid string, topic string, body []byte) bool {
+	mailbox := h.gate.GetMailboxStorage()
+	if mailbox == nil {
+		return false
+	}
+	h.offlineLock.Lock()
+	Userid, ok := h.offlineId[Sessionid]
+	h.offlineLock.Unlock()
+	if !ok {
+		return false
+	}
+	msg := gate.OfflineMessage{
+		Topic: topic,
+		Body:  body,
+	}
+	if h.gate.Options().MailboxTTL > 0 {
+		msg.ExpireAt = time.Now().Add(h.gate.Options().MailboxTTL)
+	}
+	err := mailbox.Push(Userid, msg)
+	if err != nil {
+		log.Warnf("gate mailbox push failure : %s", err.Error())
+		return false
+	}
+	return true
+}
+
+/**
+ *把消息直接存入用户的离线消息
+ */
+func (h *handler) mailboxAll(Userid string, msgs []gate.PendingMessage) {
+	mailbox := h.gate.GetMailboxStorage()
+	if mailbox == nil || Userid == "" {
+		return
+	}
+	for _, m := range msgs {
+		msg := gate.OfflineMessage{
+			Topic: m.Topic,
+			Body:  m.Body,
+		}
+		if h.gate.Options().MailboxTTL > 0 {
+			msg.ExpireAt = time.Now().Add(h.gate.Options().MailboxTTL)
+		}
+		if err := mailbox.Push(Userid, msg); err != nil {
+			log.Warnf("gate mailbox push failure : %s", err.Error())
+		}
+	}
+}
+
+/**
+ *会话处于断线暂存状态时,消息先缓存起来等待重连后发送
+ */
+func (h *handler) pending(Sessionid string, topic string, body []byte) bool {
+	h.detachLock.Lock()
+	defer h.detachLock.Unlock()
+	ds, ok := h.detachedId[Sessionid]
+	if !ok {
+		return false
+	}
+	h.appendPending(ds, gate.PendingMessage{
+		Topic: topic,
+		Body:  body,
+	})
+	return true
+}
+
+func (h *handler) appendPending(ds *detachedSession, msg gate.PendingMessage) {
+	ds.Pending = append(ds.Pending, msg)
+	if max := h.gate.Options().SessionResumeMaxPending; max > 0 && len(ds.Pending) > max {
+		//超出上限丢弃最早的消息
+		ds.Pending = ds.Pending[len(ds.Pending)-max:]
+	}
+}
+
+/**
+ *分组在本网关的在线连接,同时缓存发给断线暂存的分组成员的消息
+ *与Connect恢复会话互斥,恢复中的会话要么收到缓存的消息,要么已经重新加入分组
+ */
+func (h *handler) groupAgents(group string, topic string, body []byte) []gate.Agent {
+	h.detachLock.Lock()
+	defer h.detachLock.Unlock()
+	msg := gate.PendingMessage{Topic: topic, Body: body}
+	for _, ds := range h.detachedId {
+		for _, g := range ds.groups {
+			if g == group {
+				h.appendPending(ds, msg)
+				break
+			}
+		}
+	}
+	return h.groups.agents(group)
 }
 
 func (h *handler) GetAgentNum() int {
@@ -95,6 +589,66 @@ func (h *handler) Update(span log.TraceSpan, Sessionid string) (result gate.Sess
 	return
 }
 
+/**
+ *同一个Userid在线的Session数超过上限时按LoginPolicy踢掉最早登录的Session或者拒绝本次Bind
+ *在bindUser之后调用,所有网关按(LoginAt,Serverid,Sessionid)排序得到相同的结果;
+ *两个网关同时Bind时至少有一个能查到双方的登录记录,所以不会同时放行
+ */
+func (h *handler) checkLogin(span log.TraceSpan, Sessionid string, Userid string) (err string) {
+	max := h.gate.Options().MaxLoginSessions
+	if max <= 0 || Userid == "" {
+		return
+	}
+	module := h.gate.GetModule()
+	locs, err := NewUserRouter(module.GetApp(), module.GetType(), h.gate.GetPresenceHandler()).Locate(Userid)
+	if err != "" || len(locs) <= max {
+		return
+	}
+	sort.Slice(locs, func(i, j int) bool {
+		if locs[i].LoginAt != locs[j].LoginAt {
+			return locs[i].LoginAt < locs[j].LoginAt
+		}
+		if locs[i].Serverid != locs[j].Serverid {
+			return locs[i].Serverid < locs[j].Serverid
+		}
+		return locs[i].Sessionid < locs[j].Sessionid
+	})
+	self := func(loc gate.Location) bool {
+		return loc.Sessionid == Sessionid && loc.Serverid == module.GetServerId()
+	}
+	if h.gate.Options().LoginPolicy == gate.RejectNew {
+		//保留最早登录的max个Session,其他的由各自的网关拒绝
+		for _, loc := range locs[max:] {
+			if self(loc) {
+				return fmt.Sprintf("userId 【%s】 has reached the maximum number of login sessions(%d)", Userid, max)
+			}
+		}
+		return ""
+	}
+	//踢掉除本次登录以外最早登录的Session,本次登录的时间戳可能早于其他Session(时钟偏差)
+	others := make([]gate.Location, 0, len(locs))
+	for _, loc := range locs {
+		if !self(loc) {
+			others = append(others, loc)
+		}
+	}
+	for _, loc := range others[:len(locs)-max] {
+		if loc.Serverid == module.GetServerId() {
+			h.Kick(span, loc.Sessionid, "login elsewhere")
+			continue
+		}
+		server, e := module.GetApp().GetServerById(loc.Serverid)
+		if e != nil {
+			log.Warnf("Service not found id(%s)", loc.Serverid)
+			continue
+		}
+		if _, e := server.Call("Kick", span, loc.Sessionid, "login elsewhere"); e != "" {
+			log.Warnf("gate kick %s@%s error: %s", loc.Sessionid, loc.Serverid, e)
+		}
+	}
+	return ""
+}
+
 /**
  *Bind the session with the the Userid.
  */
@@ -104,62 +658,120 @@ func (h *handler) Bind(span log.TraceSpan, Sessionid string, Userid string) (res
 		err = "No Sesssion found"
 		return
 	}
-	agent.(gate.Agent).GetSession().SetUserId(Userid)
+	if err = h.bind(span, agent.(gate.Agent), agent.(gate.Agent).GetSession().GetUserId(), Userid); err != "" {
+		return
+	}
+	result = agent.(gate.Agent).GetSession()
+	return
+}
 
-	if h.gate.GetStorageHandler() != nil && agent.(gate.Agent).GetSession().GetUserId() != "" {
+/**
+ *把连接绑定到Userid,检查登录数,合并持久化的Settings并发送离线消息
+ *Bind和握手时已经设置了Userid的新连接都走这里
+ */
+func (h *handler) bind(span log.TraceSpan, a gate.Agent, OldUserid string, Userid string) (err string) {
+	Sessionid := a.GetSession().GetSessionId()
+	if OldUserid != "" && OldUserid != Userid {
+		h.unbindUser(a, OldUserid)
+	}
+	a.GetSession().SetUserId(Userid)
+	if Userid != "" {
+		h.bindUser(a, Userid)
+		if OldUserid != Userid {
+			if err = h.checkLogin(span, Sessionid, Userid); err != "" {
+				//拒绝本次Bind,恢复原来的绑定
+				h.unbindUser(a, Userid)
+				a.GetSession().SetUserId(OldUserid)
+				if OldUserid != "" {
+					h.bindUser(a, OldUserid)
+				}
+				return
+			}
+		}
+	}
+	if h.gate.GetStorageHandler() != nil && a.GetSession().GetUserId() != "" {
 		//可以持久化
 		data, err := h.gate.GetStorageHandler().Query(Userid)
 		if err == nil && data != nil {
 			//有已持久化的数据,可能是上一次连接保存的
 			impSession, err := h.gate.NewSession(data)
 			if err == nil {
-				if agent.(gate.Agent).GetSession().GetSettings() == nil {
-					agent.(gate.Agent).GetSession().SetSettings(impSession.GetSettings())
-				} else {
-					//合并两个map 并且以 agent.(Agent).GetSession().Settings 已有的优先
-					settings := impSession.GetSettings()
-					if settings != nil {
-						for k, v := range settings {
-							if _, ok := agent.(gate.Agent).GetSession().GetSettings()[k]; ok {
-								//不用替换
-							} else {
-								agent.(gate.Agent).GetSession().GetSettings()[k] = v
-							}
+				//合并两个map 并且以 a.GetSession().Settings 已有的优先
+				h.updateSettings(a.GetSession(), -1, func(settings map[string]string) map[string]string {
+					for k, v := range impSession.GetSettings() {
+						if _, ok := settings[k]; !ok {
+							settings[k] = v
 						}
 					}
-				}
+					return settings
+				})
 			} else {
 				//解析持久化数据失败
 				log.Warnf("Sesssion Resolve fail %s", err.Error())
 			}
 		}
 		//数据持久化
-		h.gate.GetStorageHandler().Storage(agent.(gate.Agent).GetSession())
+		h.gate.GetStorageHandler().Storage(a.GetSession())
 	}
 
-	result = agent.(gate.Agent).GetSession()
+	//合并持久化的Settings之后再通知,订阅方拿到的是完整的Session
+	h.notify(gate.SessionEvent{
+		Type:      gate.SessionBind,
+		Sessionid: Sessionid,
+		Userid:    Userid,
+		OldUserid: OldUserid,
+		Version:   a.GetSession().GetVersion(),
+	})
+
+	if mailbox := h.gate.GetMailboxStorage(); mailbox != nil && Userid != "" {
+		h.clearOffline(Userid)
+		//发送用户离线期间缓存的消息
+		msgs, e := mailbox.Pull(Userid)
+		if e != nil {
+			log.Warnf("gate mailbox pull failure : %s", e.Error())
+		}
+		for i, msg := range msgs {
+			if e := a.WriteMsg(msg.Topic, msg.Body); e != nil {
+				log.Warnf("WriteMsg error: %v", e.Error())
+				//没有发送成功的消息放回离线消息,等待下一次Bind
+				for _, rest := range msgs[i:] {
+					if e := mailbox.Push(Userid, rest); e != nil {
+						log.Warnf("gate mailbox push failure : %s", e.Error())
+					}
+				}
+				break
+			}
+		}
+	}
 	return
 }
 
 /**
- *查询某一个userId是否连接中，这里只是查询这一个网关里面是否有userId客户端连接，如果有多个网关就需要遍历了
+ *查询某一个userId是否连接中，这里只是查询这一个网关里面是否有userId客户端连接，跨网关查询使用UserRouter.IsOnline
  */
 func (h *handler) IsConnect(span log.TraceSpan, Sessionid string, Userid string) (bool, string) {
-	isconnect := false
-	found := false
-	h.sessions.Range(func(key, agent interface{}) bool {
-		if agent.(gate.Agent).GetSession().GetUserId() == Userid {
-			isconnect = !agent.(gate.Agent).IsClosed()
-			found = true
-			return false
-		}
-		return true
-	})
-	if !found {
+	agents := h.userAgents(Userid)
+	if len(agents) == 0 {
 		return false, fmt.Sprintf("The gateway did not find the corresponding userId 【%s】", Userid)
-	} else {
-		return isconnect, ""
 	}
+	for _, agent := range agents {
+		if !agent.IsClosed() {
+			return true, ""
+		}
+	}
+	return false, ""
+}
+
+/**
+ *查询userId在这个网关的所有Session,每一项为 sessionid|登录时间(毫秒),项之间用,分割
+ */
+func (h *handler) Locate(span log.TraceSpan, Userid string) (string, string) {
+	locs := h.userLogins(Userid)
+	sessionids := make([]string, 0, len(locs))
+	for _, loc := range locs {
+		sessionids = append(sessionids, loc.Sessionid+"|"+strconv.FormatInt(loc.LoginAt, 10))
+	}
+	return strings.Join(sessionids, ","), ""
 }
 
 /**
@@ -171,21 +783,123 @@ func (h *handler) UnBind(span log.TraceSpan, Sessionid string) (result gate.Sess
 		err = "No Sesssion found"
 		return
 	}
+	if old := agent.(gate.Agent).GetSession().GetUserId(); old != "" {
+		h.unbindUser(agent.(gate.Agent), old)
+		h.notify(gate.SessionEvent{
+			Type:      gate.SessionUnBind,
+			Sessionid: Sessionid,
+			Userid:    old,
+			Version:   agent.(gate.Agent).GetSession().GetVersion(),
+		})
+	}
 	agent.(gate.Agent).GetSession().SetUserId("")
 	result = agent.(gate.Agent).GetSession()
 	return
 }
 
+/**
+ *Version与Session的版本一致时(小于0不检查)修改Settings并递增版本,返回变化的key和修改后的版本
+ *Settings写时复制,持久化等读取方不会读到修改了一半的map
+ */
+func (h *handler) applySettings(session gate.Session, Version int64, apply func(settings map[string]string) map[string]string) (changed map[string]string, removed []string, version int64, err string) {
+	h.settingsLock.Lock()
+	defer h.settingsLock.Unlock()
+	if Version >= 0 && Version != session.GetVersion() {
+		err = gate.SessionVersionConflict
+		return
+	}
+	old := session.GetSettings()
+	settings := make(map[string]string, len(old))
+	for k, v := range old {
+		settings[k] = v
+	}
+	settings = apply(settings)
+	session.SetSettings(settings)
+	version = session.GetVersion() + 1
+	session.SetVersion(version)
+	changed, removed = diffSettings(old, settings)
+	return
+}
+
+/**
+ *修改Settings,有变化时通知Session变化事件
+ */
+func (h *handler) updateSettings(session gate.Session, Version int64, apply func(settings map[string]string) map[string]string) (err string) {
+	changed, removed, version, err := h.applySettings(session, Version, apply)
+	if err == "" && (len(changed) > 0 || len(removed) > 0) {
+		h.notify(gate.SessionEvent{
+			Type:      gate.SessionSettings,
+			Sessionid: session.GetSessionId(),
+			Userid:    session.GetUserId(),
+			Version:   version,
+			Changed:   changed,
+			Removed:   removed,
+		})
+	}
+	return
+}
+
 /**
  *Push the session with the the Userid.
  */
 func (h *handler) Push(span log.TraceSpan, Sessionid string, Settings map[string]string) (result gate.Session, err string) {
+	return h.PushCAS(span, Sessionid, Settings, -1)
+}
+
+/**
+ *与Push相同,Version与网关的版本不一致时返回SessionVersionConflict
+ */
+func (h *handler) PushCAS(span log.TraceSpan, Sessionid string, Settings map[string]string, Version int64) (result gate.Session, err string) {
 	agent, ok := h.sessions.Load(Sessionid)
 	if !ok || agent == nil {
 		err = "No Sesssion found"
 		return
 	}
-	agent.(gate.Agent).GetSession().SetSettings(Settings)
+	err = h.updateSettings(agent.(gate.Agent).GetSession(), Version, func(settings map[string]string) map[string]string {
+		return Settings
+	})
+	if err != "" {
+		return
+	}
+	result = agent.(gate.Agent).GetSession()
+	if h.gate.GetStorageHandler() != nil && agent.(gate.Agent).GetSession().GetUserId() != "" {
+		err := h.gate.GetStorageHandler().Storage(agent.(gate.Agent).GetSession())
+		if err != nil {
+			log.Warnf("gate session storage failure : %s", err.Error())
+		}
+	}
+
+	return
+}
+
+/**
+ *只修改Settings中的key并删除Removed中的key,多个模块同时修改不同的key时不会相互覆盖
+ */
+func (h *handler) Patch(span log.TraceSpan, Sessionid string, Settings map[string]string, Removed map[string]string) (result gate.Session, err string) {
+	return h.PatchCAS(span, Sessionid, Settings, Removed, -1)
+}
+
+/**
+ *与Patch相同,Version与网关的版本不一致时返回SessionVersionConflict
+ */
+func (h *handler) PatchCAS(span log.TraceSpan, Sessionid string, Settings map[string]string, Removed map[string]string, Version int64) (result gate.Session, err string) {
+	agent, ok := h.sessions.Load(Sessionid)
+	if !ok || agent == nil {
+		err = "No Sesssion found"
+		return
+	}
+	err = h.updateSettings(agent.(gate.Agent).GetSession(), Version, func(settings map[string]string) map[string]string {
+		for k, v := range Settings {
+			settings[k] = v
+		}
+		for k := range Removed {
+			delete(settings, k)
+		}
+		return settings
+	})
+	if err != "" {
+		return
+	}
 	result = agent.(gate.Agent).GetSession()
 	if h.gate.GetStorageHandler() != nil && agent.(gate.Agent).GetSession().GetUserId() != "" {
 		err := h.gate.GetStorageHandler().Storage(agent.(gate.Agent).GetSession())
@@ -201,12 +915,25 @@ func (h *handler) Push(span log.TraceSpan, Sessionid string, Settings map[string
  *Set values (one or many) for the session.
  */
 func (h *handler) Set(span log.TraceSpan, Sessionid string, key string, value string) (result gate.Session, err string) {
+	return h.SetCAS(span, Sessionid, key, value, -1)
+}
+
+/**
+ *与Set相同,Version与网关的版本不一致时返回SessionVersionConflict
+ */
+func (h *handler) SetCAS(span log.TraceSpan, Sessionid string, key string, value string, Version int64) (result gate.Session, err string) {
 	agent, ok := h.sessions.Load(Sessionid)
 	if !ok || agent == nil {
 		err = "No Sesssion found"
 		return
 	}
-	agent.(gate.Agent).GetSession().GetSettings()[key] = value
+	err = h.updateSettings(agent.(gate.Agent).GetSession(), Version, func(settings map[string]string) map[string]string {
+		settings[key] = value
+		return settings
+	})
+	if err != "" {
+		return
+	}
 	result = agent.(gate.Agent).GetSession()
 
 	if h.gate.GetStorageHandler() != nil && agent.(gate.Agent).GetSession().GetUserId() != "" {
@@ -223,12 +950,25 @@ func (h *handler) Set(span log.TraceSpan, Sessionid string, key string, value st
  *Remove value from the session.
  */
 func (h *handler) Remove(span log.TraceSpan, Sessionid string, key string) (result interface{}, err string) {
+	return h.RemoveCAS(span, Sessionid, key, -1)
+}
+
+/**
+ *与Remove相同,Version与网关的版本不一致时返回SessionVersionConflict
+ */
+func (h *handler) RemoveCAS(span log.TraceSpan, Sessionid string, key string, Version int64) (result interface{}, err string) {
 	agent, ok := h.sessions.Load(Sessionid)
 	if !ok || agent == nil {
 		err = "No Sesssion found"
 		return
 	}
-	delete(agent.(gate.Agent).GetSession().GetSettings(), key)
+	err = h.updateSettings(agent.(gate.Agent).GetSession(), Version, func(settings map[string]string) map[string]string {
+		delete(settings, key)
+		return settings
+	})
+	if err != "" {
+		return
+	}
 	result = agent.(gate.Agent).GetSession()
 
 	if h.gate.GetStorageHandler() != nil && agent.(gate.Agent).GetSession().GetUserId() != "" {
@@ -247,11 +987,24 @@ func (h *handler) Remove(span log.TraceSpan, Sessionid string, key string) (resu
 func (h *handler) Send(span log.TraceSpan, Sessionid string, topic string, body []byte) (result interface{}, err string) {
 	agent, ok := h.sessions.Load(Sessionid)
 	if !ok || agent == nil {
+		if h.pending(Sessionid, topic, body) {
+			result = "pending"
+			return
+		}
+		if h.mailbox(Sessionid, topic, body) {
+			result = "offline"
+			return
+		}
 		err = "No Sesssion found"
 		return
 	}
 	e := agent.(gate.Agent).WriteMsg(topic, body)
 	if e != nil {
+		if h.pending(Sessionid, topic, body) {
+			//连接正在断开,会话已经暂存
+			result = "pending"
+			return
+		}
 		err = e.Error()
 	} else {
 		result = "success"
@@ -268,10 +1021,17 @@ func (h *handler) SendBatch(span log.TraceSpan, SessionidStr string, topic strin
 	for _, sessionid := range sessionids {
 		agent, ok := h.sessions.Load(sessionid)
 		if !ok || agent == nil {
+			if h.pending(sessionid, topic, body) || h.mailbox(sessionid, topic, body) {
+				count++
+			}
 			continue
 		}
 		e := agent.(gate.Agent).WriteMsg(topic, body)
 		if e != nil {
+			if h.pending(sessionid, topic, body) {
+				count++
+				continue
+			}
 			log.Warnf("WriteMsg error: %v", e.Error())
 		} else {
 			count++
@@ -284,7 +1044,7 @@ func (h *handler) BroadCast(span log.TraceSpan, topic string, body []byte) (int6
 	h.sessions.Range(func(key, agent interface{}) bool {
 		e := agent.(gate.Agent).WriteMsg(topic, body)
 		if e != nil {
-			log.Warnf("WriteMsg error:", e.Error())
+			log.Warnf("WriteMsg error: %v", e.Error())
 		} else {
 			count++
 		}
@@ -305,3 +1065,47 @@ func (h *handler) Close(span log.TraceSpan, Sessionid string) (result interface{
 	agent.(gate.Agent).Close()
 	return
 }
+
+/**
+ *通知客户端被踢下线后关闭连接,客户端收到的消息为 KickTopic {"Reason":reason}
+ */
+func (h *handler) Kick(span log.TraceSpan, Sessionid string, reason string) (result interface{}, err string) {
+	agent, ok := h.sessions.Load(Sessionid)
+	if !ok || agent == nil {
+		err = "No Sesssion found"
+		return
+	}
+	h.kicked.Store(Sessionid, true)
+	b, e := h.gate.GetModule().GetApp().ProtocolMarshal(agent.(gate.Agent).GetSession().TraceId(), map[string]interface{}{
+		"Reason": reason,
+	}, "")
+	if e == "" {
+		if we := agent.(gate.Agent).WriteMsg(h.gate.Options().KickTopic, b.GetData()); we != nil {
+			log.Warnf("WriteMsg error: %v", we.Error())
+		}
+	}
+	agent.(gate.Agent).Close()
+	result = "success"
+	return
+}
+
+/**
+ *查询Session发送队列的状态,用于排查慢速客户端
+ */
+func (h *handler) QueueStats(span log.TraceSpan, Sessionid string) (result map[string]interface{}, err string) {
+	agent, ok := h.sessions.Load(Sessionid)
+	if !ok || agent == nil {
+		err = "No Sesssion found"
+		return
+	}
+	queued, ok := agent.(gate.QueuedAgent)
+	if !ok {
+		err = "The agent has no outbound queue"
+		return
+	}
+	result = map[string]interface{}{
+		"Depth":   queued.QueueDepth(),
+		"Dropped": queued.DroppedNum(),
+	}
+	return
+}
@@ -0,0 +1,497 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/gate/mailbox"
+	"github.com/leonlau/mqant/v2/gate/presence"
+	"github.com/leonlau/mqant/v2/module"
+)
+
+/*
+*
+只记录发送的消息的agent
+*/
+type fakeAgent struct {
+	gate.Agent
+	session gate.Session
+	lock    sync.Mutex
+	topics  []string
+	closed  bool
+	broken  bool          //WriteMsg总是失败
+	delay   time.Duration //Close的耗时
+	conn    time.Time
+}
+
+func (a *fakeAgent) GetSession() gate.Session {
+	return a.session
+}
+
+func (a *fakeAgent) WriteMsg(topic string, body []byte) error {
+	a.lock.Lock()
+	if a.broken {
+		a.lock.Unlock()
+		return errors.New("broken pipe")
+	}
+	a.topics = append(a.topics, topic)
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *fakeAgent) ConnTime() time.Time {
+	return a.conn
+}
+
+func (a *fakeAgent) RevNum() int64 {
+	return 0
+}
+
+func (a *fakeAgent) SendNum() int64 {
+	return int64(len(a.sent()))
+}
+
+func (a *fakeAgent) Close() {
+	time.Sleep(a.delay)
+	a.lock.Lock()
+	a.closed = true
+	a.lock.Unlock()
+}
+
+func (a *fakeAgent) sent() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return strings.Join(a.topics, ",")
+}
+
+/*
+*
+没有启动rpc服务的网关模块
+*/
+type testModule struct {
+	module.RPCModule
+}
+
+func (m *testModule) GetApp() module.App  { return &testApp{} }
+func (m *testModule) GetType() string     { return "gate" }
+func (m *testModule) GetServerId() string { return "gate@1" }
+
+type testApp struct {
+	module.App
+}
+
+func (a *testApp) ProtocolMarshal(Trace string, Result interface{}, Error string) (module.ProtocolMarshal, string) {
+	return nil, "not supported"
+}
+
+type testGate struct {
+	*Gate
+}
+
+func (g *testGate) GetModule() module.RPCModule {
+	return &testModule{}
+}
+
+func newTestHandler(opts ...gate.Option) *handler {
+	return NewGateHandler(&testGate{&Gate{opts: gate.NewOptions(opts...)}})
+}
+
+func newTestAgent(t *testing.T, Sessionid string, Userid string) *fakeAgent {
+	session, err := NewSessionByMap(nil, map[string]interface{}{
+		"Sessionid": Sessionid,
+		"Userid":    Userid,
+		"Serverid":  "gate@1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeAgent{session: session}
+}
+
+func TestResumeSession(t *testing.T) {
+	h := newTestHandler(gate.SessionResumeTTL(time.Minute))
+	a := newTestAgent(t, "s1", "")
+	h.Detach("c1", "token", a.GetSession(), nil, []gate.PendingMessage{{Topic: "a"}})
+	if result, err := h.Send(nil, "s1", "b", nil); result != "pending" {
+		t.Fatalf("Send to a detached session = %v %v", result, err)
+	}
+	if h.Resume("c1", "", false) != nil || h.Resume("c1", "wrong", false) != nil {
+		t.Fatal("session must not be resumed without its token")
+	}
+	ds := h.Resume("c1", "token", false)
+	if ds == nil || ds.Session.GetSessionId() != "s1" {
+		t.Fatalf("Resume = %v", ds)
+	}
+	if h.Resume("c1", "token", false) != nil {
+		t.Fatal("session resumed twice")
+	}
+	//取回之后新连接注册之前的消息仍然缓存
+	if result, _ := h.Send(nil, "s1", "c", nil); result != "pending" {
+		t.Fatalf("Send while resuming = %v", result)
+	}
+	resumed := &fakeAgent{session: ds.Session}
+	h.Connect(resumed)
+	if result, _ := h.Send(nil, "s1", "d", nil); result != "success" {
+		t.Fatalf("Send after Connect = %v", result)
+	}
+	if got := resumed.sent(); got != "a,b,c,d" {
+		t.Fatalf("messages delivered as %s, want a,b,c,d", got)
+	}
+}
+
+func TestResumeDisabledByDefault(t *testing.T) {
+	h := newTestHandler()
+	a := newTestAgent(t, "s1", "")
+	h.Detach("c1", "token", a.GetSession(), nil, nil)
+	if h.Resume("c1", "token", false) != nil {
+		t.Fatal("sessions must not be kept unless SessionResumeTTL is set")
+	}
+}
+
+func TestResumeTokenFromPassword(t *testing.T) {
+	str := func(s string) *string { return &s }
+	enabled := gate.NewOptions(gate.SessionResumeTTL(time.Minute))
+	for _, c := range []struct {
+		opts     gate.Options
+		password *string
+		want     string
+	}{
+		{enabled, nil, ""},
+		{enabled, str("secret"), ""},
+		{enabled, str(ResumeTokenPrefix + "abc"), "abc"},
+		{gate.NewOptions(), str(ResumeTokenPrefix + "abc"), ""},
+	} {
+		if got := resumeToken(c.opts, c.password); got != c.want {
+			t.Fatalf("resumeToken(%v) = %q, want %q", c.password, got, c.want)
+		}
+	}
+}
+
+func TestRefreshPresence(t *testing.T) {
+	p := presence.NewMemoryPresence(presence.TTL(200 * time.Millisecond))
+	h := newTestHandler(gate.SetPresenceHandler(p))
+	a := newTestAgent(t, "s1", "u1")
+	b := newTestAgent(t, "s2", "u2")
+	h.bindUser(a, "u1")
+	h.bindUser(b, "u2")
+	h.unbindUser(b, "u2")
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		h.refreshPresence()
+	}
+	if locs, _ := p.Locate("u1"); len(locs) != 1 || locs[0].Sessionid != "s1" {
+		t.Fatalf("refreshed user should stay online, got %v", locs)
+	}
+	if locs, _ := p.Locate("u2"); len(locs) != 0 {
+		t.Fatalf("unbound user should be offline, got %v", locs)
+	}
+	//网关不再续期以后记录过期
+	time.Sleep(250 * time.Millisecond)
+	if locs, _ := p.Locate("u1"); len(locs) != 0 {
+		t.Fatalf("stale location should expire, got %v", locs)
+	}
+}
+
+func TestMaxLoginSessions(t *testing.T) {
+	for _, policy := range []gate.LoginPolicy{gate.KickOld, gate.RejectNew} {
+		h := newTestHandler(
+			gate.SetPresenceHandler(presence.NewMemoryPresence()),
+			gate.MaxLoginSessions(2),
+			gate.SetLoginPolicy(policy),
+		)
+		agents := make([]*fakeAgent, 0)
+		for _, Sessionid := range []string{"s3", "s1", "s2"} {
+			a := newTestAgent(t, Sessionid, "")
+			h.Connect(a)
+			agents = append(agents, a)
+		}
+		for i, a := range agents {
+			time.Sleep(2 * time.Millisecond)
+			_, err := h.Bind(nil, a.GetSession().GetSessionId(), "u1")
+			if i < 2 && err != "" {
+				t.Fatalf("policy %v: Bind %d failed: %s", policy, i, err)
+			}
+			if i == 2 && (err != "") != (policy == gate.RejectNew) {
+				t.Fatalf("policy %v: third Bind = %q", policy, err)
+			}
+		}
+		//踢掉的是最早登录的Session,与Sessionid的顺序无关
+		closed := []bool{agents[0].closed, agents[1].closed, agents[2].closed}
+		if policy == gate.KickOld && (!closed[0] || closed[1] || closed[2]) {
+			t.Fatalf("KickOld should kick the oldest login, closed = %v", closed)
+		}
+		if policy == gate.RejectNew {
+			if closed[0] || closed[1] || closed[2] {
+				t.Fatalf("RejectNew should not kick, closed = %v", closed)
+			}
+			if agents[2].GetSession().GetUserId() != "" {
+				t.Fatal("rejected session should keep its old Userid")
+			}
+			if locs, _ := h.gate.GetPresenceHandler().Locate("u1"); len(locs) != 2 {
+				t.Fatalf("rejected session should be offline, got %v", locs)
+			}
+		}
+	}
+}
+
+func TestKickOldExcludesSelf(t *testing.T) {
+	p := presence.NewMemoryPresence()
+	h := newTestHandler(
+		gate.SetPresenceHandler(p),
+		gate.MaxLoginSessions(2),
+		gate.SetLoginPolicy(gate.KickOld),
+	)
+	agents := make([]*fakeAgent, 0)
+	for _, Sessionid := range []string{"s1", "s2", "s3"} {
+		a := newTestAgent(t, Sessionid, "")
+		h.Connect(a)
+		agents = append(agents, a)
+	}
+	//其他网关的时钟较快,本次登录的时间戳反而最早
+	later := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	for i, a := range agents[1:] {
+		p.Online(gate.Location{Userid: "u1", Serverid: "gate@1", Sessionid: a.GetSession().GetSessionId(), LoginAt: later + int64(i)})
+	}
+	if _, err := h.Bind(nil, "s1", "u1"); err != "" {
+		t.Fatal(err)
+	}
+	if agents[0].closed || !agents[1].closed || agents[2].closed {
+		t.Fatalf("closed s1 %v s2 %v s3 %v, want only s2", agents[0].closed, agents[1].closed, agents[2].closed)
+	}
+}
+
+func TestConnectWithUserid(t *testing.T) {
+	box := mailbox.NewMemoryMailbox()
+	box.Push("u1", gate.OfflineMessage{Topic: "offline", ExpireAt: time.Now().Add(time.Minute)})
+	h := newTestHandler(
+		gate.SetPresenceHandler(presence.NewMemoryPresence()),
+		gate.SetMailboxStorage(box),
+		gate.MaxLoginSessions(1),
+		gate.SetLoginPolicy(gate.RejectNew),
+	)
+	//握手时已经设置了Userid的连接与Bind一样发送离线消息并检查登录数
+	a1 := newTestAgent(t, "s1", "u1")
+	h.Connect(a1)
+	if a1.sent() != "offline" || a1.closed {
+		t.Fatalf("first login sent %q closed %v", a1.sent(), a1.closed)
+	}
+	time.Sleep(2 * time.Millisecond)
+	a2 := newTestAgent(t, "s2", "u1")
+	h.Connect(a2)
+	if !a2.closed || a2.GetSession().GetUserId() != "" {
+		t.Fatalf("second login should be rejected, closed %v Userid %q", a2.closed, a2.GetSession().GetUserId())
+	}
+	if locs, _ := h.gate.GetPresenceHandler().Locate("u1"); len(locs) != 1 || locs[0].Sessionid != "s1" {
+		t.Fatalf("rejected session should be offline, got %v", locs)
+	}
+}
+
+func TestOfflineMailbox(t *testing.T) {
+	box := mailbox.NewMemoryMailbox()
+	//MailboxTTL为0时离线消息不过期
+	h := newTestHandler(gate.SetMailboxStorage(box), gate.MailboxTTL(0))
+	a1 := newTestAgent(t, "s1", "u1")
+	h.Connect(a1)
+	h.DisConnect(a1)
+	time.Sleep(10 * time.Millisecond)
+	if result, err := h.Send(nil, "s1", "a", nil); result != "offline" {
+		t.Fatalf("Send to a disconnected session = %v %v", result, err)
+	}
+	h.Send(nil, "s1", "b", nil)
+
+	//发送失败的离线消息放回mailbox
+	a2 := newTestAgent(t, "s2", "u1")
+	a2.broken = true
+	h.Connect(a2)
+	if result, _ := h.Send(nil, "s1", "c", nil); result == "offline" {
+		t.Fatal("disconnected sessions must be forgotten after the user binds again")
+	}
+	h.DisConnect(a2)
+
+	a3 := newTestAgent(t, "s3", "u1")
+	h.Connect(a3)
+	if got := a3.sent(); got != "a,b" {
+		t.Fatalf("offline messages delivered as %q, want a,b", got)
+	}
+}
+
+func TestDrainingDetach(t *testing.T) {
+	box := mailbox.NewMemoryMailbox()
+	h := newTestHandler(gate.SetMailboxStorage(box), gate.SessionResumeTTL(time.Minute))
+	h.gate.(*testGate).draining = true
+	a := newTestAgent(t, "s1", "u1")
+	h.Connect(a)
+	h.DisConnect(a)
+	//排空时不保留会话,未送达的消息直接存入离线消息
+	h.Detach("c1", "token", a.GetSession(), nil, []gate.PendingMessage{{Topic: "a"}, {Topic: "b"}})
+	if h.Resume("c1", "token", false) != nil {
+		t.Fatal("a draining gate must not keep detached sessions")
+	}
+	if result, _ := h.Send(nil, "s1", "c", nil); result == "offline" || result == "pending" {
+		t.Fatalf("Send to a session closed while draining = %v", result)
+	}
+	msgs, err := box.Pull("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := make([]string, 0)
+	for _, m := range msgs {
+		topics = append(topics, m.Topic)
+	}
+	if got := strings.Join(topics, ","); got != "a,b" {
+		t.Fatalf("mailbox = %q, want a,b", got)
+	}
+}
+
+func TestDestroyParallel(t *testing.T) {
+	h := newTestHandler()
+	agents := make([]*fakeAgent, 0)
+	for i := 0; i < 10; i++ {
+		a := newTestAgent(t, "s"+string(rune('0'+i)), "")
+		a.delay = 200 * time.Millisecond
+		h.Connect(a)
+		agents = append(agents, a)
+	}
+	start := time.Now()
+	h.OnDestroy()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("OnDestroy took %v, agents must be closed in parallel", d)
+	}
+	for _, a := range agents {
+		a.lock.Lock()
+		closed := a.closed
+		a.lock.Unlock()
+		if !closed {
+			t.Fatalf("agent %s not closed", a.GetSession().GetSessionId())
+		}
+	}
+}
+
+func TestSettingsCAS(t *testing.T) {
+	h := newTestHandler()
+	a := newTestAgent(t, "s1", "")
+	h.Connect(a)
+	if _, err := h.Push(nil, "s1", map[string]string{"a": "1", "b": "2"}); err != "" {
+		t.Fatal(err)
+	}
+	if _, err := h.Set(nil, "s1", "c", "3"); err != "" {
+		t.Fatal(err)
+	}
+	//Push和Set不检查版本
+	if v := a.GetSession().GetVersion(); v != 2 {
+		t.Fatalf("Version = %d", v)
+	}
+	if _, err := h.PushCAS(nil, "s1", map[string]string{}, 1); err != gate.SessionVersionConflict {
+		t.Fatalf("PushCAS with a stale version = %q", err)
+	}
+	if _, err := h.SetCAS(nil, "s1", "a", "x", 1); err != gate.SessionVersionConflict {
+		t.Fatalf("SetCAS with a stale version = %q", err)
+	}
+	if _, err := h.RemoveCAS(nil, "s1", "a", 1); err != gate.SessionVersionConflict {
+		t.Fatalf("RemoveCAS with a stale version = %q", err)
+	}
+	if _, err := h.PatchCAS(nil, "s1", nil, map[string]string{"b": ""}, 1); err != gate.SessionVersionConflict {
+		t.Fatalf("PatchCAS with a stale version = %q", err)
+	}
+	if a.GetSession().Get("a") != "1" || a.GetSession().Get("b") != "2" {
+		t.Fatalf("conflicting writes must not apply, got %v", a.GetSession().GetSettings())
+	}
+	if _, err := h.RemoveCAS(nil, "s1", "a", 2); err != "" {
+		t.Fatal(err)
+	}
+	if _, err := h.SetCAS(nil, "s1", "b", "x", 3); err != "" {
+		t.Fatal(err)
+	}
+	if a.GetSession().Get("a") != "" || a.GetSession().Get("b") != "x" || a.GetSession().GetVersion() != 4 {
+		t.Fatalf("unexpected session %v %d", a.GetSession().GetSettings(), a.GetSession().GetVersion())
+	}
+}
+
+func TestPatch(t *testing.T) {
+	h := newTestHandler()
+	a := newTestAgent(t, "s1", "")
+	h.Connect(a)
+	if _, err := h.Push(nil, "s1", map[string]string{"a": "1", "b,c": "2", "d": "3"}); err != "" {
+		t.Fatal(err)
+	}
+	//不同模块修改不同的key,持有旧版本也不会被拒绝
+	if _, err := h.Patch(nil, "s1", map[string]string{"e": "5"}, nil); err != "" {
+		t.Fatal(err)
+	}
+	if _, err := h.Patch(nil, "s1", map[string]string{"a": "x"}, map[string]string{"b,c": ""}); err != "" {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "x", "d": "3", "e": "5"}
+	if got := a.GetSession().GetSettings(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Settings = %v, want %v", got, want)
+	}
+	if _, err := h.PatchCAS(nil, "s1", map[string]string{"a": "y"}, nil, 1); err != gate.SessionVersionConflict {
+		t.Fatalf("PatchCAS with a stale version = %q", err)
+	}
+	if _, err := h.PatchCAS(nil, "s1", map[string]string{"a": "y"}, nil, a.GetSession().GetVersion()); err != "" {
+		t.Fatal(err)
+	}
+}
+
+type eventLearner struct {
+	events []gate.SessionEvent
+}
+
+func (l *eventLearner) Connect(a gate.Session)    {}
+func (l *eventLearner) DisConnect(a gate.Session) {}
+func (l *eventLearner) OnSessionEvent(event gate.SessionEvent) {
+	l.events = append(l.events, event)
+}
+
+type testStorage struct {
+	data []byte
+}
+
+func (s *testStorage) Storage(session gate.Session) error  { return nil }
+func (s *testStorage) Delete(session gate.Session) error   { return nil }
+func (s *testStorage) Query(Userid string) ([]byte, error) { return s.data, nil }
+func (s *testStorage) Heartbeat(session gate.Session)      {}
+
+func TestBindEventAfterMerge(t *testing.T) {
+	saved, _ := NewSessionByMap(nil, map[string]interface{}{
+		"Settings": map[string]string{"lv": "7"},
+	})
+	data, _ := saved.Serializable()
+	learner := &eventLearner{}
+	h := newTestHandler(gate.SetSessionLearner(learner), gate.SetStorageHandler(&testStorage{data: data}))
+	a := newTestAgent(t, "s1", "")
+	h.Connect(a)
+	if _, err := h.Bind(nil, "s1", "u1"); err != "" {
+		t.Fatal(err)
+	}
+	var bind *gate.SessionEvent
+	for i, event := range learner.events {
+		if event.Type == gate.SessionBind {
+			bind = &learner.events[i]
+			if i == 0 || learner.events[i-1].Type != gate.SessionSettings {
+				t.Fatalf("SessionBind must follow the merged settings, events %v", learner.events)
+			}
+		}
+	}
+	if bind == nil || bind.Version != a.GetSession().GetVersion() || a.GetSession().Get("lv") != "7" {
+		t.Fatalf("bind event %v, session %v %d", bind, a.GetSession().GetSettings(), a.GetSession().GetVersion())
+	}
+}
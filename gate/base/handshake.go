@@ -0,0 +1,116 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/leonlau/mqant/v2/utils/aes"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"io/ioutil"
+)
+
+/**
+mqtt/binary协议的负载加密,用于不能使用TLS的客户端
+客户端在CONNECT之后发送 HandshakeTopic,消息体为X25519临时公钥(32字节)
+网关回复自己的X25519临时公钥(32字节)+Ed25519签名(64字节),失败时回复 "none"
+签名内容为 HandshakeSalt+客户端公钥+网关公钥,客户端必须用预先配置的网关Ed25519公钥验证签名,防止中间人替换公钥
+双方用 HKDF-SHA256(共享密钥, salt=客户端公钥+网关公钥) 分别派生两个方向的AES-256-GCM密钥,
+info为 HandshakeSalt+" c2s" 和 HandshakeSalt+" s2c"
+收到回复之后双方的消息体都为 计数器(8字节,大端)+密文+认证标签,计数器从1开始每条消息加1,
+nonce为4字节0+计数器,topic作为附加认证数据,计数器不大于上一条消息的会被拒绝
+同时协商了负载压缩时先压缩再加密
+*/
+const HandshakeTopic = "$gate/handshake"
+
+const HandshakeSalt = "mqant-gate"
+
+/**
+负载加密的两个方向的密钥
+*/
+type payloadCipher struct {
+	seal *aes.GcmEncrypt //网关发给客户端
+	open *aes.GcmEncrypt //客户端发给网关
+}
+
+/**
+用客户端的公钥完成密钥交换,返回回复给客户端的消息体和会话密钥
+*/
+func handshake(key ed25519.PrivateKey, clientPub []byte) (reply []byte, c *payloadCipher, err error) {
+	if key == nil {
+		return nil, nil, fmt.Errorf("handshake key not configured")
+	}
+	if len(clientPub) != curve25519.PointSize {
+		return nil, nil, fmt.Errorf("invalid public key")
+	}
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	serverPub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	//低阶点得到全0的共享密钥时返回错误
+	shared, err := curve25519.X25519(priv, clientPub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid public key")
+	}
+	transcript := append(append([]byte(HandshakeSalt), clientPub...), serverPub...)
+	c = &payloadCipher{}
+	if c.open, err = handshakeKey(shared, transcript[len(HandshakeSalt):], " c2s"); err != nil {
+		return nil, nil, err
+	}
+	if c.seal, err = handshakeKey(shared, transcript[len(HandshakeSalt):], " s2c"); err != nil {
+		return nil, nil, err
+	}
+	return append(serverPub, ed25519.Sign(key, transcript)...), c, nil
+}
+
+func handshakeKey(shared, salt []byte, direction string) (*aes.GcmEncrypt, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(HandshakeSalt+direction)), key); err != nil {
+		return nil, err
+	}
+	return aes.NewGcmEncrypt(key)
+}
+
+/**
+读取PEM(PKCS#8)格式的Ed25519私钥,用于签名密钥交换
+*/
+func loadHandshakeKey(file string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", file)
+	}
+	return k, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/leonlau/mqant/v2/utils/aes"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"testing"
+)
+
+//客户端一侧的密钥交换
+func clientHandshake(t *testing.T, serverKey ed25519.PublicKey, send func(pub []byte) []byte) (c2s, s2c *aes.GcmEncrypt) {
+	priv := make([]byte, curve25519.ScalarSize)
+	rand.Read(priv)
+	clientPub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := send(clientPub)
+	if len(reply) != 32+ed25519.SignatureSize {
+		t.Fatalf("handshake reply length %d", len(reply))
+	}
+	serverPub, sig := reply[:32], reply[32:]
+	transcript := append(append([]byte(HandshakeSalt), clientPub...), serverPub...)
+	if !ed25519.Verify(serverKey, transcript, sig) {
+		t.Fatal("handshake signature must verify with the server key")
+	}
+	shared, _ := curve25519.X25519(priv, serverPub)
+	derive := func(direction string) *aes.GcmEncrypt {
+		key := make([]byte, 32)
+		io.ReadFull(hkdf.New(sha256.New, shared, transcript[len(HandshakeSalt):], []byte(HandshakeSalt+direction)), key)
+		c, _ := aes.NewGcmEncrypt(key)
+		return c
+	}
+	return derive(" c2s"), derive(" s2c")
+}
+
+func TestHandshake(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	var server *payloadCipher
+	c2s, s2c := clientHandshake(t, pub, func(clientPub []byte) []byte {
+		reply, c, err := handshake(key, clientPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server = c
+		return reply
+	})
+
+	b, _ := c2s.Seal([]byte("up"), []byte("topic"))
+	if got, err := server.open.Open(b, []byte("topic")); err != nil || string(got) != "up" {
+		t.Fatalf("server open = %q %v", got, err)
+	}
+	if _, err := server.open.Open(b, []byte("topic")); err == nil {
+		t.Fatal("replayed client message must be rejected")
+	}
+	b, _ = server.seal.Seal([]byte("down"), []byte("topic"))
+	if got, err := s2c.Open(b, []byte("topic")); err != nil || string(got) != "down" {
+		t.Fatalf("client open = %q %v", got, err)
+	}
+	//两个方向的密钥不同,网关发出的消息不能被当作客户端的消息接受
+	b, _ = server.seal.Seal([]byte("reflect"), []byte("topic"))
+	if _, err := server.open.Open(b, []byte("topic")); err == nil {
+		t.Fatal("reflected message must be rejected")
+	}
+
+	if _, _, err := handshake(key, bytes.Repeat([]byte{1}, 65)); err == nil {
+		t.Fatal("invalid public key must be rejected")
+	}
+	if _, _, err := handshake(key, make([]byte, 32)); err == nil {
+		t.Fatal("low order public key must be rejected")
+	}
+	if _, _, err := handshake(nil, make([]byte, 32)); err == nil {
+		t.Fatal("handshake without a signing key must fail")
+	}
+}
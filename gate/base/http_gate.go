@@ -0,0 +1,252 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"fmt"
+	"github.com/leonlau/mqant/v2/conf"
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+	"github.com/leonlau/mqant/v2/module"
+	"github.com/leonlau/mqant/v2/module/base"
+	"github.com/leonlau/mqant/v2/utils"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/**
+HTTP网关,把 POST /{moduleType}/{handler} 转发给后端模块的HD_handler
+请求体与mqtt的PUBLISH消息体相同,返回值经过App.ProtocolMarshal后作为响应体
+每个请求都会创建一个临时Session,后端不能通过它给客户端推送消息
+*/
+type HttpGate struct {
+	basemodule.BaseModule
+	HTTPAddr       string
+	HTTPTimeout    time.Duration
+	MaxBodySize    int64
+	MaxHeaderBytes int
+
+	//tls
+	Tls      bool
+	CertFile string
+	KeyFile  string
+
+	authHandler func(r *http.Request, session gate.Session) error
+	server      *http.Server
+}
+
+/**
+默认的鉴权方式,不信任请求中的任何身份信息,所有请求都是访客(Userid为空)
+需要登录态时通过SetAuthHandler设置自己的鉴权函数(校验令牌等)
+*/
+func DefaultHttpAuth(r *http.Request, session gate.Session) error {
+	return nil
+}
+
+/**
+信任鉴权代理设置的请求头,只能在网关部署在鉴权代理之后,并且代理会删除客户端自带的这些请求头时使用
+X-User-Id 绑定为Session的Userid
+X-Session-{Key} 写入Session的Settings
+需要显式调用 SetAuthHandler(ProxyHeaderAuth) 启用
+*/
+func ProxyHeaderAuth(r *http.Request, session gate.Session) error {
+	if userId := r.Header.Get("X-User-Id"); userId != "" {
+		session.SetUserId(userId)
+	}
+	settings := session.GetSettings()
+	if settings == nil {
+		settings = map[string]string{}
+	}
+	for key, values := range r.Header {
+		if strings.HasPrefix(key, "X-Session-") && len(values) > 0 {
+			//临时Session只在本地修改,不需要同步给网关
+			settings[strings.TrimPrefix(key, "X-Session-")] = values[0]
+		}
+	}
+	session.SetSettings(settings)
+	return nil
+}
+
+/**
+设置从HTTP请求构建Session的函数,返回错误时响应401
+*/
+func (this *HttpGate) SetAuthHandler(auth func(r *http.Request, session gate.Session) error) error {
+	this.authHandler = auth
+	return nil
+}
+
+func (this *HttpGate) OnInit(subclass module.RPCModule, app module.App, settings *conf.ModuleSettings) {
+	this.BaseModule.OnInit(subclass, app, settings) //这是必须的
+	if HTTPAddr, ok := settings.Settings["HTTPAddr"]; ok {
+		this.HTTPAddr = HTTPAddr.(string)
+	}
+	if HTTPTimeout, ok := settings.Settings["HTTPTimeout"]; ok {
+		this.HTTPTimeout = time.Second * time.Duration(HTTPTimeout.(float64))
+	} else {
+		this.HTTPTimeout = time.Second * 10
+	}
+	if MaxBodySize, ok := settings.Settings["MaxBodySize"]; ok {
+		this.MaxBodySize = int64(MaxBodySize.(float64))
+	} else {
+		this.MaxBodySize = 1 << 20
+	}
+	if MaxHeaderBytes, ok := settings.Settings["MaxHeaderBytes"]; ok {
+		this.MaxHeaderBytes = int(MaxHeaderBytes.(float64))
+	} else {
+		this.MaxHeaderBytes = 1 << 16
+	}
+	if Tls, ok := settings.Settings["Tls"]; ok {
+		this.Tls = Tls.(bool)
+	}
+	if CertFile, ok := settings.Settings["CertFile"]; ok {
+		this.CertFile = CertFile.(string)
+	}
+	if KeyFile, ok := settings.Settings["KeyFile"]; ok {
+		this.KeyFile = KeyFile.(string)
+	}
+	if this.authHandler == nil {
+		this.authHandler = DefaultHttpAuth
+	}
+}
+
+func (this *HttpGate) OnAppConfigurationLoaded(app module.App) {
+	//后端返回的Session和ProtocolMarshal需要反序列化
+	this.BaseModule.OnAppConfigurationLoaded(app) //这是必须的
+	err := app.AddRPCSerialize("httpgate", this)
+	if err != nil {
+		log.Warnf("Adding session structures failed to serialize interfaces %s", err.Error())
+	}
+}
+
+func (this *HttpGate) Serialize(param interface{}) (ptype string, p []byte, err error) {
+	return serializeParam(param)
+}
+
+func (this *HttpGate) Deserialize(ptype string, b []byte) (param interface{}, err error) {
+	return deserializeParam(this.App, ptype, b)
+}
+
+func (this *HttpGate) GetTypes() []string {
+	return []string{RPC_PARAM_SESSION_TYPE}
+}
+
+func (this *HttpGate) Run(closeSig chan bool) {
+	if this.HTTPAddr == "" {
+		<-closeSig
+		return
+	}
+	ln, err := net.Listen("tcp", this.HTTPAddr)
+	if err != nil {
+		log.Warnf("%v", err)
+		<-closeSig
+		return
+	}
+	this.server = &http.Server{
+		Addr:           this.HTTPAddr,
+		Handler:        this,
+		ReadTimeout:    this.HTTPTimeout,
+		WriteTimeout:   this.HTTPTimeout,
+		MaxHeaderBytes: this.MaxHeaderBytes,
+	}
+	log.Infof("HTTP Listen :%s", this.HTTPAddr)
+	go func() {
+		if this.Tls {
+			err = this.server.ServeTLS(ln, this.CertFile, this.KeyFile)
+		} else {
+			err = this.server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Warnf("http gate serve: %v", err)
+		}
+	}()
+	<-closeSig
+	this.server.Close()
+}
+
+func (this *HttpGate) OnDestroy() {
+	this.BaseModule.OnDestroy() //这是必须的
+}
+
+func (this *HttpGate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topics := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(topics) != 2 {
+		http.Error(w, "Path must be /[moduleType]/[handler]", http.StatusNotFound)
+		return
+	}
+	if !strings.HasPrefix(topics[1], "HD_") {
+		http.Error(w, fmt.Sprintf("Method(%s) must begin with 'HD_'", topics[1]), http.StatusNotFound)
+		return
+	}
+	msg, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, this.MaxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	session, err := NewSessionByMap(this.App, map[string]interface{}{
+		"Sessionid": utils.GenerateID().String(),
+		"Network":   "http",
+		"IP":        r.RemoteAddr,
+		"Serverid":  this.GetServerId(),
+		"Settings":  make(map[string]string),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := this.authHandler(r, session); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	session.CreateTrace()
+	session.SetTopic(topics[0] + "/" + topics[1])
+
+	hash := session.GetUserId()
+	if hash == "" {
+		hash = this.GetServerId()
+	}
+	serverSession, err := this.GetRouteServer(topics[0], hash)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Service(type:%s) not found", topics[0]), http.StatusNotFound)
+		return
+	}
+	ArgsType, args, errstr := routeArgs(session, msg)
+	if errstr != "" {
+		http.Error(w, errstr, http.StatusBadRequest)
+		return
+	}
+	result, e := serverSession.CallArgs(topics[1], ArgsType, args)
+	var body []byte
+	switch v2 := result.(type) {
+	case module.ProtocolMarshal:
+		body = v2.GetData()
+	default:
+		b, perr := this.App.ProtocolMarshal(session.TraceId(), result, e)
+		if perr != "" {
+			log.Error(perr)
+			b, _ = this.App.ProtocolMarshal(session.TraceId(), nil, perr)
+		}
+		if b != nil {
+			body = b.GetData()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,65 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHttpAuth(t *testing.T) {
+	r := httptest.NewRequest("POST", "/chat/HD_Say", nil)
+	r.Header.Set("X-User-Id", "admin")
+	r.Header.Set("X-Session-Role", "root")
+	session, err := NewSessionByMap(nil, map[string]interface{}{"Sessionid": "s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DefaultHttpAuth(r, session); err != nil {
+		t.Fatal(err)
+	}
+	if session.GetUserId() != "" || session.Get("Role") != "" {
+		t.Fatal("the default auth must not trust client headers")
+	}
+	if err := ProxyHeaderAuth(r, session); err != nil {
+		t.Fatal(err)
+	}
+	if session.GetUserId() != "admin" || session.Get("Role") != "root" {
+		t.Fatalf("ProxyHeaderAuth = %q %q", session.GetUserId(), session.Get("Role"))
+	}
+}
+
+func TestHttpGateReject(t *testing.T) {
+	g := &HttpGate{MaxBodySize: 4}
+	for _, c := range []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"GET", "/chat/HD_Say", "", http.StatusMethodNotAllowed},
+		{"POST", "/chat", "", http.StatusNotFound},
+		{"POST", "/chat/HD_Say/1", "", http.StatusNotFound},
+		{"POST", "/chat/Say", "", http.StatusNotFound},
+		{"POST", "/chat/HD_Say", "too large", http.StatusRequestEntityTooLarge},
+	} {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if w.Code != c.code {
+			t.Errorf("%s %s = %d, want %d", c.method, c.path, w.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/leonlau/mqant/v2/conf"
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+	"github.com/leonlau/mqant/v2/module"
+	"github.com/leonlau/mqant/v2/network"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+客户端请求
+Id 不为空时网关会回复,route为空的请求表示心跳包
+*/
+type JsonRequest struct {
+	Id    json.RawMessage `json:"id,omitempty"`
+	Route string          `json:"route"`
+	Body  json.RawMessage `json:"body,omitempty"`
+}
+
+/**
+网关回复
+*/
+type JsonResponse struct {
+	Id     json.RawMessage `json:"id"`
+	Result interface{}     `json:"result"`
+	Error  string          `json:"error,omitempty"`
+}
+
+/**
+服务端推送
+*/
+type JsonPush struct {
+	Route string      `json:"route"`
+	Body  interface{} `json:"body"`
+}
+
+type messageWriter interface {
+	WriteMessage(messageType int, p []byte) error
+}
+
+/**
+JSON协议agent,面向浏览器客户端
+websocket连接上每条消息是一个JSON对象,其他连接上以换行分隔
+*/
+type jsonAgent struct {
+	baseAgent
+	dec   *json.Decoder
+	wlock sync.Mutex
+}
+
+func NewJsonAgent(module module.RPCModule) *jsonAgent {
+	a := &jsonAgent{}
+	a.module = module
+	return a
+}
+
+func (this *jsonAgent) OnInit(gate gate.Gate, conn network.Conn) error {
+	this.init(this, gate, conn)
+	this.dec = json.NewDecoder(conn)
+	this.startQueue(this.write)
+	return nil
+}
+
+func (a *jsonAgent) Run() (err error) {
+	defer func() {
+		if err := recover(); err != nil {
+			buff := make([]byte, 4096)
+			runtime.Stack(buff, false)
+			log.Errorf("conn.serve() panic(%v)\n info:%s", err, string(buff))
+		}
+		a.Close()
+	}()
+	a.session, err = a.newSession()
+	if err != nil {
+		log.Errorf("gate create agent fail %v", err)
+		return
+	}
+	a.session.JudgeGuest(a.gate.GetJudgeGuest())
+	a.session.CreateTrace()             //代码跟踪
+	a.gate.GetAgentLearner().Connect(a) //发送连接成功的事件
+	a.conn_time = time.Now()
+
+	alive := conf.Conf.Mqtt.ReadTimeout
+	if alive < 1 {
+		alive = 60
+	}
+	for {
+		a.conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(float64(alive)*1.5)))
+		req := new(JsonRequest)
+		if e := a.dec.Decode(req); e != nil {
+			return nil
+		}
+		if string(req.Id) == "null" {
+			req.Id = nil
+		}
+		if strings.Contains(string(req.Id), "/") {
+			//id会拼接到topic中作为请求序号
+			a.reply(req.Id, nil, "id must not contain /")
+			continue
+		}
+		if req.Route == "" {
+			//客户端发送的心跳包
+			a.heartbeat()
+			if len(req.Id) > 0 {
+				a.reply(req.Id, nil, "")
+			}
+			continue
+		}
+		if !a.allow(func(Error string) {
+			a.reply(req.Id, nil, Error)
+		}) {
+			continue
+		}
+		if e := a.Wait(); e != nil {
+			log.Warnf("Gate OnRecover error [%v]", e)
+			if len(req.Id) > 0 {
+				a.reply(req.Id, nil, e.Error())
+			}
+			continue
+		}
+		go a.recoverworker(req)
+	}
+}
+
+func (a *jsonAgent) recoverworker(req *JsonRequest) {
+	defer a.recoverDone()
+	topic := req.Route
+	if len(req.Id) > 0 && strings.Count(topic, "/") < 2 {
+		//带上msgid,后端处理完以后回复客户端
+		topic = topic + "/" + strings.Trim(string(req.Id), "\"")
+	}
+	var body []byte
+	if len(req.Body) > 0 && req.Body[0] == '"' {
+		var s string
+		if err := json.Unmarshal(req.Body, &s); err != nil {
+			a.reply(req.Id, nil, err.Error())
+			return
+		}
+		body = []byte(s)
+	} else {
+		body = req.Body
+	}
+	a.route(topic, body, func(Result interface{}, Error string) {
+		a.reply(req.Id, Result, Error)
+	})
+}
+
+/**
+后端返回的[]byte和ProtocolMarshal如果是合法的JSON则原样嵌入,否则作为字符串
+*/
+func jsonValue(v interface{}) interface{} {
+	var b []byte
+	switch v2 := v.(type) {
+	case module.ProtocolMarshal:
+		b = v2.GetData()
+	case []byte:
+		b = v2
+	default:
+		return v
+	}
+	if json.Valid(b) {
+		return json.RawMessage(b)
+	}
+	return string(b)
+}
+
+func (a *jsonAgent) reply(id json.RawMessage, Result interface{}, Error string) error {
+	if len(id) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(&JsonResponse{
+		Id:     id,
+		Result: jsonValue(Result),
+		Error:  Error,
+	})
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	//回复和推送经过同一个发送队列,保证顺序并且不阻塞调用方
+	return a.out.pushMsg(outMessage{body: b})
+}
+
+func (a *jsonAgent) writeRaw(b []byte) error {
+	a.wlock.Lock()
+	defer a.wlock.Unlock()
+	if conf.Conf.Mqtt.WriteTimeout > 0 {
+		a.conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(conf.Conf.Mqtt.WriteTimeout)))
+	}
+	if w, ok := a.conn.(messageWriter); ok {
+		return w.WriteMessage(websocket.TextMessage, b)
+	}
+	_, err := a.conn.Write(append(b, '\n'))
+	return err
+}
+
+func (a *jsonAgent) OnClose() error {
+	a.isclose = true
+	a.gate.GetAgentLearner().DisConnect(a) //发送连接断开的事件
+	return nil
+}
+
+/**
+推送消息给客户端 {"route":topic,"body":body}
+*/
+func (a *jsonAgent) WriteMsg(topic string, body []byte) error {
+	if topic == "" {
+		return fmt.Errorf("topic is empty")
+	}
+	return a.out.push(topic, body)
+}
+
+/**
+发送队列的写入函数,topic为空的是已经编码好的回复
+*/
+func (a *jsonAgent) write(topic string, body []byte) error {
+	if topic == "" {
+		return a.writeRaw(body)
+	}
+	b, err := json.Marshal(&JsonPush{
+		Route: topic,
+		Body:  jsonValue(body),
+	})
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	a.send_num++
+	a.lock.Unlock()
+	return a.writeRaw(b)
+}
+
+func (a *jsonAgent) Close() {
+	a.out.close(time.Second)
+	a.conn.Close()
+}
+
+func (a *jsonAgent) Destroy() {
+	a.conn.Destroy()
+}
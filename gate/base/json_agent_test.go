@@ -0,0 +1,82 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/network"
+)
+
+func TestJsonAgent(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	g := &testGate{&Gate{}}
+	g.opts = gate.NewOptions(gate.SetAgentLearner(NewGateHandler(g)))
+	agents := make(chan *jsonAgent, 1)
+	server := &network.TCPServer{Addr: addr}
+	server.NewAgent = func(conn *network.TCPConn) network.Agent {
+		a := NewJsonAgent(&testModule{})
+		a.OnInit(g, conn)
+		agents <- a
+		return a
+	}
+	server.Start()
+	defer server.Close()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	a := <-agents
+	r := bufio.NewReader(conn)
+	expect := func(want string) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want+"\n" {
+			t.Fatalf("received %q, want %q", line, want)
+		}
+	}
+
+	//心跳包带id时回复
+	conn.Write([]byte(`{"id":1,"route":""}` + "\n"))
+	expect(`{"id":1,"result":null}`)
+	conn.Write([]byte(`{"id":"a/b","route":"chat/HD_Say"}` + "\n"))
+	expect(`{"id":"a/b","result":null,"error":"id must not contain /"}`)
+
+	//合法的JSON原样嵌入,否则作为字符串
+	if err := a.WriteMsg("chat/msg", []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	expect(`{"route":"chat/msg","body":{"a":1}}`)
+	a.WriteMsg("chat/msg", []byte("hi"))
+	expect(`{"route":"chat/msg","body":"hi"}`)
+	if err := a.WriteMsg("", nil); err == nil {
+		t.Fatal("WriteMsg without a topic should fail")
+	}
+	if n := a.SendNum(); n != 2 {
+		t.Fatalf("SendNum = %d, want 2", n)
+	}
+}
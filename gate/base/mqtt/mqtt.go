@@ -143,6 +143,13 @@ func (c *Connect) IsCleanSession() bool {
 	return c.clean_session
 }
 
+func (c *Connect) GetClientId() *string {
+	if c.id == nil {
+		return &null_string
+	}
+	return c.id
+}
+
 func (c *Connect) GetProtocol() *string {
 	return c.protocol
 }
@@ -162,6 +169,15 @@ func (c *Connack) SetReturnCode(return_code byte) {
 	c.return_code = return_code
 }
 
+// Session Present flag (MQTT 3.1.1)
+func (c *Connack) SetSessionPresent(present bool) {
+	if present {
+		c.reserved = 1
+	} else {
+		c.reserved = 0
+	}
+}
+
 type Publish struct {
 	topic_name *string
 	mid        int
@@ -128,6 +128,7 @@ func (c *Client) waitPack(pAndErr *packAndErr) (err error) {
 		//用于 Qos =1 的消息
 		//ack := pAndErr.pack.GetVariable().(*mqtt.Puback)
 		//log.Debug("Client Ack Qos(%d) Dup(%d) mid(%d) \n",pAndErr.pack.GetQos(),pAndErr.pack.GetDup(), ack.GetMid())
+		c.recover.OnRecover(pAndErr.pack)
 	case PUBREC: //5
 		//log.Debug("Ack To Client By PUBREL \n")
 		//用于 Qos =2 的消息 回复 PUBREL
@@ -174,11 +175,24 @@ func (c *Client) waitPack(pAndErr *packAndErr) (err error) {
 }
 
 func (c *Client) WriteMsg(topic string, body []byte) error {
+	_, err := c.WriteMsgQos(topic, body, 0)
+	return err
+}
+
+// Publish a msg with the given qos, qos 1 msgs are acked by a PUBACK with the returned msg id
+func (c *Client) WriteMsgQos(topic string, body []byte, qos byte) (int, error) {
 	c.lock.Lock()
 	if c.isStop {
-		return fmt.Errorf("connection is closed")
+		c.lock.Unlock()
+		return 0, fmt.Errorf("connection is closed")
 	}
 	c.lock.Unlock()
-	pack := GetPubPack(0, 0, c.getOnlineMsgId(), &topic, body)
-	return c.queue.WritePack(pack)
+	mid := c.getOnlineMsgId()
+	pack := GetPubPack(qos, 0, mid, &topic, body)
+	return mid, c.queue.WritePack(pack)
+}
+
+// Flush the msgs waiting in the write queue
+func (c *Client) Flush() error {
+	return c.queue.Flush()
 }
@@ -138,6 +138,16 @@ func (queue *PackQueue) WritePack(pack *Pack) (err error) {
 	return err
 }
 
+// Flush the buffered packs immediately
+func (queue *PackQueue) Flush() error {
+	queue.writelock.Lock()
+	defer queue.writelock.Unlock()
+	if !queue.isConnected() || queue.w.Buffered() == 0 {
+		return nil
+	}
+	return queue.w.Flush()
+}
+
 func (queue *PackQueue) SetAlive(alive int) error {
 	if alive < 1 {
 		alive = queue.conf.ReadTimeout
@@ -15,7 +15,8 @@ package basegate
 
 import (
 	"bufio"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"github.com/leonlau/mqant/v2/conf"
 	"github.com/leonlau/mqant/v2/gate"
@@ -23,78 +24,77 @@ import (
 	"github.com/leonlau/mqant/v2/log"
 	"github.com/leonlau/mqant/v2/module"
 	"github.com/leonlau/mqant/v2/network"
-	"github.com/leonlau/mqant/v2/rpc/util"
-	"github.com/leonlau/mqant/v2/utils"
 	"runtime"
 	"strings"
-	"sync"
 	"time"
 )
 
+/**
+clean-session=false 并且开启了会话保留(SessionResumeTTL>0)时,网关在CONNACK之后通过 ResumeTopic 下发恢复令牌,每次连接都会更换
+客户端重连时把 ResumeTokenPrefix+令牌 放在CONNECT的Password中,令牌不匹配时不恢复会话
+没有这个前缀的Password不会被当作令牌,可以继续用于登录鉴权
+*/
+const (
+	ResumeTopic       = "$gate/resume"
+	ResumeTokenPrefix = "$resume:"
+)
+
+type inflightMsg struct {
+	mid int
+	msg gate.PendingMessage
+}
+
 //type resultInfo struct {
 //	Error  string      //错误结果 如果为nil表示请求正确
 //	Result interface{} //结果
 //}
 
 type agent struct {
-	gate.Agent
-	module                           module.RPCModule
-	session                          gate.Session
-	conn                             network.Conn
-	r                                *bufio.Reader
-	w                                *bufio.Writer
-	gate                             gate.Gate
-	client                           *mqtt.Client
-	ch                               chan int //控制模块可同时开启的最大协程数
-	isclose                          bool
-	lock                             sync.Mutex
-	last_storage_heartbeat_data_time time.Duration //上一次发送存储心跳时间
-	rev_num                          int64
-	send_num                         int64
-	conn_time                        time.Time
+	baseAgent
+	r             *bufio.Reader
+	w             *bufio.Writer
+	client        *mqtt.Client
+	client_id     string
+	clean_session bool
+	topics        map[string]byte //客户端已订阅的主题
+	resume_token  string
+	inflight      []inflightMsg //已发送还没有收到PUBACK的Qos1消息,只在可以恢复会话时记录
 }
 
-func NewMqttAgent(module module.RPCModule) *agent {
-	a := &agent{
-		module: module,
+func newResumeToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+/**
+从CONNECT的Password中取出恢复令牌,没有开启会话保留或者没有ResumeTokenPrefix前缀时返回""
+*/
+func resumeToken(opts gate.Options, password *string) string {
+	if opts.SessionResumeTTL <= 0 || password == nil {
+		return ""
+	}
+	if !strings.HasPrefix(*password, ResumeTokenPrefix) {
+		return ""
 	}
+	return strings.TrimPrefix(*password, ResumeTokenPrefix)
+}
+
+func NewMqttAgent(module module.RPCModule) *agent {
+	a := &agent{}
+	a.module = module
 	return a
 }
 func (this *agent) OnInit(gate gate.Gate, conn network.Conn) error {
-	this.ch = make(chan int, gate.Options().ConcurrentTasks)
-	this.conn = conn
-	this.gate = gate
+	this.init(this, gate, conn)
 	this.r = bufio.NewReaderSize(conn, gate.Options().BufSize)
 	this.w = bufio.NewWriterSize(conn, gate.Options().BufSize)
-	this.isclose = false
-	this.rev_num = 0
-	this.send_num = 0
-	this.last_storage_heartbeat_data_time = time.Duration(time.Now().UnixNano())
+	this.topics = map[string]byte{}
+	this.startQueue(this.write)
 	return nil
 }
-func (a *agent) IsClosed() bool {
-	return a.isclose
-}
-
-func (a *agent) GetSession() gate.Session {
-	return a.session
-}
-
-func (a *agent) Wait() error {
-	// 如果ch满了则会处于阻塞，从而达到限制最大协程的功能
-	select {
-	case a.ch <- 1:
-	//do nothing
-	default:
-		//warnning!
-		return fmt.Errorf("the work queue is full!")
-	}
-	return nil
-}
-func (a *agent) Finish() {
-	// 完成则从ch推出数据
-	<-a.ch
-}
 
 func (a *agent) Run() (err error) {
 	defer func() {
@@ -121,7 +121,7 @@ func (a *agent) Run() (err error) {
 	var pack *mqtt.Pack
 	pack, err = mqtt.ReadPack(a.r)
 	if err != nil {
-		log.Errorf("Read login pack error", err)
+		log.Errorf("Read login pack error %v", err)
 		return
 	}
 	if pack.GetType() != mqtt.CONNECT {
@@ -138,220 +138,196 @@ func (a *agent) Run() (err error) {
 	//log.Debug("Read login pack %s %s %s %s",*id,*psw,info.GetProtocol(),info.GetVersion())
 	c := mqtt.NewClient(conf.Conf.Mqtt, a, a.r, a.w, a.conn, info.GetKeepAlive())
 	a.client = c
-	a.session, err = NewSessionByMap(a.module.GetApp(), map[string]interface{}{
-		"Sessionid": utils.GenerateID().String(),
-		"Network":   a.conn.RemoteAddr().Network(),
-		"IP":        a.conn.RemoteAddr().String(),
-		"Serverid":  a.module.GetServerId(),
-		"Settings":  make(map[string]string),
-	})
-	if err != nil {
-		log.Errorf("gate create agent fail", err.Error())
-		return
+	a.client_id = *info.GetClientId()
+	a.clean_session = info.IsCleanSession()
+	//clean-session=false 尝试恢复上一次断线时暂存的会话
+	token := resumeToken(a.gate.Options(), info.GetPassword())
+	resumed := a.gate.GetGateHandler().Resume(a.client_id, token, a.clean_session)
+	if resumed != nil {
+		a.session = resumed.Session
+		a.session.SetNetwork(a.conn.RemoteAddr().Network())
+		a.session.SetIP(a.conn.RemoteAddr().String())
+		if resumed.Topics != nil {
+			a.topics = resumed.Topics
+		}
+	} else {
+		a.session, err = a.newSession()
+		if err != nil {
+			log.Errorf("gate create agent fail %v", err)
+			return
+		}
 	}
 	a.session.JudgeGuest(a.gate.GetJudgeGuest())
-	a.session.CreateTrace()             //代码跟踪
-	a.gate.GetAgentLearner().Connect(a) //发送连接成功的事件
+	a.session.CreateTrace() //代码跟踪
 
 	//回复客户端 CONNECT
-	err = mqtt.WritePack(mqtt.GetConnAckPack(0), a.w)
+	connack := mqtt.GetConnAckPack(0)
+	connack.GetVariable().(*mqtt.Connack).SetSessionPresent(resumed != nil)
+	err = mqtt.WritePack(connack, a.w)
 	if err != nil {
 		return
 	}
 	a.conn_time = time.Now()
-	c.Listen_loop() //开始监听,直到连接中断
+	if !a.clean_session && a.gate.Options().SessionResumeTTL > 0 {
+		a.resume_token, err = newResumeToken()
+		if err != nil {
+			return
+		}
+		a.out.push(ResumeTopic, []byte(a.resume_token))
+	}
+	//恢复的会话在注册连接时先补发断线期间未送达的消息
+	a.gate.GetAgentLearner().Connect(a) //发送连接成功的事件
+	c.Listen_loop()                     //开始监听,直到连接中断
 	return nil
 }
 
 func (a *agent) OnClose() error {
 	a.isclose = true
+	if a.session != nil && a.resume_token != "" {
+		//暂存会话,等待客户端以相同的ClientId和令牌重连
+		//没有收到PUBACK的消息和还在发送队列中的消息在重连后补发
+		a.lock.Lock()
+		topics := a.topics
+		pending := make([]gate.PendingMessage, 0, len(a.inflight))
+		for _, m := range a.inflight {
+			pending = append(pending, m.msg)
+		}
+		a.inflight = nil
+		a.lock.Unlock()
+		pending = append(pending, a.out.unsent(time.Second)...)
+		a.gate.GetGateHandler().Detach(a.client_id, a.resume_token, a.session, topics, pending)
+	}
 	a.gate.GetAgentLearner().DisConnect(a) //发送连接断开的事件
 	return nil
 }
 
-func (a *agent) RevNum() int64 {
-	return a.rev_num
-}
-func (a *agent) SendNum() int64 {
-	return a.send_num
-}
-func (a *agent) ConnTime() time.Time {
-	return a.conn_time
-}
 func (a *agent) OnRecover(pack *mqtt.Pack) {
+	if pack.GetType() == mqtt.PUBACK {
+		a.ack(pack.GetVariable().(*mqtt.Puback).GetMid())
+		return
+	}
+	if pack.GetType() == mqtt.PUBLISH {
+		pub := pack.GetVariable().(*mqtt.Publish)
+		if a.control(*pub.GetTopic(), pub.GetMsg()) {
+			return
+		}
+		msg, err := a.decodePayload(*pub.GetTopic(), pub.GetMsg())
+		if err != nil {
+			a.toResult(*pub.GetTopic(), nil, err.Error())
+			return
+		}
+		pub.SetMsg(msg)
+		if !a.allow(func(Error string) {
+			a.toResult(*pub.GetTopic(), nil, Error)
+		}) {
+			return
+		}
+	}
 	err := a.Wait()
 	if err != nil {
 		log.Warnf("Gate OnRecover error [%v]", err)
 		pub := pack.GetVariable().(*mqtt.Publish)
-		a.toResult(a, *pub.GetTopic(), nil, err.Error())
+		a.toResult(*pub.GetTopic(), nil, err.Error())
 	} else {
 		go a.recoverworker(pack)
 	}
 }
 
-func (this *agent) toResult(a *agent, Topic string, Result interface{}, Error string) error {
-	switch v2 := Result.(type) {
-	case module.ProtocolMarshal:
-		return a.WriteMsg(Topic, v2.GetData())
-	}
-	b, err := a.module.GetApp().ProtocolMarshal(a.session.TraceId(), Result, Error)
-	if err == "" {
-		return a.WriteMsg(Topic, b.GetData())
-	} else {
-		log.Error(err)
-		br, _ := a.module.GetApp().ProtocolMarshal(a.session.TraceId(), nil, err)
-		return a.WriteMsg(Topic, br.GetData())
-	}
-	return fmt.Errorf(err)
-}
-
 func (a *agent) recoverworker(pack *mqtt.Pack) {
-	defer a.Finish()
-	defer func() {
-		if r := recover(); r != nil {
-			buff := make([]byte, 4096)
-			runtime.Stack(buff, false)
-			log.Errorf("Gate recoverworker error [%v] stack : %v", r, string(buff))
-		}
-	}()
+	defer a.recoverDone()
 
-	toResult := a.toResult
 	//路由服务
 	switch pack.GetType() {
 	case mqtt.PUBLISH:
-		a.lock.Lock()
-		a.rev_num = a.rev_num + 1
-		a.lock.Unlock()
 		pub := pack.GetVariable().(*mqtt.Publish)
-		topics := strings.Split(*pub.GetTopic(), "/")
-		a.session.CreateTrace()
-		if a.gate.GetRouteHandler() != nil {
-			needreturn, result, err := a.gate.GetRouteHandler().OnRoute(a.session, *pub.GetTopic(), pub.GetMsg())
-			if err != nil {
-				if needreturn {
-					toResult(a, *pub.GetTopic(), result, err.Error())
-				}
-				return
-			} else {
-				if needreturn {
-					toResult(a, *pub.GetTopic(), result, "")
-				}
-			}
-		} else {
-			var msgid string
-			if len(topics) < 2 {
-				errorstr := "Topic must be [moduleType@moduleID]/[handler]|[moduleType@moduleID]/[handler]/[msgid]"
-				log.Error(errorstr)
-				toResult(a, *pub.GetTopic(), nil, errorstr)
-				return
-			} else if len(topics) == 3 {
-				msgid = topics[2]
-			}
-			startsWith := strings.HasPrefix(topics[1], "HD_")
-			if !startsWith {
-				if msgid != "" {
-					toResult(a, *pub.GetTopic(), nil, fmt.Sprintf("Method(%s) must begin with 'HD_'", topics[1]))
-				}
-				return
-			}
-			var ArgsType []string = make([]string, 2)
-			var args [][]byte = make([][]byte, 2)
-			hash := ""
-			if a.session.GetUserId() != "" {
-				hash = a.session.GetUserId()
-			} else {
-				hash = a.module.GetServerId()
-			}
-			//if (a.gate.GetTracingHandler() != nil) && a.gate.GetTracingHandler().OnRequestTracing(a.session, *pub.GetTopic(), pub.GetMsg()) {
-			//	a.session.CreateRootSpan("gate")
-			//}
-
-			serverSession, err := a.module.GetRouteServer(topics[0], hash)
-			if err != nil {
-				if msgid != "" {
-					toResult(a, *pub.GetTopic(), nil, fmt.Sprintf("Service(type:%s) not found", topics[0]))
-				}
-				return
-			}
-			if pub.GetMsg()[0] == '{' && pub.GetMsg()[len(pub.GetMsg())-1] == '}' {
-				//尝试解析为json为map
-				var obj interface{} // var obj map[string]interface{}
-				err := json.Unmarshal(pub.GetMsg(), &obj)
-				if err != nil {
-					if msgid != "" {
-						toResult(a, *pub.GetTopic(), nil, "The JSON format is incorrect")
-					}
-					return
-				}
-				ArgsType[1] = argsutil.MAP
-				args[1] = pub.GetMsg()
-			} else {
-				ArgsType[1] = argsutil.BYTES
-				args[1] = pub.GetMsg()
-			}
-			a.session.SetTopic(*pub.GetTopic())
-			if msgid != "" {
-				ArgsType[0] = RPC_PARAM_SESSION_TYPE
-				b, err := a.GetSession().Serializable()
-				if err != nil {
-					return
-				}
-				args[0] = b
-				result, e := serverSession.CallArgs(topics[1], ArgsType, args)
-				toResult(a, *pub.GetTopic(), result, e)
-			} else {
-				ArgsType[0] = RPC_PARAM_SESSION_TYPE
-				b, err := a.GetSession().Serializable()
-				if err != nil {
-					return
-				}
-				args[0] = b
-
-				e := serverSession.CallNRArgs(topics[1], ArgsType, args)
-				if e != nil {
-					log.Warnf("Gate RPC %s", e.Error())
-				}
-			}
-		}
-		//if a.GetSession().GetUserId() != "" {
-		//这个链接已经绑定Userid
+		a.route(*pub.GetTopic(), pub.GetMsg(), func(Result interface{}, Error string) {
+			a.toResult(*pub.GetTopic(), Result, Error)
+		})
+	case mqtt.SUBSCRIBE:
+		sub := pack.GetVariable().(*mqtt.Subscribe)
 		a.lock.Lock()
-		interval := int64(a.last_storage_heartbeat_data_time) + int64(a.gate.Options().Heartbeat) //单位纳秒
+		for _, top := range sub.GetTopics() {
+			a.topics[*top.GetName()] = top.GetQos()
+		}
 		a.lock.Unlock()
-		if interval < time.Now().UnixNano() {
-			if a.gate.GetStorageHandler() != nil {
-				a.lock.Lock()
-				a.last_storage_heartbeat_data_time = time.Duration(time.Now().UnixNano())
-				a.lock.Unlock()
-				a.gate.GetStorageHandler().Heartbeat(a.GetSession())
-			}
+	case mqtt.UNSUBSCRIBE:
+		sub := pack.GetVariable().(*mqtt.UNSubscribe)
+		a.lock.Lock()
+		for _, top := range sub.GetTopics() {
+			delete(a.topics, *top.GetName())
 		}
-		//}
+		a.lock.Unlock()
 	case mqtt.PINGREQ:
 		//客户端发送的心跳包
-		//if a.GetSession().GetUserId() != "" {
-		//这个链接已经绑定Userid
-		a.lock.Lock()
-		interval := int64(a.last_storage_heartbeat_data_time) + int64(a.gate.Options().Heartbeat) //单位纳秒
-		a.lock.Unlock()
-		if interval < time.Now().UnixNano() {
-			if a.gate.GetStorageHandler() != nil {
-				a.lock.Lock()
-				a.last_storage_heartbeat_data_time = time.Duration(time.Now().UnixNano())
-				a.lock.Unlock()
-				a.gate.GetStorageHandler().Heartbeat(a.GetSession())
-			}
-		}
-		//}
+		a.heartbeat()
 	}
 }
 
 func (a *agent) WriteMsg(topic string, body []byte) error {
+	return a.push(topic, body)
+}
+
+func (a *agent) write(topic string, body []byte) error {
+	if a.client == nil {
+		return fmt.Errorf("mqtt connection is not established")
+	}
 	a.send_num++
-	return a.client.WriteMsg(topic, body)
+	msg := a.out.current()
+	if a.resume_token == "" || msg.raw == nil || a.qos(topic) == 0 {
+		return a.client.WriteMsg(topic, body)
+	}
+	mid, err := a.client.WriteMsgQos(topic, body, 1)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	a.inflight = append(a.inflight, inflightMsg{mid: mid, msg: gate.PendingMessage{Topic: topic, Body: msg.raw}})
+	if max := a.gate.Options().SessionResumeMaxPending; max > 0 && len(a.inflight) > max {
+		//客户端一直不回复PUBACK,丢弃最早的记录
+		a.inflight = a.inflight[len(a.inflight)-max:]
+	}
+	a.lock.Unlock()
+	return nil
+}
+
+/**
+客户端订阅的主题中与topic匹配的最大Qos,网关最多使用Qos1
+*/
+func (a *agent) qos(topic string) byte {
+	levels := strings.Split(topic, "/")
+	var qos byte
+	a.lock.Lock()
+	for filter, q := range a.topics {
+		if q > qos && matchLevels(strings.Split(filter, "/"), levels) {
+			qos = q
+		}
+	}
+	a.lock.Unlock()
+	if qos > 1 {
+		qos = 1
+	}
+	return qos
+}
+
+func (a *agent) ack(mid int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for i, m := range a.inflight {
+		if m.mid == mid {
+			a.inflight = append(a.inflight[:i], a.inflight[i+1:]...)
+			return
+		}
+	}
 }
 
 func (a *agent) Close() {
+	//尽量把队列中的消息发送出去,例如踢下线的通知
+	a.out.close(time.Second)
+	if a.client != nil {
+		//尽量把已经写入缓冲区的消息发送出去,例如踢下线的通知
+		a.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		a.client.Flush()
+	}
 	a.conn.Close()
 }
 
@@ -21,7 +21,11 @@ import (
 	"github.com/leonlau/mqant/v2/module"
 	"github.com/leonlau/mqant/v2/module/base"
 	"github.com/leonlau/mqant/v2/network"
+	"github.com/leonlau/mqant/v2/selector"
+	"net/http"
 	"reflect"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -35,18 +39,59 @@ type Gate struct {
 	// websocket
 	WSAddr      string
 	HTTPTimeout time.Duration
+	// 客户端协议 mqtt(默认)|json|binary,所有监听使用相同的协议
+	Protocol string
+	// 按监听类型(ws,tcp,kcp,poll)单独指定的协议,覆盖Protocol
+	Protocols map[string]string
+	// websocket permessage-deflate
+	WSCompression bool
+	// websocket允许的Origin,为空时不检查
+	AllowedOrigins []string
+	// websocket子协议对应的协议 例如 {"json.mqant":"json"},没有协商子协议时使用Protocol
+	Subprotocols map[string]string
 
 	// tcp
 	TCPAddr string
+	// http长轮询/SSE
+	PollAddr string
+	PollPath string
 
-	//tls
+	// kcp
+	KCPAddr    string
+	KCPOptions network.KCPOptions
+	//kcp最大连接数,0不限制
+	KCPMaxConnNum int
+
+	//tls 证书文件修改或者收到SIGHUP时自动重新加载
 	Tls      bool
 	CertFile string
 	KeyFile  string
+	// 客户端证书的CA,不为空时开启mTLS(tcp和websocket)
+	ClientCAFile      string
+	RequireClientCert bool
 	//
 	judgeGuest func(session gate.Session) bool
 
 	createAgent func() gate.Agent
+	// 按websocket子协议创建agent
+	subprotocolAgents map[string]func() gate.Agent
+
+	ipLimiter *ipRateLimiter
+	routes    *routeTable
+	balancer  *selector.HashBalancer
+	// 每个IP最多同时建立的连接数,0表示不限制
+	MaxConnPerIP int
+	// tcp在负载均衡之后时解析PROXY protocol头
+	ProxyProtocol bool
+	// 可信代理(IP或CIDR),tcp只解析来自它们的PROXY头,websocket只信任来自它们的X-Forwarded-For
+	// 为空时不信任任何代理,开启ProxyProtocol时不能为空
+	TrustedProxies []string
+
+	// 排空网关
+	drainLock sync.Mutex
+	draining  bool
+	drained   chan struct{}
+	listeners []acceptStopper
 }
 
 func (this *Gate) defaultCreateAgentd() gate.Agent {
@@ -54,6 +99,85 @@ func (this *Gate) defaultCreateAgentd() gate.Agent {
 	return a
 }
 
+/**
+按协议创建agent,SetCreateAgent设置的函数优先
+*/
+func (this *Gate) newAgent(protocol string) gate.Agent {
+	if this.createAgent != nil {
+		return this.createAgent()
+	}
+	switch protocol {
+	case "binary":
+		return NewBinaryAgent(this.GetModule(), this.opts.FrameCodec)
+	case "json":
+		return NewJsonAgent(this.GetModule())
+	default:
+		return this.defaultCreateAgentd()
+	}
+}
+
+/**
+按协商的websocket子协议创建agent
+*/
+func (this *Gate) newWSAgent(subprotocol string) gate.Agent {
+	if cfunc, ok := this.subprotocolAgents[subprotocol]; ok {
+		return cfunc()
+	}
+	if protocol, ok := this.Subprotocols[subprotocol]; ok {
+		return this.newAgent(protocol)
+	}
+	return this.newAgent(this.protocol("ws"))
+}
+
+/**
+监听类型使用的协议
+*/
+func (this *Gate) protocol(listener string) string {
+	if protocol, ok := this.Protocols[listener]; ok {
+		return protocol
+	}
+	return this.Protocol
+}
+
+/**
+websocket支持的子协议,mqttv3.1优先,其余按名称排序
+*/
+func (this *Gate) wsSubprotocols() []string {
+	protocols := []string{"mqttv3.1"}
+	var names []string
+	for name := range this.Subprotocols {
+		names = append(names, name)
+	}
+	for name := range this.subprotocolAgents {
+		if _, ok := this.Subprotocols[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name != "mqttv3.1" {
+			protocols = append(protocols, name)
+		}
+	}
+	return protocols
+}
+
+/**
+websocket升级之前的鉴权,身份信息写入一个临时Session,连接建立后复制到真正的Session
+*/
+func (this *Gate) beforeUpgrade(r *http.Request) (interface{}, error) {
+	session, err := NewSessionByMap(this.App, map[string]interface{}{
+		"Settings": make(map[string]string),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := this.opts.WSHandshakeHandler(r, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
 func (this *Gate) SetJudgeGuest(judgeGuest func(session gate.Session) bool) error {
 	this.judgeGuest = judgeGuest
 	return nil
@@ -75,6 +199,22 @@ func (this *Gate) SetStorageHandler(storage gate.StorageHandler) error {
 	return nil
 }
 
+/**
+设置离线消息存储接口,不设置则不缓存离线消息
+*/
+func (this *Gate) SetMailboxStorage(mailbox gate.MailboxStorage) error {
+	this.opts.MailboxStorage = mailbox
+	return nil
+}
+
+/**
+设置集群用户在线索引,不设置则跨网关查询时遍历所有网关
+*/
+func (this *Gate) SetPresenceHandler(presence gate.PresenceHandler) error {
+	this.opts.PresenceHandler = presence
+	return nil
+}
+
 /**
 设置客户端连接和断开的监听器
 */
@@ -83,6 +223,14 @@ func (this *Gate) SetSessionLearner(sessionLearner gate.SessionLearner) error {
 	return nil
 }
 
+/**
+设置二进制协议的帧编解码器,默认NewTopicCodec,也可以在配置中用FrameCodec/FrameTopics指定
+*/
+func (this *Gate) SetFrameCodec(codec gate.FrameCodec) error {
+	this.opts.FrameCodec = codec
+	return nil
+}
+
 /**
 设置创建客户端Agent的函数
 */
@@ -90,12 +238,29 @@ func (this *Gate) SetCreateAgent(cfunc func() gate.Agent) error {
 	this.createAgent = cfunc
 	return nil
 }
+/**
+设置websocket子协议对应的agent,客户端协商到这个子协议时使用
+*/
+func (this *Gate) SetSubprotocolAgent(subprotocol string, cfunc func() gate.Agent) error {
+	if this.subprotocolAgents == nil {
+		this.subprotocolAgents = map[string]func() gate.Agent{}
+	}
+	this.subprotocolAgents[subprotocol] = cfunc
+	return nil
+}
+
 func (this *Gate) Options() gate.Options {
 	return this.opts
 }
 func (this *Gate) GetStorageHandler() (storage gate.StorageHandler) {
 	return this.opts.StorageHandler
 }
+func (this *Gate) GetMailboxStorage() gate.MailboxStorage {
+	return this.opts.MailboxStorage
+}
+func (this *Gate) GetPresenceHandler() gate.PresenceHandler {
+	return this.opts.PresenceHandler
+}
 func (this *Gate) GetGateHandler() gate.GateHandler {
 	return this.opts.GateHandler
 }
@@ -111,6 +276,20 @@ func (this *Gate) GetRouteHandler() gate.RouteHandler {
 func (this *Gate) GetJudgeGuest() func(session gate.Session) bool {
 	return this.judgeGuest
 }
+func (this *Gate) matchRoute(topic string) (*gate.Route, bool, bool) {
+	if this.routes == nil {
+		return nil, false, false
+	}
+	return this.routes.match(topic)
+}
+
+func (this *Gate) ipBucket(ip string) *tokenBucket {
+	if this.ipLimiter == nil {
+		return nil
+	}
+	return this.ipLimiter.get(ip)
+}
+
 func (this *Gate) GetModule() module.RPCModule {
 	return this.GetSubclass()
 }
@@ -130,6 +309,14 @@ func (this *Gate) OnConfChanged(settings *conf.ModuleSettings) {
 自定义rpc参数序列化反序列化  Session
 */
 func (this *Gate) Serialize(param interface{}) (ptype string, p []byte, err error) {
+	return serializeParam(param)
+}
+
+func (this *Gate) Deserialize(ptype string, b []byte) (param interface{}, err error) {
+	return deserializeParam(this.App, ptype, b)
+}
+
+func serializeParam(param interface{}) (ptype string, p []byte, err error) {
 	switch v2 := param.(type) {
 	case gate.Session:
 		bytes, err := v2.Serializable()
@@ -145,16 +332,16 @@ func (this *Gate) Serialize(param interface{}) (ptype string, p []byte, err erro
 	}
 }
 
-func (this *Gate) Deserialize(ptype string, b []byte) (param interface{}, err error) {
+func deserializeParam(app module.App, ptype string, b []byte) (param interface{}, err error) {
 	switch ptype {
 	case RPC_PARAM_SESSION_TYPE:
-		mps, errs := NewSession(this.App, b)
+		mps, errs := NewSession(app, b)
 		if errs != nil {
 			return nil, errs
 		}
 		return mps, nil
 	case RPC_PARAM_ProtocolMarshal_TYPE:
-		return this.App.NewProtocolMarshal(b), nil
+		return app.NewProtocolMarshal(b), nil
 	default:
 		return nil, fmt.Errorf("args [%s] Types not allowed", ptype)
 	}
@@ -174,13 +361,106 @@ func (this *Gate) OnAppConfigurationLoaded(app module.App) {
 func (this *Gate) OnInit(subclass module.RPCModule, app module.App, settings *conf.ModuleSettings, opts ...gate.Option) {
 	this.BaseModule.OnInit(subclass, app, settings) //这是必须的
 	this.opts = gate.NewOptions(opts...)
+	this.drained = make(chan struct{})
 	if WSAddr, ok := settings.Settings["WSAddr"]; ok {
 		this.WSAddr = WSAddr.(string)
 	}
+	//"Protocol":"json" 或者 "Protocol":{"ws":"json","tcp":"binary"}
+	this.Protocol = "mqtt"
+	if Protocol, ok := settings.Settings["Protocol"]; ok {
+		switch v := Protocol.(type) {
+		case string:
+			this.Protocol = v
+		case map[string]interface{}:
+			this.Protocols = map[string]string{}
+			for listener, protocol := range v {
+				this.Protocols[listener] = protocol.(string)
+			}
+		}
+	}
+	if AllowedOrigins, ok := settings.Settings["AllowedOrigins"]; ok {
+		for _, origin := range AllowedOrigins.([]interface{}) {
+			this.AllowedOrigins = append(this.AllowedOrigins, origin.(string))
+		}
+	}
+	if Subprotocols, ok := settings.Settings["Subprotocols"]; ok {
+		this.Subprotocols = map[string]string{}
+		for name, protocol := range Subprotocols.(map[string]interface{}) {
+			this.Subprotocols[name] = protocol.(string)
+		}
+	}
+	if WSCompression, ok := settings.Settings["WSCompression"]; ok {
+		this.WSCompression = WSCompression.(bool)
+	}
+	if PayloadCompression, ok := settings.Settings["PayloadCompression"]; ok {
+		this.opts.PayloadCompression = PayloadCompression.(bool)
+	}
+	if CompressThreshold, ok := settings.Settings["CompressThreshold"]; ok {
+		this.opts.CompressThreshold = int(CompressThreshold.(float64))
+	}
+	if CompressLevel, ok := settings.Settings["CompressLevel"]; ok {
+		this.opts.CompressLevel = int(CompressLevel.(float64))
+	}
+	if PayloadEncryption, ok := settings.Settings["PayloadEncryption"]; ok {
+		this.opts.PayloadEncryption = PayloadEncryption.(bool)
+	}
+	if RequireEncryption, ok := settings.Settings["RequireEncryption"]; ok {
+		this.opts.RequireEncryption = RequireEncryption.(bool)
+		if this.opts.RequireEncryption {
+			this.opts.PayloadEncryption = true
+		}
+	}
+	if HandshakeKeyFile, ok := settings.Settings["HandshakeKeyFile"]; ok {
+		key, err := loadHandshakeKey(HandshakeKeyFile.(string))
+		if err != nil {
+			panic(fmt.Sprintf("Gate HandshakeKeyFile: %v", err))
+		}
+		this.opts.HandshakeKey = key
+	}
+	if this.opts.PayloadEncryption && this.opts.HandshakeKey == nil {
+		//没有签名的密钥交换无法防止中间人
+		panic("Gate PayloadEncryption requires HandshakeKeyFile")
+	}
 	this.HTTPTimeout = time.Second * time.Duration(settings.Settings["HTTPTimeout"].(float64))
 	if TCPAddr, ok := settings.Settings["TCPAddr"]; ok {
 		this.TCPAddr = TCPAddr.(string)
 	}
+	if PollAddr, ok := settings.Settings["PollAddr"]; ok {
+		this.PollAddr = PollAddr.(string)
+	}
+	if PollPath, ok := settings.Settings["PollPath"]; ok {
+		this.PollPath = PollPath.(string)
+	}
+	if KCPAddr, ok := settings.Settings["KCPAddr"]; ok {
+		this.KCPAddr = KCPAddr.(string)
+	}
+	if KCPNoDelay, ok := settings.Settings["KCPNoDelay"]; ok {
+		this.KCPOptions.NoDelay = int(KCPNoDelay.(float64))
+	}
+	if KCPInterval, ok := settings.Settings["KCPInterval"]; ok {
+		this.KCPOptions.Interval = int(KCPInterval.(float64))
+	}
+	if KCPResend, ok := settings.Settings["KCPResend"]; ok {
+		this.KCPOptions.Resend = int(KCPResend.(float64))
+	}
+	if KCPNoCongestion, ok := settings.Settings["KCPNoCongestion"]; ok {
+		this.KCPOptions.NoCongestion = int(KCPNoCongestion.(float64))
+	}
+	if KCPSndWnd, ok := settings.Settings["KCPSndWnd"]; ok {
+		this.KCPOptions.SndWnd = int(KCPSndWnd.(float64))
+	}
+	if KCPRcvWnd, ok := settings.Settings["KCPRcvWnd"]; ok {
+		this.KCPOptions.RcvWnd = int(KCPRcvWnd.(float64))
+	}
+	if KCPMTU, ok := settings.Settings["KCPMTU"]; ok {
+		this.KCPOptions.MTU = int(KCPMTU.(float64))
+	}
+	if KCPVerifyAddr, ok := settings.Settings["KCPVerifyAddr"]; ok {
+		this.KCPOptions.VerifyAddr = KCPVerifyAddr.(bool)
+	}
+	if KCPMaxConnNum, ok := settings.Settings["KCPMaxConnNum"]; ok {
+		this.KCPMaxConnNum = int(KCPMaxConnNum.(float64))
+	}
 	if Tls, ok := settings.Settings["Tls"]; ok {
 		this.Tls = Tls.(bool)
 	} else {
@@ -196,6 +476,119 @@ func (this *Gate) OnInit(subclass module.RPCModule, app module.App, settings *co
 	} else {
 		this.KeyFile = ""
 	}
+	if ClientCAFile, ok := settings.Settings["ClientCAFile"]; ok {
+		this.ClientCAFile = ClientCAFile.(string)
+	}
+	if RequireClientCert, ok := settings.Settings["RequireClientCert"]; ok {
+		this.RequireClientCert = RequireClientCert.(bool)
+	}
+	if this.RequireClientCert && this.ClientCAFile == "" {
+		panic("Gate RequireClientCert requires ClientCAFile")
+	}
+
+	if MaxConnPerIP, ok := settings.Settings["MaxConnPerIP"]; ok {
+		this.MaxConnPerIP = int(MaxConnPerIP.(float64))
+	}
+	if ProxyProtocol, ok := settings.Settings["ProxyProtocol"]; ok {
+		this.ProxyProtocol = ProxyProtocol.(bool)
+	}
+	if TrustedProxies, ok := settings.Settings["TrustedProxies"]; ok {
+		for _, proxy := range TrustedProxies.([]interface{}) {
+			this.TrustedProxies = append(this.TrustedProxies, proxy.(string))
+		}
+	}
+	if this.ProxyProtocol && len(this.TrustedProxies) == 0 {
+		panic("Gate ProxyProtocol requires TrustedProxies")
+	}
+	if DrainWindow, ok := settings.Settings["DrainWindow"]; ok {
+		this.opts.DrainWindow = time.Second * time.Duration(DrainWindow.(float64))
+	}
+	if DrainMessage, ok := settings.Settings["DrainMessage"]; ok {
+		this.opts.DrainMessage = DrainMessage.(string)
+	}
+	if DrainOnShutdown, ok := settings.Settings["DrainOnShutdown"]; ok {
+		this.opts.DrainOnShutdown = DrainOnShutdown.(bool)
+	}
+	if PublishSessionEvents, ok := settings.Settings["PublishSessionEvents"]; ok {
+		this.opts.PublishSessionEvents = PublishSessionEvents.(bool)
+	}
+	if SessionRateLimit, ok := settings.Settings["SessionRateLimit"]; ok {
+		this.opts.SessionRateLimit = SessionRateLimit.(float64)
+	}
+	if SessionRateBurst, ok := settings.Settings["SessionRateBurst"]; ok {
+		this.opts.SessionRateBurst = int(SessionRateBurst.(float64))
+	}
+	if IPRateLimit, ok := settings.Settings["IPRateLimit"]; ok {
+		this.opts.IPRateLimit = IPRateLimit.(float64)
+	}
+	if IPRateBurst, ok := settings.Settings["IPRateBurst"]; ok {
+		this.opts.IPRateBurst = int(IPRateBurst.(float64))
+	}
+	if RateLimitAction, ok := settings.Settings["RateLimitAction"]; ok {
+		action, err := parseRateLimitAction(RateLimitAction.(string))
+		if err != nil {
+			panic(fmt.Sprintf("Gate %v", err))
+		}
+		this.opts.RateLimitAction = action
+	}
+	if this.opts.IPRateLimit > 0 {
+		this.ipLimiter = newIPRateLimiter(this.opts.IPRateLimit, this.opts.IPRateBurst)
+	}
+	//二进制协议的帧格式,也可以用SetFrameCodec在代码中指定
+	FrameCodec, hasCodec := settings.Settings["FrameCodec"]
+	MaxFrameSize, hasSize := settings.Settings["MaxFrameSize"]
+	if hasCodec || hasSize {
+		var name string
+		if hasCodec {
+			name = FrameCodec.(string)
+		}
+		var topics map[string]interface{}
+		if FrameTopics, ok := settings.Settings["FrameTopics"]; ok {
+			topics = FrameTopics.(map[string]interface{})
+		}
+		var maxSize uint32
+		if hasSize {
+			maxSize = uint32(MaxFrameSize.(float64))
+		}
+		codec, err := parseFrameCodec(name, topics, maxSize)
+		if err != nil {
+			panic(fmt.Sprintf("Gate FrameCodec: %v", err))
+		}
+		this.opts.FrameCodec = codec
+	}
+	if Routes, ok := settings.Settings["Routes"]; ok {
+		routes, err := parseRoutes(Routes)
+		if err != nil {
+			panic(fmt.Sprintf("Gate Routes: %v", err))
+		}
+		this.opts.Routes = append(this.opts.Routes, routes...)
+	}
+	if RouteKeys, ok := settings.Settings["RouteKeys"]; ok {
+		if this.opts.RouteKeys == nil {
+			this.opts.RouteKeys = map[string]string{}
+		}
+		for moduleType, source := range RouteKeys.(map[string]interface{}) {
+			this.opts.RouteKeys[moduleType] = source.(string)
+		}
+	}
+	for moduleType, source := range this.opts.RouteKeys {
+		if !checkKeySource(source) {
+			panic(fmt.Sprintf("Gate RouteKeys: unknown key source %q for %s", source, moduleType))
+		}
+	}
+	if HashLoadFactor, ok := settings.Settings["HashLoadFactor"]; ok {
+		this.opts.HashLoadFactor = HashLoadFactor.(float64)
+	}
+	if this.opts.HashLoadFactor > 0 {
+		this.balancer = selector.NewHashBalancer(this.opts.HashLoadFactor, 0)
+	}
+	if len(this.opts.Routes) > 0 {
+		routes, err := newRouteTable(this.opts.Routes)
+		if err != nil {
+			panic(fmt.Sprintf("Gate Routes: %v", err))
+		}
+		this.routes = routes
+	}
 
 	handler := NewGateHandler(this)
 
@@ -206,12 +599,29 @@ func (this *Gate) OnInit(subclass module.RPCModule, app module.App, settings *co
 	this.GetServer().RegisterGO("UnBind", this.opts.GateHandler.UnBind)
 	this.GetServer().RegisterGO("Push", this.opts.GateHandler.Push)
 	this.GetServer().RegisterGO("Set", this.opts.GateHandler.Set)
+	this.GetServer().RegisterGO("Patch", this.opts.GateHandler.Patch)
+	this.GetServer().RegisterGO("PatchCAS", this.opts.GateHandler.PatchCAS)
 	this.GetServer().RegisterGO("Remove", this.opts.GateHandler.Remove)
+	this.GetServer().RegisterGO("PushCAS", this.opts.GateHandler.PushCAS)
+	this.GetServer().RegisterGO("SetCAS", this.opts.GateHandler.SetCAS)
+	this.GetServer().RegisterGO("RemoveCAS", this.opts.GateHandler.RemoveCAS)
 	this.GetServer().RegisterGO("Send", this.opts.GateHandler.Send)
 	this.GetServer().RegisterGO("SendBatch", this.opts.GateHandler.SendBatch)
 	this.GetServer().RegisterGO("BroadCast", this.opts.GateHandler.BroadCast)
+	this.GetServer().RegisterGO("JoinGroup", this.opts.GateHandler.JoinGroup)
+	this.GetServer().RegisterGO("LeaveGroup", this.opts.GateHandler.LeaveGroup)
+	this.GetServer().RegisterGO("GroupMembers", this.opts.GateHandler.GroupMembers)
+	this.GetServer().RegisterGO("GroupBroadCast", this.opts.GateHandler.GroupBroadCast)
 	this.GetServer().RegisterGO("IsConnect", this.opts.GateHandler.IsConnect)
+	this.GetServer().RegisterGO("Locate", this.opts.GateHandler.Locate)
 	this.GetServer().RegisterGO("Close", this.opts.GateHandler.Close)
+	this.GetServer().RegisterGO("Kick", this.opts.GateHandler.Kick)
+	this.GetServer().RegisterGO("QueueStats", this.opts.GateHandler.QueueStats)
+	this.GetServer().RegisterGO("ListSessions", this.opts.GateHandler.ListSessions)
+	this.GetServer().RegisterGO("AgentStats", this.opts.GateHandler.AgentStats)
+	this.GetServer().RegisterGO("KickUser", this.opts.GateHandler.KickUser)
+	this.GetServer().RegisterGO("KickIP", this.opts.GateHandler.KickIP)
+	this.GetServer().RegisterGO("Drain", this.drain)
 }
 
 func (this *Gate) Run(closeSig chan bool) {
@@ -223,11 +633,20 @@ func (this *Gate) Run(closeSig chan bool) {
 		wsServer.Tls = this.Tls
 		wsServer.CertFile = this.CertFile
 		wsServer.KeyFile = this.KeyFile
+		wsServer.ClientCAFile = this.ClientCAFile
+		wsServer.RequireClientCert = this.RequireClientCert
+		wsServer.MaxConnPerIP = this.MaxConnPerIP
+		wsServer.TrustedProxies = this.TrustedProxies
+		wsServer.EnableCompression = this.WSCompression
+		wsServer.CompressionLevel = this.opts.CompressLevel
+		wsServer.CompressThreshold = this.opts.CompressThreshold
+		wsServer.AllowedOrigins = this.AllowedOrigins
+		wsServer.Subprotocols = this.wsSubprotocols()
+		if this.opts.WSHandshakeHandler != nil {
+			wsServer.BeforeUpgrade = this.beforeUpgrade
+		}
 		wsServer.NewAgent = func(conn *network.WSConn) network.Agent {
-			if this.createAgent == nil {
-				this.createAgent = this.defaultCreateAgentd
-			}
-			agent := this.createAgent()
+			agent := this.newWSAgent(conn.Subprotocol())
 			agent.OnInit(this, conn)
 			return agent
 		}
@@ -240,11 +659,46 @@ func (this *Gate) Run(closeSig chan bool) {
 		tcpServer.Tls = this.Tls
 		tcpServer.CertFile = this.CertFile
 		tcpServer.KeyFile = this.KeyFile
+		tcpServer.ClientCAFile = this.ClientCAFile
+		tcpServer.RequireClientCert = this.RequireClientCert
+		tcpServer.MaxConnPerIP = this.MaxConnPerIP
+		tcpServer.ProxyProtocol = this.ProxyProtocol
+		tcpServer.TrustedProxies = this.TrustedProxies
 		tcpServer.NewAgent = func(conn *network.TCPConn) network.Agent {
-			if this.createAgent == nil {
-				this.createAgent = this.defaultCreateAgentd
-			}
-			agent := this.createAgent()
+			agent := this.newAgent(this.protocol("tcp"))
+			agent.OnInit(this, conn)
+			return agent
+		}
+	}
+
+	var kcpServer *network.KCPServer
+	if this.KCPAddr != "" {
+		kcpServer = new(network.KCPServer)
+		kcpServer.Addr = this.KCPAddr
+		kcpServer.KCPOptions = this.KCPOptions
+		kcpServer.MaxConnNum = this.KCPMaxConnNum
+		kcpServer.MaxConnPerIP = this.MaxConnPerIP
+		kcpServer.NewAgent = func(conn *network.KCPConn) network.Agent {
+			agent := this.newAgent(this.protocol("kcp"))
+			agent.OnInit(this, conn)
+			return agent
+		}
+	}
+
+	var pollServer *network.PollServer
+	if this.PollAddr != "" {
+		pollServer = new(network.PollServer)
+		pollServer.Addr = this.PollAddr
+		pollServer.Path = this.PollPath
+		pollServer.Tls = this.Tls
+		pollServer.CertFile = this.CertFile
+		pollServer.KeyFile = this.KeyFile
+		pollServer.ClientCAFile = this.ClientCAFile
+		pollServer.RequireClientCert = this.RequireClientCert
+		pollServer.MaxConnPerIP = this.MaxConnPerIP
+		pollServer.TrustedProxies = this.TrustedProxies
+		pollServer.NewAgent = func(conn *network.PollConn) network.Agent {
+			agent := this.newAgent(this.protocol("poll"))
 			agent.OnInit(this, conn)
 			return agent
 		}
@@ -252,11 +706,31 @@ func (this *Gate) Run(closeSig chan bool) {
 
 	if wsServer != nil {
 		wsServer.Start()
+		this.addListener(wsServer)
+	}
+	if pollServer != nil {
+		pollServer.Start()
+		this.addListener(pollServer)
 	}
 	if tcpServer != nil {
 		tcpServer.Start()
+		this.addListener(tcpServer)
 	}
+	if kcpServer != nil {
+		kcpServer.Start()
+		this.addListener(kcpServer)
+	}
+	stop := make(chan struct{})
+	this.watchDrainSignal(stop)
+	this.refreshPresence(stop)
 	<-closeSig
+	close(stop)
+	if this.opts.DrainOnShutdown {
+		if err := this.Drain(0, ""); err != nil {
+			//已经在排空,等待排空完成
+			<-this.drained
+		}
+	}
 	if this.opts.GateHandler != nil {
 		this.opts.GateHandler.OnDestroy()
 	}
@@ -266,6 +740,34 @@ func (this *Gate) Run(closeSig chan bool) {
 	if tcpServer != nil {
 		tcpServer.Close()
 	}
+	if kcpServer != nil {
+		kcpServer.Close()
+	}
+	if pollServer != nil {
+		pollServer.Close()
+	}
+}
+
+/**
+定期续期在线索引,直到stop关闭
+*/
+func (this *Gate) refreshPresence(stop chan struct{}) {
+	h, ok := this.opts.GateHandler.(interface{ refreshPresence() })
+	if !ok || this.opts.PresenceHandler == nil || this.opts.PresenceRefresh <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(this.opts.PresenceRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.refreshPresence()
+			case <-stop:
+				return
+			}
+		}
+	}()
 }
 
 func (this *Gate) OnDestroy() {
@@ -0,0 +1,240 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"errors"
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+	"sync"
+	"time"
+)
+
+var errQueueClosed = errors.New("the outbound queue is closed")
+var errQueueFull = errors.New("the outbound queue is full")
+
+type outMessage struct {
+	topic string
+	body  []byte
+	raw   []byte //压缩加密之前的消息体,为nil的是网关的控制消息,断线时不需要保留
+}
+
+/**
+每个agent的发送队列
+WriteMsg只入队,由单独的协程写入连接,慢速客户端不会阻塞BroadCast等调用方
+*/
+type outQueue struct {
+	lock       sync.Mutex
+	msgs       []outMessage
+	bytes      int
+	highWater  int
+	highBytes  int
+	policy     gate.OutboundPolicy
+	dropped    int64
+	closed     bool
+	signal     chan struct{}
+	done       chan struct{}
+	write      func(topic string, body []byte) error
+	onOverflow func()
+	inflight   bool       //写协程正在写入一条已经出队的消息,仍然计入深度和字节数
+	writing    outMessage //正在写入的消息
+}
+
+func newOutQueue(opts gate.Options, write func(topic string, body []byte) error, onOverflow func()) *outQueue {
+	q := &outQueue{
+		highWater:  opts.OutboundHighWater,
+		highBytes:  opts.OutboundHighWaterBytes,
+		policy:     opts.OutboundPolicy,
+		signal:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		write:      write,
+		onOverflow: onOverflow,
+	}
+	go q.run()
+	return q
+}
+
+/**
+队列中的消息数,包括正在写入的消息
+*/
+func (q *outQueue) count() int {
+	if q.inflight {
+		return len(q.msgs) + 1
+	}
+	return len(q.msgs)
+}
+
+func (q *outQueue) full(size int) bool {
+	if q.count() == 0 {
+		return false
+	}
+	if q.highWater > 0 && q.count()+1 > q.highWater {
+		return true
+	}
+	if q.highBytes > 0 && q.bytes+size > q.highBytes {
+		return true
+	}
+	return false
+}
+
+func (q *outQueue) push(topic string, body []byte) error {
+	return q.pushMsg(outMessage{topic: topic, body: body})
+}
+
+func (q *outQueue) pushMsg(msg outMessage) error {
+	body := msg.body
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return errQueueClosed
+	}
+	if q.full(len(body)) {
+		switch q.policy {
+		case gate.OutboundDropNew:
+			q.dropped++
+			q.lock.Unlock()
+			return errQueueFull
+		case gate.OutboundDropOldest:
+			//正在写入的消息无法丢弃
+			for len(q.msgs) > 0 && q.full(len(body)) {
+				q.bytes -= len(q.msgs[0].body)
+				q.msgs[0] = outMessage{}
+				q.msgs = q.msgs[1:]
+				q.dropped++
+			}
+		default:
+			q.dropped++
+			q.lock.Unlock()
+			if q.onOverflow != nil {
+				q.onOverflow()
+			}
+			return errQueueFull
+		}
+	}
+	q.msgs = append(q.msgs, msg)
+	q.bytes += len(body)
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	q.lock.Unlock()
+	return nil
+}
+
+func (q *outQueue) run() {
+	defer close(q.done)
+	for {
+		_, ok := <-q.signal
+		for {
+			//每次只取出一条消息,写入完成之前仍然占用队列的容量
+			q.lock.Lock()
+			if len(q.msgs) == 0 {
+				q.lock.Unlock()
+				break
+			}
+			msg := q.msgs[0]
+			q.msgs[0] = outMessage{}
+			q.msgs = q.msgs[1:]
+			q.inflight = true
+			q.writing = msg
+			q.lock.Unlock()
+			err := q.write(msg.topic, msg.body)
+			q.lock.Lock()
+			q.inflight = false
+			q.bytes -= len(msg.body)
+			if ee, ok := err.(*gate.FrameEncodeError); ok {
+				//只是这一条消息无法编码,丢弃后继续发送
+				log.Warnf("Gate drop outbound message: %v", ee)
+				q.dropped++
+				q.lock.Unlock()
+				continue
+			}
+			if err != nil {
+				//连接已经不可写,这条消息和剩余的消息留给unsent
+				if !q.closed {
+					q.closed = true
+					close(q.signal)
+				}
+				q.msgs = append([]outMessage{msg}, q.msgs...)
+				q.bytes += len(msg.body)
+				q.lock.Unlock()
+				return
+			}
+			q.lock.Unlock()
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+/**
+不再接受新消息,等待队列中的消息写完,最多等待timeout
+*/
+func (q *outQueue) close(timeout time.Duration) {
+	q.lock.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.signal)
+	}
+	q.lock.Unlock()
+	select {
+	case <-q.done:
+	case <-time.After(timeout):
+	}
+}
+
+/**
+正在写入的消息,只能在write回调中调用
+*/
+func (q *outQueue) current() outMessage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.writing
+}
+
+/**
+队列关闭后还没有写入连接的消息(不含控制消息),最多等待写协程退出timeout
+超时时正在写入的消息也会返回,恢复会话后可能重复发送,但不会丢失
+*/
+func (q *outQueue) unsent(timeout time.Duration) []gate.PendingMessage {
+	select {
+	case <-q.done:
+	case <-time.After(timeout):
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var msgs []gate.PendingMessage
+	if q.inflight && q.writing.raw != nil {
+		msgs = append(msgs, gate.PendingMessage{Topic: q.writing.topic, Body: q.writing.raw})
+	}
+	for _, msg := range q.msgs {
+		if msg.raw != nil {
+			msgs = append(msgs, gate.PendingMessage{Topic: msg.topic, Body: msg.raw})
+		}
+	}
+	return msgs
+}
+
+func (q *outQueue) depth() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.count()
+}
+
+func (q *outQueue) droppedNum() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.dropped
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+)
+
+/**
+写入前等待release的慢速连接
+*/
+type slowWriter struct {
+	lock    sync.Mutex
+	topics  []string
+	started chan string
+	release chan struct{}
+}
+
+func newSlowWriter() *slowWriter {
+	return &slowWriter{
+		started: make(chan string, 10),
+		release: make(chan struct{}),
+	}
+}
+
+func (w *slowWriter) write(topic string, body []byte) error {
+	w.started <- topic
+	<-w.release
+	w.lock.Lock()
+	w.topics = append(w.topics, topic)
+	w.lock.Unlock()
+	return nil
+}
+
+func (w *slowWriter) written() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return strings.Join(w.topics, ",")
+}
+
+func TestOutQueuePolicies(t *testing.T) {
+	for _, c := range []struct {
+		policy   gate.OutboundPolicy
+		err      error
+		overflow bool
+		written  string
+	}{
+		{gate.OutboundDropOldest, nil, false, "a,c"},
+		{gate.OutboundDropNew, errQueueFull, false, "a,b"},
+		{gate.OutboundDisconnect, errQueueFull, true, "a,b"},
+	} {
+		w := newSlowWriter()
+		overflow := false
+		q := newOutQueue(gate.NewOptions(gate.OutboundHighWater(2, 0), gate.SetOutboundPolicy(c.policy)), w.write, func() {
+			overflow = true
+		})
+		q.push("a", nil)
+		<-w.started
+		//正在写入的a也占用容量
+		if err := q.push("b", nil); err != nil {
+			t.Fatalf("policy %v: push b = %v", c.policy, err)
+		}
+		if err := q.push("c", nil); err != c.err {
+			t.Fatalf("policy %v: push c = %v, want %v", c.policy, err, c.err)
+		}
+		if q.depth() != 2 || q.droppedNum() != 1 || overflow != c.overflow {
+			t.Fatalf("policy %v: depth %d dropped %d overflow %v", c.policy, q.depth(), q.droppedNum(), overflow)
+		}
+		close(w.release)
+		q.close(time.Second)
+		if got := w.written(); got != c.written {
+			t.Fatalf("policy %v: written %s, want %s", c.policy, got, c.written)
+		}
+	}
+}
+
+func TestOutQueueUnsentInflight(t *testing.T) {
+	w := newSlowWriter()
+	q := newOutQueue(gate.NewOptions(gate.OutboundHighWater(0, 10)), w.write, nil)
+	defer close(w.release)
+	q.pushMsg(outMessage{topic: "a", body: []byte("12345"), raw: []byte("a")})
+	<-w.started
+	q.pushMsg(outMessage{topic: "b", body: []byte("12345"), raw: []byte("b")})
+	//字节数也包括正在写入的消息
+	if err := q.push("c", []byte("1")); err != errQueueFull {
+		t.Fatalf("push over the byte limit = %v", err)
+	}
+	q.close(10 * time.Millisecond)
+	var topics []string
+	for _, msg := range q.unsent(10 * time.Millisecond) {
+		topics = append(topics, msg.Topic)
+	}
+	if got := strings.Join(topics, ","); got != "a,b" {
+		t.Fatalf("unsent %s, want a,b", got)
+	}
+}
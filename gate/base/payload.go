@@ -0,0 +1,126 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"fmt"
+	"github.com/leonlau/mqant/v2/log"
+)
+
+/**
+处理网关自己的控制消息,返回true表示这条消息已经处理,不再路由到后端模块
+需要在读取消息的协程中调用,保证协商前后的消息顺序
+回复本身不经过压缩和加密,协商成功后发送的消息才会处理
+*/
+func (a *baseAgent) control(topic string, msg []byte) bool {
+	switch topic {
+	case CompressTopic:
+		a.payloadLock.Lock()
+		defer a.payloadLock.Unlock()
+		if !a.gate.Options().PayloadCompression || (len(msg) > 0 && string(msg) != "deflate") {
+			a.out.push(CompressTopic, []byte("none"))
+			return true
+		}
+		if !a.compress {
+			a.out.push(CompressTopic, []byte("deflate"))
+			a.compress = true
+		}
+		return true
+	case HandshakeTopic:
+		a.payloadLock.Lock()
+		defer a.payloadLock.Unlock()
+		if !a.gate.Options().PayloadEncryption || a.cipher != nil {
+			//不支持重复协商密钥,无法区分协商前后发送的消息
+			a.out.push(HandshakeTopic, []byte("none"))
+			return true
+		}
+		reply, c, err := handshake(a.gate.Options().HandshakeKey, msg)
+		if err != nil {
+			log.Warnf("Gate handshake error %s", err.Error())
+			a.out.push(HandshakeTopic, []byte("none"))
+			return true
+		}
+		a.out.push(HandshakeTopic, reply)
+		a.cipher = c
+		return true
+	}
+	return false
+}
+
+/**
+发送消息,按协商结果压缩和加密消息体
+*/
+func (a *baseAgent) push(topic string, body []byte) error {
+	a.payloadLock.RLock()
+	defer a.payloadLock.RUnlock()
+	raw := body
+	if topic == "" || (!a.compress && a.cipher == nil) {
+		return a.out.pushMsg(outMessage{topic: topic, body: body, raw: raw})
+	}
+	if a.compress {
+		opts := a.gate.Options()
+		if len(body) >= opts.CompressThreshold {
+			b, err := deflate(opts.CompressLevel, body)
+			if err != nil {
+				return err
+			}
+			body = b
+		} else {
+			b := make([]byte, len(body)+1)
+			b[0] = PayloadRaw
+			copy(b[1:], body)
+			body = b
+		}
+	}
+	if a.cipher != nil {
+		//加密和入队需要在同一个锁里,保证发送顺序和计数器的顺序一致
+		a.sealLock.Lock()
+		defer a.sealLock.Unlock()
+		b, err := a.cipher.seal.Seal(body, []byte(topic))
+		if err != nil {
+			return err
+		}
+		body = b
+	}
+	return a.out.pushMsg(outMessage{topic: topic, body: body, raw: raw})
+}
+
+/**
+还原客户端的消息体,先解密再去掉压缩标记
+*/
+func (a *baseAgent) decodePayload(topic string, msg []byte) ([]byte, error) {
+	a.payloadLock.RLock()
+	compress, c := a.compress, a.cipher
+	a.payloadLock.RUnlock()
+	if c != nil {
+		b, err := c.open.Open(msg, []byte(topic))
+		if err != nil {
+			return nil, fmt.Errorf("payload decrypt fail")
+		}
+		msg = b
+	} else if a.gate.Options().RequireEncryption {
+		return nil, fmt.Errorf("encryption handshake required")
+	}
+	if !compress || len(msg) == 0 {
+		return msg, nil
+	}
+	switch msg[0] {
+	case PayloadRaw:
+		return msg[1:], nil
+	case PayloadDeflate:
+		return inflate(msg[1:])
+	default:
+		return nil, fmt.Errorf("unknown payload flag %d", msg[0])
+	}
+}
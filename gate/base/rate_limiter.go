@@ -0,0 +1,151 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"fmt"
+	"github.com/leonlau/mqant/v2/gate"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+令牌桶,每秒补充rate个令牌,最多积累burst个
+*/
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// 补充令牌,需要持有锁
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+/**
+所有桶都有令牌时才从每个桶各取一个,任何一个桶没有令牌时都不消耗
+按参数顺序加锁,调用方需要保证顺序一致(连接的桶在前,IP的桶在后),nil表示不限流
+*/
+func takeTokens(buckets ...*tokenBucket) bool {
+	now := time.Now()
+	locked := make([]*tokenBucket, 0, len(buckets))
+	defer func() {
+		for _, b := range locked {
+			b.lock.Unlock()
+		}
+	}()
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		b.lock.Lock()
+		locked = append(locked, b)
+		b.refill(now)
+		if b.tokens < 1 {
+			return false
+		}
+	}
+	for _, b := range locked {
+		b.tokens--
+	}
+	return true
+}
+
+// 令牌桶已满说明一段时间内没有消息
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+/**
+按IP共享的令牌桶,长时间空闲的桶会被清理
+*/
+type ipRateLimiter struct {
+	lock      sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+	return &ipRateLimiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *ipRateLimiter) get(ip string) *tokenBucket {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.lastSweep = now
+		for k, b := range l.buckets {
+			if b.idle(now) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = newTokenBucket(l.rate, l.burst)
+		l.buckets[ip] = b
+	}
+	return b
+}
+
+func parseRateLimitAction(action string) (gate.RateLimitAction, error) {
+	switch action {
+	case "drop":
+		return gate.RateLimitDrop, nil
+	case "reply":
+		return gate.RateLimitReply, nil
+	case "disconnect":
+		return gate.RateLimitDisconnect, nil
+	}
+	return gate.RateLimitDrop, fmt.Errorf("unknown RateLimitAction %q, must be drop|reply|disconnect", action)
+}
+
+// 去掉地址中的端口
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
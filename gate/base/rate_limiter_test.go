@@ -0,0 +1,83 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(20, 2)
+	if !takeTokens(b) || !takeTokens(b) {
+		t.Fatal("burst should be allowed")
+	}
+	if takeTokens(b) {
+		t.Fatal("bucket should be empty")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !takeTokens(b) {
+		t.Fatal("bucket should be refilled")
+	}
+	if !takeTokens(nil) {
+		t.Fatal("nil bucket means no limit")
+	}
+}
+
+func TestTakeTokensAllOrNothing(t *testing.T) {
+	session := newTokenBucket(0.001, 5)
+	ip := newTokenBucket(0.001, 1)
+	if !takeTokens(session, ip) {
+		t.Fatal("first message should be allowed")
+	}
+	for i := 0; i < 3; i++ {
+		if takeTokens(session, ip) {
+			t.Fatal("ip bucket should deny")
+		}
+	}
+	//被IP限流的消息不消耗连接的令牌
+	if session.tokens < 3.9 {
+		t.Fatalf("session bucket has %v tokens, want 4", session.tokens)
+	}
+	if ip.tokens >= 1 {
+		t.Fatalf("ip bucket has %v tokens", ip.tokens)
+	}
+}
+
+func TestIPRateLimiter(t *testing.T) {
+	l := newIPRateLimiter(0.001, 1)
+	if !takeTokens(l.get("1.1.1.1")) || takeTokens(l.get("1.1.1.1")) {
+		t.Fatal("connections from the same ip should share a bucket")
+	}
+	if !takeTokens(l.get("2.2.2.2")) {
+		t.Fatal("other ips should not be limited")
+	}
+}
+
+func TestParseRateLimitAction(t *testing.T) {
+	for s, want := range map[string]gate.RateLimitAction{
+		"drop":       gate.RateLimitDrop,
+		"reply":      gate.RateLimitReply,
+		"disconnect": gate.RateLimitDisconnect,
+	} {
+		if got, err := parseRateLimitAction(s); err != nil || got != want {
+			t.Errorf("parseRateLimitAction(%q) = %v %v", s, got, err)
+		}
+	}
+	if _, err := parseRateLimitAction("close"); err == nil {
+		t.Error("unknown action should be rejected")
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/selector"
+)
+
+/**
+由网关实现,按路由表查找客户端topic对应的路由
+*/
+type routeMatcher interface {
+	matchRoute(topic string) (route *gate.Route, reply bool, ok bool)
+}
+
+/**
+由网关实现,返回按key一致性哈希选择模块实例的选项
+*/
+type keyRouter interface {
+	keyOptions(key string) []selector.SelectOption
+}
+
+type topicRoute struct {
+	levels []string
+	route  *gate.Route
+}
+
+/**
+网关的路由表,topic路由按配置顺序匹配,数字消息id直接查表
+*/
+type routeTable struct {
+	topics []topicRoute
+	ids    map[int64]*gate.Route
+}
+
+/**
+检查路由key来源 userid|setting:<key>|payload:<字段>
+*/
+func checkKeySource(source string) bool {
+	switch {
+	case source == "userid":
+	case strings.HasPrefix(source, "setting:") && len(source) > len("setting:"):
+	case strings.HasPrefix(source, "payload:") && len(source) > len("payload:"):
+	default:
+		return false
+	}
+	return true
+}
+
+func checkRoute(r gate.Route) error {
+	if r.Module == "" || r.Func == "" {
+		return fmt.Errorf("route %s%d: Module and Func are required", r.Topic, r.MsgId)
+	}
+	if (r.Topic == "") == (r.MsgId == 0) {
+		return fmt.Errorf("route %s%d: exactly one of Topic and MsgId must be set", r.Topic, r.MsgId)
+	}
+	if r.Hash != "" && !checkKeySource(r.Hash) {
+		return fmt.Errorf("route %s%d: unknown Hash %q", r.Topic, r.MsgId, r.Hash)
+	}
+	if r.Topic != "" {
+		levels := strings.Split(r.Topic, "/")
+		for i, level := range levels {
+			if level == "#" && i != len(levels)-1 {
+				return fmt.Errorf("route %s: # must be the last level", r.Topic)
+			}
+			if level != "+" && level != "#" && strings.ContainsAny(level, "+#") {
+				return fmt.Errorf("route %s: wildcards must occupy an entire level", r.Topic)
+			}
+		}
+	}
+	return nil
+}
+
+func newRouteTable(routes []gate.Route) (*routeTable, error) {
+	t := &routeTable{
+		ids: map[int64]*gate.Route{},
+	}
+	for i := range routes {
+		r := &routes[i]
+		if err := checkRoute(*r); err != nil {
+			return nil, err
+		}
+		if r.MsgId != 0 {
+			if _, ok := t.ids[r.MsgId]; ok {
+				return nil, fmt.Errorf("route %d: duplicate MsgId", r.MsgId)
+			}
+			t.ids[r.MsgId] = r
+			continue
+		}
+		t.topics = append(t.topics, topicRoute{
+			levels: strings.Split(r.Topic, "/"),
+			route:  r,
+		})
+	}
+	return t, nil
+}
+
+/**
+读取网关配置中的路由表
+"Routes":[{"Topic":"chat/+","Module":"chat","Func":"HD_Say","Hash":"setting:RoomId","Reply":true},{"MsgId":1001,"Module":"login","Func":"HD_Login"}]
+*/
+func parseRoutes(v interface{}) ([]gate.Route, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var routes []gate.Route
+	if err := json.Unmarshal(b, &routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+func matchLevels(pattern, levels []string) bool {
+	for i, p := range pattern {
+		if p == "#" {
+			return true
+		}
+		if i >= len(levels) {
+			return false
+		}
+		if p != "+" && p != levels[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(levels)
+}
+
+func (t *routeTable) match(topic string) (*gate.Route, bool, bool) {
+	levels := strings.Split(topic, "/")
+	if len(t.ids) > 0 && len(levels) <= 2 {
+		if id, err := strconv.ParseInt(levels[0], 10, 64); err == nil {
+			if r, ok := t.ids[id]; ok {
+				return r, r.Reply || (len(levels) == 2 && levels[1] != ""), true
+			}
+		}
+	}
+	for _, r := range t.topics {
+		if matchLevels(r.levels, levels) {
+			return r.route, r.route.Reply, true
+		}
+	}
+	return nil, false, false
+}
+
+/**
+按key来源取出本次请求的路由key,取不到时返回空字符串
+*/
+func routeKey(source string, session gate.Session, msg []byte) string {
+	switch {
+	case source == "userid":
+		return session.GetUserId()
+	case strings.HasPrefix(source, "setting:"):
+		return session.Get(strings.TrimPrefix(source, "setting:"))
+	case strings.HasPrefix(source, "payload:"):
+		return payloadField(msg, strings.TrimPrefix(source, "payload:"))
+	}
+	return ""
+}
+
+/**
+从JSON对象中取出字段的值,path用.访问子字段
+*/
+func payloadField(msg []byte, path string) string {
+	var v interface{}
+	if err := json.Unmarshal(msg, &v); err != nil {
+		return ""
+	}
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = obj[key]
+	}
+	switch v2 := v.(type) {
+	case string:
+		return v2
+	case float64:
+		return strconv.FormatFloat(v2, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v2)
+	}
+	return ""
+}
+
+/**
+所有模块类型共用一个带负载上限的一致性哈希,HashLoadFactor小于等于0时不限制负载
+*/
+func (this *Gate) keyOptions(key string) []selector.SelectOption {
+	return []selector.SelectOption{selector.WithStrategy(selector.ConsistentHash(this.balancer, key))}
+}
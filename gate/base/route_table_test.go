@@ -0,0 +1,127 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"testing"
+
+	"github.com/leonlau/mqant/v2/gate"
+)
+
+func TestRouteTable(t *testing.T) {
+	routes, err := parseRoutes([]interface{}{
+		map[string]interface{}{"Topic": "chat/+/say", "Module": "chat", "Func": "HD_Say", "Hash": "setting:RoomId"},
+		map[string]interface{}{"Topic": "game/#", "Module": "game", "Func": "HD_Game", "Reply": true},
+		map[string]interface{}{"MsgId": float64(1001), "Module": "login", "Func": "HD_Login"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := newRouteTable(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		topic  string
+		fn     string
+		reply  bool
+		routed bool
+	}{
+		{"chat/r1/say", "HD_Say", false, true},
+		{"chat/r1/say/1", "", false, false},
+		{"chat/say", "", false, false},
+		{"game", "HD_Game", true, true},
+		{"game/a/b", "HD_Game", true, true},
+		{"1001", "HD_Login", false, true},
+		{"1001/7", "HD_Login", true, true},
+		{"1002", "", false, false},
+		{"login/HD_Login", "", false, false},
+	} {
+		r, reply, ok := table.match(c.topic)
+		if ok != c.routed || (ok && (r.Func != c.fn || reply != c.reply)) {
+			t.Errorf("match(%q) = %v %v %v", c.topic, r, reply, ok)
+		}
+	}
+}
+
+func TestCheckRoute(t *testing.T) {
+	for _, r := range []gate.Route{
+		{Topic: "a", Module: "m"},
+		{Module: "m", Func: "f"},
+		{Topic: "a", MsgId: 1, Module: "m", Func: "f"},
+		{Topic: "a/#/b", Module: "m", Func: "f"},
+		{Topic: "a/b+", Module: "m", Func: "f"},
+		{Topic: "a", Module: "m", Func: "f", Hash: "setting:"},
+		{Topic: "a", Module: "m", Func: "f", Hash: "ip"},
+	} {
+		if _, err := newRouteTable([]gate.Route{r}); err == nil {
+			t.Errorf("route %+v should be rejected", r)
+		}
+	}
+	dup := []gate.Route{
+		{MsgId: 1, Module: "m", Func: "f"},
+		{MsgId: 1, Module: "m", Func: "g"},
+	}
+	if _, err := newRouteTable(dup); err == nil {
+		t.Error("duplicate MsgId should be rejected")
+	}
+}
+
+func TestRouteKey(t *testing.T) {
+	session, err := NewSessionByMap(nil, map[string]interface{}{
+		"Userid":   "u1",
+		"Settings": map[string]string{"RoomId": "r9"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte(`{"table":{"id":42},"name":"x"}`)
+	for _, c := range []struct {
+		source string
+		want   string
+	}{
+		{"", ""},
+		{"userid", "u1"},
+		{"setting:RoomId", "r9"},
+		{"setting:Missing", ""},
+		{"payload:table.id", "42"},
+		{"payload:name", "x"},
+		{"payload:table.missing", ""},
+	} {
+		if got := routeKey(c.source, session, msg); got != c.want {
+			t.Errorf("routeKey(%q) = %q, want %q", c.source, got, c.want)
+		}
+	}
+}
+
+func TestRouteKeyFallback(t *testing.T) {
+	g := &testGate{&Gate{opts: gate.NewOptions(gate.RouteKey("room", "setting:RoomId"))}}
+	session, _ := NewSessionByMap(nil, map[string]interface{}{})
+	a := &baseAgent{gate: g, module: g.GetModule(), session: session}
+	if key := a.routeKey("chat", "", nil); key != "" {
+		t.Fatalf("module without a key source got %q", key)
+	}
+	//取不到key时使用网关的ServerId,绑定Userid之后使用Userid
+	if key := a.routeKey("room", "", nil); key != "gate@1" {
+		t.Fatalf("fallback without Userid got %q", key)
+	}
+	session.SetUserId("u1")
+	if key := a.routeKey("room", "", nil); key != "u1" {
+		t.Fatalf("fallback with Userid got %q", key)
+	}
+	session.SetSettings(map[string]string{"RoomId": "r9"})
+	if key := a.routeKey("room", "", nil); key != "r9" {
+		t.Fatalf("key got %q", key)
+	}
+}
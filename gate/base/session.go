@@ -21,12 +21,14 @@ import (
 	"github.com/leonlau/mqant/v2/module"
 	"github.com/leonlau/mqant/v2/utils"
 	"strconv"
+	"strings"
 )
 
 type sessionagent struct {
 	app        module.App
 	session    *SessionImp
 	judgeGuest func(session gate.Session) bool
+	changed    map[string]bool //本地修改过还没有推送到网关的key
 }
 
 func NewSession(app module.App, data []byte) (gate.Session, error) {
@@ -38,6 +40,9 @@ func NewSession(app module.App, data []byte) (gate.Session, error) {
 	if err != nil {
 		return nil, err
 	} // 测试结果
+	if err := upgradeSettings(se); err != nil {
+		return nil, err
+	}
 	agent.session = se
 	return agent, nil
 }
@@ -47,6 +52,9 @@ func NewSessionByMap(app module.App, data map[string]interface{}) (gate.Session,
 		app:     app,
 		session: new(SessionImp),
 	}
+	if schema := GetSettingsSchema(); schema != nil {
+		agent.session.SettingsVersion = schema.Version
+	}
 	err := agent.updateMap(data)
 	if err != nil {
 		return nil, err
@@ -112,6 +120,21 @@ func (this *sessionagent) SetSettings(settings map[string]string) {
 	this.session.Settings = settings
 }
 
+func (this *sessionagent) GetVersion() int64 {
+	return this.session.GetVersion()
+}
+
+func (this *sessionagent) SetVersion(version int64) {
+	this.session.Version = version
+}
+
+func (this *sessionagent) markChanged(key string) {
+	if this.changed == nil {
+		this.changed = map[string]bool{}
+	}
+	this.changed[key] = true
+}
+
 func (this *sessionagent) updateMap(s map[string]interface{}) error {
 	Userid := s["Userid"]
 	if Userid != nil {
@@ -140,6 +163,9 @@ func (this *sessionagent) updateMap(s map[string]interface{}) error {
 	if Settings != nil {
 		this.session.Settings = Settings.(map[string]string)
 	}
+	if version, ok := s["SettingsVersion"].(int32); ok {
+		this.session.SettingsVersion = version
+	}
 	return nil
 }
 
@@ -157,6 +183,9 @@ func (this *sessionagent) update(s gate.Session) error {
 	this.session.ServerId = Serverid
 	Settings := s.GetSettings()
 	this.session.Settings = Settings
+	this.session.SettingsVersion = s.GetSettingsVersion()
+	this.session.Version = s.GetVersion()
+	this.changed = nil
 	return nil
 }
 
@@ -238,7 +267,7 @@ func (this *sessionagent) Push() (err string) {
 		err = fmt.Sprintf("Service not found id(%s)", this.session.ServerId)
 		return
 	}
-	result, err := server.Call("Push", log.CreateTrace(this.TraceId(), this.SpanId()), this.session.SessionId, this.session.Settings)
+	result, err := server.Call("PushCAS", log.CreateTrace(this.TraceId(), this.SpanId()), this.session.SessionId, this.session.Settings, this.session.Version)
 	if err == "" {
 		if result != nil {
 			//绑定成功,重新更新当前Session
@@ -248,15 +277,59 @@ func (this *sessionagent) Push() (err string) {
 	return
 }
 
+func (this *sessionagent) Patch() (err string) {
+	return this.patch(-1)
+}
+
+func (this *sessionagent) PatchCAS() (err string) {
+	return this.patch(this.session.Version)
+}
+
+func (this *sessionagent) patch(Version int64) (err string) {
+	if this.app == nil {
+		err = fmt.Sprintf("Module.App is nil")
+		return
+	}
+	if len(this.changed) == 0 {
+		return
+	}
+	server, e := this.app.GetServerById(this.session.ServerId)
+	if e != nil {
+		err = fmt.Sprintf("Service not found id(%s)", this.session.ServerId)
+		return
+	}
+	settings := map[string]string{}
+	removed := map[string]string{}
+	for key := range this.changed {
+		if value, ok := this.session.Settings[key]; ok {
+			settings[key] = value
+		} else {
+			removed[key] = ""
+		}
+	}
+	result, err := server.Call("PatchCAS", log.CreateTrace(this.TraceId(), this.SpanId()), this.session.SessionId, settings, removed, Version)
+	if err == "" {
+		if result != nil {
+			this.update(result.(gate.Session))
+		}
+	}
+	return
+}
+
 func (this *sessionagent) Set(key string, value string) (err string) {
 	if this.app == nil {
 		err = fmt.Sprintf("Module.App is nil")
 		return
 	}
+	if e := checkSetting(key, gate.SettingString, value); e != nil {
+		err = e.Error()
+		return
+	}
 	if this.session.Settings == nil {
 		this.session.Settings = map[string]string{}
 	}
 	this.session.Settings[key] = value
+	this.markChanged(key)
 	return
 }
 func (this *sessionagent) SetPush(key string, value string) (err string) {
@@ -264,10 +337,15 @@ func (this *sessionagent) SetPush(key string, value string) (err string) {
 		err = fmt.Sprintf("Module.App is nil")
 		return
 	}
+	if e := checkSetting(key, gate.SettingString, value); e != nil {
+		err = e.Error()
+		return
+	}
 	if this.session.Settings == nil {
 		this.session.Settings = map[string]string{}
 	}
 	this.session.Settings[key] = value
+	this.markChanged(key)
 	return this.Push()
 }
 func (this *sessionagent) Get(key string) (result string) {
@@ -287,6 +365,7 @@ func (this *sessionagent) Remove(key string) (err string) {
 		this.session.Settings = map[string]string{}
 	}
 	delete(this.session.Settings, key)
+	this.markChanged(key)
 	return
 }
 func (this *sessionagent) Send(topic string, body []byte) string {
@@ -316,6 +395,45 @@ func (this *sessionagent) SendBatch(Sessionids string, topic string, body []byte
 	return count.(int64), err
 }
 
+func (this *sessionagent) JoinGroup(group string) (err string) {
+	if this.app == nil {
+		err = fmt.Sprintf("Module.App is nil")
+		return
+	}
+	server, e := this.app.GetServerById(this.session.ServerId)
+	if e != nil {
+		err = fmt.Sprintf("Service not found id(%s)", this.session.ServerId)
+		return
+	}
+	_, err = server.Call("JoinGroup", log.CreateTrace(this.TraceId(), this.SpanId()), this.session.SessionId, group)
+	return
+}
+
+func (this *sessionagent) LeaveGroup(group string) (err string) {
+	if this.app == nil {
+		err = fmt.Sprintf("Module.App is nil")
+		return
+	}
+	server, e := this.app.GetServerById(this.session.ServerId)
+	if e != nil {
+		err = fmt.Sprintf("Service not found id(%s)", this.session.ServerId)
+		return
+	}
+	_, err = server.Call("LeaveGroup", log.CreateTrace(this.TraceId(), this.SpanId()), this.session.SessionId, group)
+	return
+}
+
+/**
+广播消息给分组在所有同类型网关的Session
+*/
+func (this *sessionagent) GroupBroadCast(group string, topic string, body []byte) (int64, string) {
+	if this.app == nil {
+		return 0, fmt.Sprintf("Module.App is nil")
+	}
+	gateType := strings.Split(this.session.ServerId, "@")[0]
+	return NewUserRouter(this.app, gateType, nil).GroupBroadCast(group, topic, body)
+}
+
 func (this *sessionagent) IsConnect(userId string) (bool, string) {
 	if this.app == nil {
 		return false, fmt.Sprintf("Module.App is nil")
@@ -380,6 +498,9 @@ func (this *sessionagent) Clone() gate.Session {
 		TraceId:   this.session.TraceId,
 		SpanId:    utils.GenerateID().String(),
 		Settings:  this.session.Settings,
+
+		SettingsVersion: this.session.SettingsVersion,
+		Version:         this.session.Version,
 	}
 	agent.session = se
 	return agent
@@ -411,6 +532,9 @@ func (this *sessionagent) ExtractSpan() log.TraceSpan {
 		TraceId:   this.session.TraceId,
 		SpanId:    utils.GenerateID().String(),
 		Settings:  this.session.Settings,
+
+		SettingsVersion: this.session.SettingsVersion,
+		Version:         this.session.Version,
 	}
 	agent.session = se
 	return agent
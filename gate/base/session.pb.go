@@ -31,6 +31,8 @@ type SessionImp struct {
 	Settings             map[string]string `protobuf:"bytes,8,rep,name=Settings,proto3" json:"Settings,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 	Carrier              map[string]string `protobuf:"bytes,9,rep,name=Carrier,proto3" json:"Carrier,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 	Topic                string            `protobuf:"bytes,10,opt,name=Topic,proto3" json:"Topic,omitempty"`
+	SettingsVersion      int32             `protobuf:"varint,11,opt,name=SettingsVersion,proto3" json:"SettingsVersion,omitempty"`
+	Version              int64             `protobuf:"varint,12,opt,name=Version,proto3" json:"Version,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
 	XXX_unrecognized     []byte            `json:"-"`
 	XXX_sizecache        int32             `json:"-"`
@@ -131,6 +133,20 @@ func (m *SessionImp) GetTopic() string {
 	return ""
 }
 
+func (m *SessionImp) GetSettingsVersion() int32 {
+	if m != nil {
+		return m.SettingsVersion
+	}
+	return 0
+}
+
+func (m *SessionImp) GetVersion() int64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*SessionImp)(nil), "basegate.sessionImp")
 	proto.RegisterMapType((map[string]string)(nil), "basegate.sessionImp.CarrierEntry")
@@ -140,23 +156,24 @@ func init() {
 func init() { proto.RegisterFile("session.proto", fileDescriptor_3a6be1b361fa6f14) }
 
 var fileDescriptor_3a6be1b361fa6f14 = []byte{
-	// 279 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x91, 0xcf, 0x4a, 0xc3, 0x40,
-	0x10, 0xc6, 0x49, 0x62, 0xf3, 0x67, 0xb4, 0x22, 0x83, 0xc8, 0x12, 0x3c, 0xd4, 0x9e, 0x7a, 0xca,
-	0x41, 0x2f, 0xd2, 0x82, 0x17, 0xf1, 0x90, 0x8b, 0x94, 0xa6, 0x3e, 0xc0, 0xb6, 0x19, 0x4a, 0xa8,
-	0x66, 0xc3, 0xee, 0x5a, 0xe9, 0x0b, 0xfa, 0x5c, 0xb2, 0x7f, 0xd2, 0x2a, 0x78, 0xe9, 0x2d, 0xdf,
-	0x7c, 0xf3, 0x9b, 0x2f, 0x33, 0x0b, 0x43, 0x45, 0x4a, 0x35, 0xa2, 0x2d, 0x3a, 0x29, 0xb4, 0xc0,
-	0x74, 0xc5, 0x15, 0x6d, 0xb8, 0xa6, 0xf1, 0x77, 0x04, 0xe0, 0xbd, 0xf2, 0xa3, 0xc3, 0x4b, 0x08,
-	0xcb, 0x39, 0x0b, 0x46, 0xc1, 0x24, 0x5b, 0x84, 0xe5, 0x1c, 0x19, 0x24, 0xaf, 0xa4, 0xbf, 0x84,
-	0xdc, 0xb2, 0xd0, 0x16, 0x7b, 0x89, 0x37, 0x10, 0xbf, 0x29, 0x92, 0x65, 0xcd, 0x22, 0x6b, 0x78,
-	0x85, 0xb7, 0x90, 0x55, 0x7e, 0x5e, 0xcd, 0xce, 0xac, 0x75, 0x2c, 0x60, 0x0e, 0x69, 0x45, 0x72,
-	0x67, 0xb9, 0x81, 0x35, 0x0f, 0xda, 0x64, 0x2d, 0x25, 0x5f, 0x53, 0x59, 0xb3, 0xd8, 0x65, 0x79,
-	0x69, 0xb2, 0xaa, 0x8e, 0x9b, 0x81, 0x89, 0xcb, 0x72, 0x0a, 0x9f, 0xcc, 0x34, 0xad, 0x9b, 0x76,
-	0xa3, 0x58, 0x3a, 0x8a, 0x26, 0xe7, 0xf7, 0xe3, 0xa2, 0xdf, 0xac, 0x38, 0x6e, 0x55, 0xf4, 0x4d,
-	0x2f, 0xad, 0x96, 0xfb, 0xc5, 0x81, 0xc1, 0x19, 0x24, 0xcf, 0x5c, 0xca, 0x86, 0x24, 0xcb, 0x2c,
-	0x7e, 0xf7, 0x2f, 0xee, 0x7b, 0x1c, 0xdd, 0x13, 0x78, 0x0d, 0x83, 0xa5, 0xe8, 0x9a, 0x35, 0x03,
-	0xfb, 0x4f, 0x4e, 0xe4, 0x33, 0x18, 0xfe, 0x49, 0xc3, 0x2b, 0x88, 0xb6, 0xb4, 0xf7, 0x27, 0x35,
-	0x9f, 0x06, 0xdc, 0xf1, 0xf7, 0x4f, 0xf2, 0x17, 0x75, 0x62, 0x1a, 0x3e, 0x06, 0xf9, 0x14, 0x2e,
-	0x7e, 0x67, 0x9d, 0xc2, 0xae, 0x62, 0xfb, 0xb2, 0x0f, 0x3f, 0x01, 0x00, 0x00, 0xff, 0xff, 0x41,
-	0x48, 0x6d, 0x73, 0xea, 0x01, 0x00, 0x00,
+	// 304 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x92, 0x4f, 0x4b, 0xf3, 0x40,
+	0x10, 0xc6, 0x49, 0xd2, 0x36, 0xc9, 0xb4, 0x7d, 0x5f, 0x59, 0x44, 0x96, 0xe0, 0x21, 0xf6, 0x94,
+	0x53, 0x0e, 0x7a, 0x91, 0x16, 0xbc, 0x88, 0x87, 0x5c, 0xa4, 0x24, 0xd5, 0xfb, 0xb6, 0x19, 0x4a,
+	0xa8, 0x26, 0x61, 0x77, 0xad, 0xf4, 0x2b, 0xf8, 0xa9, 0x65, 0xff, 0xb5, 0x2a, 0x5e, 0xbc, 0xe5,
+	0x37, 0x33, 0xcf, 0xf3, 0xcc, 0xb0, 0x81, 0xa9, 0x40, 0x21, 0x9a, 0xae, 0xcd, 0x7b, 0xde, 0xc9,
+	0x8e, 0x44, 0x6b, 0x26, 0x70, 0xcb, 0x24, 0xce, 0x3e, 0x06, 0x00, 0xb6, 0x57, 0xbc, 0xf6, 0xe4,
+	0x1f, 0xf8, 0xc5, 0x92, 0x7a, 0xa9, 0x97, 0xc5, 0xa5, 0x5f, 0x2c, 0x09, 0x85, 0xf0, 0x11, 0xe5,
+	0x7b, 0xc7, 0x77, 0xd4, 0xd7, 0x45, 0x87, 0xe4, 0x02, 0x46, 0x4f, 0x02, 0x79, 0x51, 0xd3, 0x40,
+	0x37, 0x2c, 0x91, 0x4b, 0x88, 0x2b, 0xeb, 0x57, 0xd3, 0x81, 0x6e, 0x9d, 0x0a, 0x24, 0x81, 0xa8,
+	0x42, 0xbe, 0xd7, 0xba, 0xa1, 0x6e, 0x1e, 0x59, 0x65, 0xad, 0x38, 0xdb, 0x60, 0x51, 0xd3, 0x91,
+	0xc9, 0xb2, 0xa8, 0xb2, 0xaa, 0x9e, 0x29, 0xc3, 0xd0, 0x64, 0x19, 0x22, 0x77, 0xca, 0x4d, 0xca,
+	0xa6, 0xdd, 0x0a, 0x1a, 0xa5, 0x41, 0x36, 0xbe, 0x9e, 0xe5, 0xee, 0xb2, 0xfc, 0x74, 0x55, 0xee,
+	0x86, 0x1e, 0x5a, 0xc9, 0x0f, 0xe5, 0x51, 0x43, 0x16, 0x10, 0xde, 0x33, 0xce, 0x1b, 0xe4, 0x34,
+	0xd6, 0xf2, 0xab, 0x5f, 0xe5, 0x76, 0xc6, 0xa8, 0x9d, 0x82, 0x9c, 0xc3, 0x70, 0xd5, 0xf5, 0xcd,
+	0x86, 0x82, 0xde, 0xc9, 0x00, 0xc9, 0xe0, 0xbf, 0xb3, 0x7f, 0x46, 0xae, 0x1c, 0xe8, 0x38, 0xf5,
+	0xb2, 0x61, 0xf9, 0xb3, 0xac, 0xce, 0x75, 0x13, 0x93, 0xd4, 0xcb, 0x82, 0xd2, 0x61, 0xb2, 0x80,
+	0xe9, 0xb7, 0x8d, 0xc9, 0x19, 0x04, 0x3b, 0x3c, 0xd8, 0x67, 0x51, 0x9f, 0x2a, 0x7c, 0xcf, 0x5e,
+	0xde, 0xd0, 0xbe, 0x8a, 0x81, 0xb9, 0x7f, 0xeb, 0x25, 0x73, 0x98, 0x7c, 0xdd, 0xf7, 0x2f, 0xda,
+	0xf5, 0x48, 0xff, 0x1d, 0x37, 0x9f, 0x03, 0x00, 0xfd, 0xe4, 0xfa, 0x04, 0x2e, 0x02, 0x00, 0x00,
 }
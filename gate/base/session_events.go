@@ -0,0 +1,87 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+	"github.com/leonlau/mqant/v2/module"
+	"github.com/nats-io/nats.go"
+)
+
+//gateType类型的网关发布Session变化事件的nats主题
+func sessionEventSubject(gateType string) string {
+	return "mqant.gate." + gateType + ".session"
+}
+
+/**
+比较修改前后的Settings,返回新增或修改的key和删除的key
+*/
+func diffSettings(old, settings map[string]string) (changed map[string]string, removed []string) {
+	for k, v := range settings {
+		if ov, ok := old[k]; !ok || ov != v {
+			if changed == nil {
+				changed = map[string]string{}
+			}
+			changed[k] = v
+		}
+	}
+	for k := range old {
+		if _, ok := settings[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+	return
+}
+
+/**
+通知SessionLearner并按Options.PublishSessionEvents发布事件
+*/
+func (h *handler) notify(event gate.SessionEvent) {
+	module := h.gate.GetModule()
+	event.Serverid = module.GetServerId()
+	if learner, ok := h.gate.GetSessionLearner().(gate.SessionEventLearner); ok {
+		learner.OnSessionEvent(event)
+	}
+	if !h.gate.Options().PublishSessionEvents {
+		return
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Warnf("session event marshal error: %v", err)
+		return
+	}
+	if err := module.GetApp().Transport().Publish(sessionEventSubject(module.GetType()), b); err != nil {
+		log.Warnf("session event publish error: %v", err)
+	}
+}
+
+/**
+订阅gateType类型的所有网关发布的Session变化事件,不再需要时调用Unsubscribe
+网关需要开启Options.PublishSessionEvents
+*/
+func SubscribeSessionEvents(app module.App, gateType string, learner gate.SessionEventLearner) (*nats.Subscription, error) {
+	return app.Transport().Subscribe(sessionEventSubject(gateType), func(msg *nats.Msg) {
+		var event gate.SessionEvent
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			log.Warnf("session event unmarshal error: %v", err)
+			return
+		}
+		learner.OnSessionEvent(event)
+	})
+}
@@ -0,0 +1,191 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/leonlau/mqant/v2/gate"
+)
+
+var kindNames = map[gate.SettingKind]string{
+	gate.SettingString:  "string",
+	gate.SettingInt64:   "int64",
+	gate.SettingBool:    "bool",
+	gate.SettingFloat64: "float64",
+	gate.SettingJSON:    "json",
+}
+
+var schemaLock sync.RWMutex
+var settingsSchema *gate.SettingsSchema
+
+/**
+设置全局的Settings结构,网关和所有使用Session的模块应该在启动时设置同一个结构
+*/
+func SetSettingsSchema(schema *gate.SettingsSchema) {
+	schemaLock.Lock()
+	settingsSchema = schema
+	schemaLock.Unlock()
+}
+
+func GetSettingsSchema() *gate.SettingsSchema {
+	schemaLock.RLock()
+	defer schemaLock.RUnlock()
+	return settingsSchema
+}
+
+/**
+检查值是否符合Settings结构中声明的类型,没有声明的key不检查
+*/
+func checkSetting(key string, kind gate.SettingKind, value string) error {
+	schema := GetSettingsSchema()
+	if schema == nil {
+		return nil
+	}
+	declared, ok := schema.Fields[key]
+	if !ok {
+		return nil
+	}
+	if kind != declared && kind != gate.SettingString {
+		return fmt.Errorf("setting %s is declared as %s, not %s", key, kindNames[declared], kindNames[kind])
+	}
+	var err error
+	switch declared {
+	case gate.SettingInt64:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case gate.SettingBool:
+		_, err = strconv.ParseBool(value)
+	case gate.SettingFloat64:
+		_, err = strconv.ParseFloat(value, 64)
+	case gate.SettingJSON:
+		if !json.Valid([]byte(value)) {
+			err = fmt.Errorf("invalid json")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("setting %s is not a valid %s: %v", key, kindNames[declared], err)
+	}
+	return nil
+}
+
+/**
+把旧版本Session的Settings升级到当前的结构版本,版本更新的Session原样保留
+*/
+func upgradeSettings(se *SessionImp) error {
+	schema := GetSettingsSchema()
+	if schema == nil || se.SettingsVersion >= schema.Version {
+		return nil
+	}
+	if schema.Upgrade != nil {
+		settings, err := schema.Upgrade(se.SettingsVersion, se.Settings)
+		if err != nil {
+			return err
+		}
+		se.Settings = settings
+	}
+	se.SettingsVersion = schema.Version
+	return nil
+}
+
+func (this *sessionagent) GetSettingsVersion() int32 {
+	return this.session.GetSettingsVersion()
+}
+
+func (this *sessionagent) setTyped(key string, kind gate.SettingKind, value string) (err string) {
+	if this.app == nil {
+		err = fmt.Sprintf("Module.App is nil")
+		return
+	}
+	if e := checkSetting(key, kind, value); e != nil {
+		err = e.Error()
+		return
+	}
+	if this.session.Settings == nil {
+		this.session.Settings = map[string]string{}
+	}
+	this.session.Settings[key] = value
+	this.markChanged(key)
+	return
+}
+
+func (this *sessionagent) SetInt64(key string, value int64) (err string) {
+	return this.setTyped(key, gate.SettingInt64, strconv.FormatInt(value, 10))
+}
+
+func (this *sessionagent) GetInt64(key string) (result int64, err string) {
+	value := this.Get(key)
+	if value == "" {
+		return
+	}
+	result, e := strconv.ParseInt(value, 10, 64)
+	if e != nil {
+		err = fmt.Sprintf("setting %s is not a valid int64: %v", key, e)
+	}
+	return
+}
+
+func (this *sessionagent) SetBool(key string, value bool) (err string) {
+	return this.setTyped(key, gate.SettingBool, strconv.FormatBool(value))
+}
+
+func (this *sessionagent) GetBool(key string) (result bool, err string) {
+	value := this.Get(key)
+	if value == "" {
+		return
+	}
+	result, e := strconv.ParseBool(value)
+	if e != nil {
+		err = fmt.Sprintf("setting %s is not a valid bool: %v", key, e)
+	}
+	return
+}
+
+func (this *sessionagent) SetFloat64(key string, value float64) (err string) {
+	return this.setTyped(key, gate.SettingFloat64, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (this *sessionagent) GetFloat64(key string) (result float64, err string) {
+	value := this.Get(key)
+	if value == "" {
+		return
+	}
+	result, e := strconv.ParseFloat(value, 64)
+	if e != nil {
+		err = fmt.Sprintf("setting %s is not a valid float64: %v", key, e)
+	}
+	return
+}
+
+func (this *sessionagent) SetJSON(key string, value interface{}) (err string) {
+	b, e := json.Marshal(value)
+	if e != nil {
+		err = e.Error()
+		return
+	}
+	return this.setTyped(key, gate.SettingJSON, string(b))
+}
+
+func (this *sessionagent) GetJSON(key string, value interface{}) (err string) {
+	s := this.Get(key)
+	if s == "" {
+		return
+	}
+	if e := json.Unmarshal([]byte(s), value); e != nil {
+		err = fmt.Sprintf("setting %s is not a valid json: %v", key, e)
+	}
+	return
+}
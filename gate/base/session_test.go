@@ -15,28 +15,30 @@ package basegate
 
 import (
 	"github.com/golang/protobuf/proto"
+	"github.com/leonlau/mqant/v2/app"
+	"github.com/leonlau/mqant/v2/gate"
 	"testing"
 )
 
 func TestSession(t *testing.T) {
-	session := &session{ // 使用辅助函数设置域的值
+	session := &SessionImp{ // 使用辅助函数设置域的值
 		IP:        *proto.String("127.0.0.1"),
 		Network:   *proto.String("tcp"),
-		Sessionid: *proto.String("iii"),
-		Serverid:  *proto.String("232244"),
+		SessionId: *proto.String("iii"),
+		ServerId:  *proto.String("232244"),
 	} // 进行编码
 	session.Settings = map[string]string{"isLogin": "true"}
 	data, err := proto.Marshal(session)
 	if err != nil {
-		t.Fatalf("marshaling error: ", err)
+		t.Fatalf("marshaling error: %v", err)
 	} // 进行解码
-	newSession := &session{}
+	newSession := &SessionImp{}
 	err = proto.Unmarshal(data, newSession)
 	if err != nil {
-		t.Fatalf("unmarshaling error: ", err)
+		t.Fatalf("unmarshaling error: %v", err)
 	} // 测试结果
-	if session.Serverid != newSession.GetServerid() {
-		t.Fatalf("data mismatch %q != %q", session.GetServerid(), newSession.GetServerid())
+	if session.ServerId != newSession.GetServerId() {
+		t.Fatalf("data mismatch %q != %q", session.GetServerId(), newSession.GetServerId())
 	}
 	if newSession.GetSettings() == nil {
 		t.Fatalf("data mismatch Settings == nil")
@@ -47,3 +49,159 @@ func TestSession(t *testing.T) {
 	}
 
 }
+
+func TestTypedSettings(t *testing.T) {
+	session := &sessionagent{app: &app.DefaultApp{}, session: &SessionImp{}}
+	if err := session.SetInt64("level", 42); err != "" {
+		t.Fatal(err)
+	}
+	if err := session.SetBool("vip", true); err != "" {
+		t.Fatal(err)
+	}
+	if err := session.SetFloat64("rate", 0.25); err != "" {
+		t.Fatal(err)
+	}
+	type room struct {
+		Id   string
+		Seat int
+	}
+	if err := session.SetJSON("room", room{Id: "r1", Seat: 3}); err != "" {
+		t.Fatal(err)
+	}
+	//仍然以字符串传输
+	data, err := session.Serializable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	se := &SessionImp{}
+	if err := proto.Unmarshal(data, se); err != nil {
+		t.Fatal(err)
+	}
+	if se.Settings["level"] != "42" || se.Settings["vip"] != "true" || se.Settings["rate"] != "0.25" {
+		t.Fatalf("unexpected settings %v", se.Settings)
+	}
+	newSession := &sessionagent{app: session.app, session: se}
+	if v, err := newSession.GetInt64("level"); err != "" || v != 42 {
+		t.Fatalf("GetInt64 = %v %q", v, err)
+	}
+	if v, err := newSession.GetBool("vip"); err != "" || !v {
+		t.Fatalf("GetBool = %v %q", v, err)
+	}
+	if v, err := newSession.GetFloat64("rate"); err != "" || v != 0.25 {
+		t.Fatalf("GetFloat64 = %v %q", v, err)
+	}
+	var r room
+	if err := newSession.GetJSON("room", &r); err != "" || r.Id != "r1" || r.Seat != 3 {
+		t.Fatalf("GetJSON = %v %q", r, err)
+	}
+	if v, err := newSession.GetInt64("missing"); err != "" || v != 0 {
+		t.Fatalf("GetInt64 missing = %v %q", v, err)
+	}
+	if _, err := newSession.GetInt64("vip"); err == "" {
+		t.Fatal("GetInt64 of a bool setting should fail")
+	}
+}
+
+func TestSettingsSchema(t *testing.T) {
+	SetSettingsSchema(&gate.SettingsSchema{
+		Version: 2,
+		Fields: map[string]gate.SettingKind{
+			"level": gate.SettingInt64,
+		},
+		Upgrade: func(version int32, settings map[string]string) (map[string]string, error) {
+			//版本1中等级保存在lv
+			if version < 2 {
+				settings["level"] = settings["lv"]
+				delete(settings, "lv")
+			}
+			return settings, nil
+		},
+	})
+	defer SetSettingsSchema(nil)
+
+	old, err := proto.Marshal(&SessionImp{SettingsVersion: 1, Settings: map[string]string{"lv": "7"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := NewSession(&app.DefaultApp{}, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.GetSettingsVersion() != 2 {
+		t.Fatalf("SettingsVersion = %d", session.GetSettingsVersion())
+	}
+	if v, e := session.GetInt64("level"); e != "" || v != 7 {
+		t.Fatalf("GetInt64 = %v %q", v, e)
+	}
+	if e := session.Set("level", "high"); e == "" {
+		t.Fatal("Set should check the declared type")
+	}
+	if e := session.SetBool("level", true); e == "" {
+		t.Fatal("SetBool should check the declared type")
+	}
+	if e := session.Set("level", "8"); e != "" {
+		t.Fatal(e)
+	}
+	if e := session.Clone().SetInt64("level", 9); e != "" {
+		t.Fatal(e)
+	}
+}
+
+func TestSettingsVersionConflict(t *testing.T) {
+	h := &handler{}
+	session := &sessionagent{app: &app.DefaultApp{}, session: &SessionImp{Settings: map[string]string{"a": "1"}}}
+	set := func(key, value string) func(settings map[string]string) map[string]string {
+		return func(settings map[string]string) map[string]string {
+			settings[key] = value
+			return settings
+		}
+	}
+	changed, removed, version, err := h.applySettings(session, 0, set("b", "2"))
+	if err != "" {
+		t.Fatal(err)
+	}
+	if version != 1 || session.GetVersion() != 1 {
+		t.Fatalf("Version = %d", session.GetVersion())
+	}
+	if len(changed) != 1 || changed["b"] != "2" || len(removed) != 0 {
+		t.Fatalf("unexpected diff %v %v", changed, removed)
+	}
+	//持有旧版本的调用方
+	if _, _, _, err := h.applySettings(session, 0, set("a", "3")); err != gate.SessionVersionConflict {
+		t.Fatalf("expected conflict, got %q", err)
+	}
+	if _, _, _, err := h.applySettings(session, -1, set("a", "3")); err != "" {
+		t.Fatal(err)
+	}
+	if session.Get("a") != "3" || session.Get("b") != "2" || session.GetVersion() != 2 {
+		t.Fatalf("unexpected session %v %d", session.GetSettings(), session.GetVersion())
+	}
+
+	//只记录本地修改过的key
+	local := session.Clone().(*sessionagent)
+	local.Set("c", "4")
+	local.Remove("a")
+	if len(local.changed) != 2 || !local.changed["a"] || !local.changed["c"] {
+		t.Fatalf("changed = %v", local.changed)
+	}
+	local.update(session)
+	if local.changed != nil {
+		t.Fatal("update should reset the changed keys")
+	}
+}
+
+func TestDiffSettings(t *testing.T) {
+	changed, removed := diffSettings(
+		map[string]string{"a": "1", "b": "2", "c": "3"},
+		map[string]string{"a": "1", "b": "20", "d": "4"},
+	)
+	if len(changed) != 2 || changed["b"] != "20" || changed["d"] != "4" {
+		t.Fatalf("changed = %v", changed)
+	}
+	if len(removed) != 1 || removed[0] != "c" {
+		t.Fatalf("removed = %v", removed)
+	}
+	if changed, removed := diffSettings(nil, nil); changed != nil || removed != nil {
+		t.Fatalf("unexpected diff %v %v", changed, removed)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+	"github.com/leonlau/mqant/v2/module"
+	"github.com/leonlau/mqant/v2/utils"
+)
+
+/**
+跨网关按Userid路由消息
+设置了PresenceHandler时从在线索引查询用户所在的网关,否则遍历gateType类型的所有网关
+*/
+type UserRouter struct {
+	app        module.App
+	gateType   string
+	presence   gate.PresenceHandler
+	mailbox    gate.MailboxStorage
+	mailboxTTL time.Duration
+}
+
+func NewUserRouter(app module.App, gateType string, presence gate.PresenceHandler) *UserRouter {
+	return &UserRouter{
+		app:      app,
+		gateType: gateType,
+		presence: presence,
+	}
+}
+
+/**
+用户不在线时SendToUser把消息存入离线消息,用户下一次Bind时由网关发送
+mailbox需要是网关共用的存储(与网关的MailboxStorage相同),ttl为0表示不过期
+*/
+func (this *UserRouter) SetMailbox(mailbox gate.MailboxStorage, ttl time.Duration) {
+	this.mailbox = mailbox
+	this.mailboxTTL = ttl
+}
+
+func (this *UserRouter) trace() log.TraceSpan {
+	return log.CreateTrace(utils.GenerateID().String(), utils.GenerateID().String())
+}
+
+/**
+查询用户所有在线的Session
+*/
+func (this *UserRouter) Locate(Userid string) ([]gate.Location, string) {
+	if this.presence != nil {
+		locs, err := this.presence.Locate(Userid)
+		if err != nil {
+			return nil, err.Error()
+		}
+		return locs, ""
+	}
+	locs := make([]gate.Location, 0)
+	for _, server := range this.app.GetServersByType(this.gateType) {
+		result, err := server.Call("Locate", this.trace(), Userid)
+		if err != "" {
+			log.Warnf("UserRouter Locate %s error: %s", server.GetId(), err)
+			continue
+		}
+		sessionids, _ := result.(string)
+		for _, sessionid := range strings.Split(sessionids, ",") {
+			if sessionid == "" {
+				continue
+			}
+			loc := gate.Location{
+				Userid:    Userid,
+				Serverid:  server.GetId(),
+				Sessionid: sessionid,
+			}
+			if i := strings.LastIndexByte(sessionid, '|'); i >= 0 {
+				loc.Sessionid = sessionid[:i]
+				loc.LoginAt, _ = strconv.ParseInt(sessionid[i+1:], 10, 64)
+			}
+			locs = append(locs, loc)
+		}
+	}
+	return locs, ""
+}
+
+/**
+用户是否在任意一个网关在线
+*/
+func (this *UserRouter) IsOnline(Userid string) (bool, string) {
+	locs, err := this.Locate(Userid)
+	if err != "" {
+		return false, err
+	}
+	return len(locs) > 0, ""
+}
+
+/**
+给用户所有在线的Session发送消息,返回发送成功的Session数量
+用户不在线时如果设置了离线消息存储则存入离线消息,返回0
+*/
+func (this *UserRouter) SendToUser(Userid string, topic string, body []byte) (int64, string) {
+	locs, err := this.Locate(Userid)
+	if err != "" {
+		return 0, err
+	}
+	if len(locs) == 0 {
+		if this.mailbox == nil {
+			return 0, fmt.Sprintf("userId 【%s】 is not online", Userid)
+		}
+		msg := gate.OfflineMessage{
+			Topic: topic,
+			Body:  body,
+		}
+		if this.mailboxTTL > 0 {
+			msg.ExpireAt = time.Now().Add(this.mailboxTTL)
+		}
+		if e := this.mailbox.Push(Userid, msg); e != nil {
+			return 0, e.Error()
+		}
+		return 0, ""
+	}
+	//按网关分组批量发送
+	batches := map[string][]string{}
+	for _, loc := range locs {
+		batches[loc.Serverid] = append(batches[loc.Serverid], loc.Sessionid)
+	}
+	var count int64 = 0
+	for serverid, sessionids := range batches {
+		server, e := this.app.GetServerById(serverid)
+		if e != nil {
+			log.Warnf("UserRouter service not found id(%s)", serverid)
+			continue
+		}
+		result, err := server.Call("SendBatch", this.trace(), strings.Join(sessionids, ","), topic, body)
+		if err != "" {
+			log.Warnf("UserRouter SendBatch %s error: %s", serverid, err)
+			continue
+		}
+		count += result.(int64)
+	}
+	return count, ""
+}
+
+/**
+分组在所有网关的Session
+*/
+func (this *UserRouter) GroupMembers(group string) ([]gate.Location, string) {
+	locs := make([]gate.Location, 0)
+	for _, server := range this.app.GetServersByType(this.gateType) {
+		result, err := server.Call("GroupMembers", this.trace(), group)
+		if err != "" {
+			log.Warnf("UserRouter GroupMembers %s error: %s", server.GetId(), err)
+			continue
+		}
+		sessionids, _ := result.(string)
+		for _, sessionid := range strings.Split(sessionids, ",") {
+			if sessionid == "" {
+				continue
+			}
+			locs = append(locs, gate.Location{
+				Serverid:  server.GetId(),
+				Sessionid: sessionid,
+			})
+		}
+	}
+	return locs, ""
+}
+
+/**
+广播消息给分组在所有网关的Session,返回发送成功的Session数量
+*/
+func (this *UserRouter) GroupBroadCast(group string, topic string, body []byte) (int64, string) {
+	var count int64 = 0
+	for _, server := range this.app.GetServersByType(this.gateType) {
+		result, err := server.Call("GroupBroadCast", this.trace(), group, topic, body)
+		if err != "" {
+			log.Warnf("UserRouter GroupBroadCast %s error: %s", server.GetId(), err)
+			continue
+		}
+		count += result.(int64)
+	}
+	return count, ""
+}
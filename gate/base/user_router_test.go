@@ -0,0 +1,44 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package basegate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/gate/mailbox"
+)
+
+type offlinePresence struct{}
+
+func (offlinePresence) Online(loc gate.Location) error                { return nil }
+func (offlinePresence) Offline(loc gate.Location) error               { return nil }
+func (offlinePresence) Locate(Userid string) ([]gate.Location, error) { return nil, nil }
+
+func TestSendToOfflineUser(t *testing.T) {
+	router := NewUserRouter(nil, "Gate", offlinePresence{})
+	if _, err := router.SendToUser("u1", "chat", []byte("hi")); err == "" {
+		t.Fatal("expected an error without a mailbox")
+	}
+	box := mailbox.NewMemoryMailbox()
+	router.SetMailbox(box, time.Minute)
+	if n, err := router.SendToUser("u1", "chat", []byte("hi")); n != 0 || err != "" {
+		t.Fatalf("SendToUser = %d %s", n, err)
+	}
+	msgs, _ := box.Pull("u1")
+	if len(msgs) != 1 || msgs[0].Topic != "chat" || msgs[0].ExpireAt.IsZero() {
+		t.Fatalf("unexpected mailbox %v", msgs)
+	}
+}
@@ -14,15 +14,26 @@
 package gate
 
 import (
+	"bufio"
+	"fmt"
 	"time"
 
 	"github.com/leonlau/mqant/v2/log"
+	"github.com/leonlau/mqant/v2/module"
 	"github.com/leonlau/mqant/v2/network"
 )
 
 var RPC_PARAM_SESSION_TYPE = "SESSION"
 var RPC_PARAM_ProtocolMarshal_TYPE = "ProtocolMarshal"
 
+//mTLS时已验证的客户端证书主题保存在Session.Settings中的key
+var TLSSubjectKey = "TLSSubject"
+
+/**
+修改Session Settings时调用方持有的版本已过期,需要Update后重试
+*/
+const SessionVersionConflict = "Session version conflict"
+
 /**
 net代理服务 处理器
 */
@@ -31,17 +42,93 @@ type GateHandler interface {
 	GetAgentNum() int
 	Bind(span log.TraceSpan, Sessionid string, Userid string) (result Session, err string)                 //Bind the session with the the Userid.
 	UnBind(span log.TraceSpan, Sessionid string) (result Session, err string)                              //UnBind the session with the the Userid.
-	Set(span log.TraceSpan, Sessionid string, key string, value string) (result Session, err string)       //Set values (one or many) for the session.
 	Remove(span log.TraceSpan, Sessionid string, key string) (result interface{}, err string)              //Remove value from the session.
-	Push(span log.TraceSpan, Sessionid string, Settings map[string]string) (result Session, err string)    //推送信息给Session
 	Send(span log.TraceSpan, Sessionid string, topic string, body []byte) (result interface{}, err string) //Send message
 	SendBatch(span log.TraceSpan, Sessionids string, topic string, body []byte) (int64, string)            //批量发送
 	BroadCast(span log.TraceSpan, topic string, body []byte) (int64, string)                               //广播消息给网关所有在连客户端
-	//查询某一个userId是否连接中，这里只是查询这一个网关里面是否有userId客户端连接，如果有多个网关就需要遍历了
+	Set(span log.TraceSpan, Sessionid string, key string, value string) (result Session, err string)       //Set values (one or many) for the session.
+	Push(span log.TraceSpan, Sessionid string, Settings map[string]string) (result Session, err string)    //用Settings替换Session的全部设置
+	//Settings的每次修改都会使Session.Version加一,以下方法的Version为调用方持有的版本,与网关的版本不一致时返回SessionVersionConflict,小于0时不检查版本
+	SetCAS(span log.TraceSpan, Sessionid string, key string, value string, Version int64) (result Session, err string)
+	PushCAS(span log.TraceSpan, Sessionid string, Settings map[string]string, Version int64) (result Session, err string)
+	RemoveCAS(span log.TraceSpan, Sessionid string, key string, Version int64) (result interface{}, err string)
+	//只修改Settings中的key并删除Removed中的key(只使用map的key),其他key保持不变
+	Patch(span log.TraceSpan, Sessionid string, Settings map[string]string, Removed map[string]string) (result Session, err string)
+	PatchCAS(span log.TraceSpan, Sessionid string, Settings map[string]string, Removed map[string]string, Version int64) (result Session, err string)
+	//查询某一个userId是否连接中，这里只是查询这一个网关里面是否有userId客户端连接，跨网关查询请使用basegate.UserRouter
 	IsConnect(span log.TraceSpan, Sessionid string, Userid string) (result bool, err string)
+	Locate(span log.TraceSpan, Userid string) (Sessionids string, err string)    //查询userId在这个网关的所有Session,sessionid之间用,分割
 	Close(span log.TraceSpan, Sessionid string) (result interface{}, err string) //主动关闭连接
 	Update(span log.TraceSpan, Sessionid string) (result Session, err string)    //更新整个Session 通常是其他模块拉取最新数据
 	OnDestroy()                                                                  //退出事件,主动关闭所有的连接
+	//排空网关,通知所有客户端后在window时间内逐步关闭连接,关闭完成后返回
+	OnDrain(topic string, body []byte, window time.Duration)
+	//连接断开但保留会话(MQTT clean-session=false),在Options.SessionResumeTTL时间内可被同一个ClientId和恢复令牌恢复
+	//pending为连接断开时还没有送达客户端的消息
+	Detach(clientId string, token string, session Session, topics map[string]byte, pending []PendingMessage)
+	//客户端重连时取回暂存的会话,令牌不匹配时返回nil,cleanSession=true时丢弃暂存的会话并返回nil
+	Resume(clientId string, token string, cleanSession bool) *DetachedSession
+	//通知客户端被踢下线的原因后关闭连接
+	Kick(span log.TraceSpan, Sessionid string, reason string) (result interface{}, err string)
+	//分组(房间/牌桌等),只包含本网关的Session,连接断开时自动退出所有分组
+	JoinGroup(span log.TraceSpan, Sessionid string, group string) (result interface{}, err string)
+	LeaveGroup(span log.TraceSpan, Sessionid string, group string) (result interface{}, err string)
+	GroupMembers(span log.TraceSpan, group string) (Sessionids string, err string) //sessionid之间用,分割
+	GroupBroadCast(span log.TraceSpan, group string, topic string, body []byte) (int64, string)
+	//查询Session发送队列的状态 {"Depth":等待发送的消息数,"Dropped":被丢弃的消息数}
+	QueueStats(span log.TraceSpan, Sessionid string) (result map[string]interface{}, err string)
+	//管理接口,分页查询Session,filter可选 Userid,IP(单个IP或CIDR),Network,ConnectedAfter/ConnectedBefore(unix秒)
+	ListSessions(span log.TraceSpan, filter map[string]string, offset int64, limit int64) (result map[string]interface{}, err string)
+	AgentStats(span log.TraceSpan, Sessionid string) (result map[string]interface{}, err string) //RevNum,SendNum,ConnTime,QueueDepth等
+	KickUser(span log.TraceSpan, Userid string, reason string) (int64, string)                   //踢掉用户在本网关的所有Session
+	KickIP(span log.TraceSpan, ipRange string, reason string) (int64, string)                    //踢掉IP段内的所有Session
+}
+
+/**
+同一个Userid登录的Session数超过Options.MaxLoginSessions时的处理策略
+*/
+type LoginPolicy int
+
+const (
+	KickOld   LoginPolicy = iota //踢掉已登录的Session
+	RejectNew                    //拒绝新的Bind
+)
+
+/**
+客户端消息超过限流速率时的处理策略
+*/
+type RateLimitAction int
+
+const (
+	RateLimitDrop       RateLimitAction = iota //丢弃消息
+	RateLimitReply                             //丢弃消息并回复错误
+	RateLimitDisconnect                        //断开连接
+)
+
+/**
+发送队列超过高水位时的处理策略
+*/
+type OutboundPolicy int
+
+const (
+	OutboundDisconnect OutboundPolicy = iota //断开慢速客户端
+	OutboundDropOldest                       //丢弃最早的消息
+	OutboundDropNew                          //丢弃新消息
+)
+
+/**
+断线后暂存的会话
+*/
+type DetachedSession struct {
+	ClientId string
+	Session  Session
+	Topics   map[string]byte  //已订阅的主题 topic->qos
+	Pending  []PendingMessage //断线期间未能送达的消息
+}
+
+type PendingMessage struct {
+	Topic string
+	Body  []byte
 }
 
 type Session interface {
@@ -64,15 +151,35 @@ type Session interface {
 	Update() (err string)
 	Bind(UserId string) (err string)
 	UnBind() (err string)
-	Push() (err string)
+	Push() (err string) //网关的版本已经变化时返回SessionVersionConflict
 	Set(key string, value string) (err string)
 	SetPush(key string, value string) (err string) //设置值以后立即推送到gate网关
 	Get(key string) (result string)
 	Remove(key string) (err string)
+	//带类型的Settings,值仍然以字符串保存在Settings中,key不存在时返回零值
+	SetInt64(key string, value int64) (err string)
+	GetInt64(key string) (result int64, err string)
+	SetBool(key string, value bool) (err string)
+	GetBool(key string) (result bool, err string)
+	SetFloat64(key string, value float64) (err string)
+	GetFloat64(key string) (result float64, err string)
+	SetJSON(key string, value interface{}) (err string) //以JSON编码保存
+	GetJSON(key string, value interface{}) (err string) //JSON解码到value
+	GetSettingsVersion() int32                          //Settings的结构版本,见SettingsSchema
+	GetVersion() int64                                  //网关上Settings的修改次数,用于Push时检查冲突
+	SetVersion(version int64)
+	//只把本地修改过的key推送到网关,不同模块修改不同的key时不会相互覆盖
+	Patch() (err string)
+	//与Patch相同,网关的版本已经变化时返回SessionVersionConflict,需要Update之后重新修改
+	PatchCAS() (err string)
 	Send(topic string, body []byte) (err string)
 	SendNR(topic string, body []byte) (err string)
 	SendBatch(Sessionids string, topic string, body []byte) (int64, string) //想该客户端的网关批量发送消息
-	//查询某一个userId是否连接中，这里只是查询这一个网关里面是否有userId客户端连接，如果有多个网关就需要遍历了
+	JoinGroup(group string) (err string)
+	LeaveGroup(group string) (err string)
+	//广播消息给分组在所有网关的Session
+	GroupBroadCast(group string, topic string, body []byte) (int64, string)
+	//查询某一个userId是否连接中，这里只是查询这一个网关里面是否有userId客户端连接，跨网关查询使用basegate.UserRouter.IsOnline
 	IsConnect(Userid string) (result bool, err string)
 	//是否是访客(未登录) ,默认判断规则为 userId==""代表访客
 	IsGuest() bool
@@ -92,6 +199,30 @@ type Session interface {
 	ExtractSpan() log.TraceSpan
 }
 
+/**
+Settings中值的类型
+*/
+type SettingKind int
+
+const (
+	SettingString SettingKind = iota
+	SettingInt64
+	SettingBool
+	SettingFloat64
+	SettingJSON
+)
+
+/**
+带版本的Session Settings结构
+Settings在传输时仍然是map[string]string,Version随Session一起传输
+收到版本低于Version的Session时调用Upgrade把旧的Settings转换为当前版本
+*/
+type SettingsSchema struct {
+	Version int32
+	Fields  map[string]SettingKind //声明了类型的key,写入时检查值是否符合类型
+	Upgrade func(version int32, settings map[string]string) (map[string]string, error)
+}
+
 /**
 Session信息持久化
 */
@@ -117,6 +248,96 @@ type StorageHandler interface {
 	Heartbeat(session Session)
 }
 
+/**
+离线消息
+*/
+type OfflineMessage struct {
+	Topic    string
+	Body     []byte
+	ExpireAt time.Time //过期时间,零值表示不过期
+}
+
+/**
+离线消息存储,以Userid为key
+*/
+type MailboxStorage interface {
+	/**
+	用户不在线时缓存一条消息
+	*/
+	Push(Userid string, msg OfflineMessage) (err error)
+	/**
+	取出用户所有未过期的离线消息(按写入顺序),取出后从存储中删除
+	Bind Userid时会调用Pull并将消息发送给客户端
+	*/
+	Pull(Userid string) (msgs []OfflineMessage, err error)
+}
+
+/**
+用户所在的网关和Session
+*/
+type Location struct {
+	Userid    string
+	Serverid  string
+	Sessionid string
+	LoginAt   int64 //Bind Userid的时间(毫秒时间戳),同时在线数超限时先踢掉最早登录的Session
+}
+
+/**
+集群范围的用户在线索引 Userid->网关Serverid+Sessionid
+所有网关和需要按Userid路由的模块应该使用同一个共享存储
+*/
+type PresenceHandler interface {
+	/**
+	Session Bind Userid以后调用
+	*/
+	Online(loc Location) (err error)
+	/**
+	Session UnBind或连接断开以后调用
+	*/
+	Offline(loc Location) (err error)
+	/**
+	查询用户所有在线的Session
+	*/
+	Locate(Userid string) (locs []Location, err error)
+}
+
+/**
+二进制协议的帧编解码器
+topic为空的帧表示心跳包
+WriteFrame无法编码某一条消息时(例如topic没有对应的消息号)返回*FrameEncodeError并且不写入任何数据,
+网关只丢弃这一条消息;返回其他错误时认为连接已经不可写
+*/
+type FrameCodec interface {
+	ReadFrame(r *bufio.Reader) (topic string, body []byte, err error)
+	WriteFrame(w *bufio.Writer, topic string, body []byte) error
+}
+
+/**
+消息无法编码成帧,连接仍然可用
+*/
+type FrameEncodeError struct {
+	Topic string
+	Err   error
+}
+
+func (e *FrameEncodeError) Error() string {
+	return fmt.Sprintf("encode frame of topic %s: %v", e.Topic, e.Err)
+}
+
+/**
+网关路由表中的一条路由,Topic和MsgId二选一,按配置顺序匹配第一条
+*/
+type Route struct {
+	Topic  string //客户端的topic,支持MQTT通配符 +(一级) 和 #(剩余所有级)
+	MsgId  int64  //数字消息id,客户端的topic为 消息id 或 消息id/请求序号,便于二进制客户端使用
+	Module string //目标模块类型
+	Func   string //目标模块的函数
+	//按一致性哈希选择模块实例的key来源: userid,setting:<key>,payload:<字段,可以用.访问子字段>
+	//为空时使用Options.RouteKeys中目标模块类型的配置
+	Hash  string
+	Reply bool //是否把后端的返回结果回复给客户端,带请求序号的数字消息总是回复
+}
+
 type RouteHandler interface {
 	/**
 	是否需要对本次客户端请求转发规则进行hook
@@ -134,6 +355,39 @@ type SessionLearner interface {
 	DisConnect(a Session) //当连接关闭	或者客户端主动发送MQTT DisConnect命令
 }
 
+/**
+Session变化事件的类型
+*/
+const (
+	SessionBind       = "bind"
+	SessionUnBind     = "unbind"
+	SessionSettings   = "settings"
+	SessionDisconnect = "disconnect"
+)
+
+/**
+Session变化事件,Settings变化时只包含变化的key
+*/
+type SessionEvent struct {
+	Type      string
+	Serverid  string //网关的Serverid
+	Sessionid string
+	Userid    string            //事件发生后的Userid,unbind/disconnect时为之前绑定的Userid
+	OldUserid string            //bind时之前绑定的Userid
+	Version   int64             //事件发生后Session的版本
+	Changed   map[string]string `json:",omitempty"` //新增或修改的key
+	Removed   []string          `json:",omitempty"` //删除的key
+}
+
+/**
+接收Session变化事件
+网关的SessionLearner同时实现了这个接口时会在本进程收到事件
+其他模块可以通过basegate.SubscribeSessionEvents订阅网关发布的事件(Options.PublishSessionEvents)
+*/
+type SessionEventLearner interface {
+	OnSessionEvent(event SessionEvent)
+}
+
 type Agent interface {
 	OnInit(gate Gate, conn network.Conn) error
 	WriteMsg(topic string, body []byte) error
@@ -148,12 +402,23 @@ type Agent interface {
 	GetSession() Session
 }
 
+/**
+带发送队列的Agent,WriteMsg只把消息放入队列,由单独的协程写入连接
+*/
+type QueuedAgent interface {
+	QueueDepth() int   //队列中等待发送的消息数
+	DroppedNum() int64 //因队列满被丢弃的消息数
+}
+
 type Gate interface {
 	Options() Options
+	GetModule() module.RPCModule
 	GetGateHandler() GateHandler
 	GetAgentLearner() AgentLearner
 	GetSessionLearner() SessionLearner
 	GetStorageHandler() StorageHandler
+	GetMailboxStorage() MailboxStorage
+	GetPresenceHandler() PresenceHandler
 	GetRouteHandler() RouteHandler
 	GetJudgeGuest() func(session Session) bool
 	NewSession(data []byte) (Session, error)
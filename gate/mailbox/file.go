@@ -0,0 +1,189 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mailbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+)
+
+var ErrTopicTooLong = errors.New("mailbox: topic is longer than 65535 bytes")
+
+var errCorrupt = errors.New("mailbox: corrupt record")
+
+type fileMailbox struct {
+	opts Options
+	dir  string
+	lock sync.Mutex
+}
+
+/**
+本地磁盘离线消息存储,每个用户一个文件
+*/
+func NewFileMailbox(dir string, opts ...Option) (gate.MailboxStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileMailbox{
+		opts: NewOptions(opts...),
+		dir:  dir,
+	}, nil
+}
+
+func (m *fileMailbox) path(Userid string) string {
+	return filepath.Join(m.dir, hex.EncodeToString([]byte(Userid))+".mbox")
+}
+
+func (m *fileMailbox) Push(Userid string, msg gate.OfflineMessage) error {
+	if len(msg.Topic) > math.MaxUint16 {
+		return ErrTopicTooLong
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	msgs, err := readMessages(m.path(Userid))
+	if err != nil {
+		return err
+	}
+	return writeMessages(m.path(Userid), trim(append(msgs, msg), m.opts, time.Now()))
+}
+
+func (m *fileMailbox) Pull(Userid string) ([]gate.OfflineMessage, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	msgs, err := readMessages(m.path(Userid))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(m.path(Userid)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return trim(msgs, m.opts, time.Now()), nil
+}
+
+/**
+文件格式: [8字节过期时间][2字节topic长度][topic][4字节body长度][body]...
+文件损坏时(例如写入过程中磁盘满)保留损坏位置之前的消息,丢弃之后的部分,下一次Push时重写文件
+*/
+func readMessages(path string) ([]gate.OfflineMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	remain := info.Size()
+	var msgs []gate.OfflineMessage
+	for remain > 0 {
+		msg, n, err := readMessage(r, remain)
+		if err != nil {
+			log.Warnf("mailbox %s: %v, dropping %d bytes", path, err, remain)
+			return msgs, nil
+		}
+		remain -= n
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+/**
+读取一条消息,remain为文件剩余的字节数,长度超出时认为文件已损坏
+*/
+func readMessage(r *bufio.Reader, remain int64) (msg gate.OfflineMessage, n int64, err error) {
+	var expire int64
+	var topicLen uint16
+	var bodyLen uint32
+	if remain < 14 {
+		return msg, 0, errCorrupt
+	}
+	if err = binary.Read(r, binary.BigEndian, &expire); err != nil {
+		return
+	}
+	if err = binary.Read(r, binary.BigEndian, &topicLen); err != nil {
+		return
+	}
+	if int64(topicLen)+14 > remain {
+		return msg, 0, errCorrupt
+	}
+	topic := make([]byte, topicLen)
+	if _, err = io.ReadFull(r, topic); err != nil {
+		return
+	}
+	if err = binary.Read(r, binary.BigEndian, &bodyLen); err != nil {
+		return
+	}
+	n = 14 + int64(topicLen) + int64(bodyLen)
+	if n > remain {
+		return msg, 0, errCorrupt
+	}
+	body := make([]byte, bodyLen)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	msg.Topic = string(topic)
+	msg.Body = body
+	if expire != 0 {
+		msg.ExpireAt = time.Unix(0, expire)
+	}
+	return msg, n, nil
+}
+
+func writeMessages(path string, msgs []gate.OfflineMessage) error {
+	if len(msgs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	for _, msg := range msgs {
+		if len(msg.Topic) > math.MaxUint16 {
+			continue
+		}
+		var expire int64
+		if !msg.ExpireAt.IsZero() {
+			expire = msg.ExpireAt.UnixNano()
+		}
+		binary.Write(buf, binary.BigEndian, expire)
+		binary.Write(buf, binary.BigEndian, uint16(len(msg.Topic)))
+		buf.WriteString(msg.Topic)
+		binary.Write(buf, binary.BigEndian, uint32(len(msg.Body)))
+		buf.Write(msg.Body)
+	}
+	//先写临时文件再替换,避免写一半时进程退出导致文件损坏
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
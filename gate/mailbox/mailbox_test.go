@@ -0,0 +1,125 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mailbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+)
+
+func testMailbox(t *testing.T, m gate.MailboxStorage) {
+	for i := 0; i < 5; i++ {
+		if err := m.Push("u1", gate.OfflineMessage{Topic: "chat/msg", Body: []byte(fmt.Sprintf("%d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Push("u1", gate.OfflineMessage{Topic: "chat/msg", Body: []byte("expired"), ExpireAt: time.Now().Add(-time.Second)})
+
+	msgs, err := m.Pull("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// MaxNum=3 只保留最后3条, 过期的消息被丢弃
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	for i, msg := range msgs {
+		if string(msg.Body) != fmt.Sprintf("%d", i+2) {
+			t.Errorf("message %d out of order: %s", i, msg.Body)
+		}
+	}
+	msgs, err = m.Pull("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("mailbox should be empty after pull, got %d", len(msgs))
+	}
+}
+
+func TestMemoryMailbox(t *testing.T) {
+	testMailbox(t, NewMemoryMailbox(MaxNum(3)))
+}
+
+func TestFileMailbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m, err := NewFileMailbox(dir, MaxNum(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMailbox(t, m)
+}
+
+func TestMailboxMaxBytes(t *testing.T) {
+	m := NewMemoryMailbox(MaxBytes(10))
+	m.Push("u1", gate.OfflineMessage{Topic: "a", Body: []byte("1234")})
+	m.Push("u1", gate.OfflineMessage{Topic: "b", Body: []byte("5678")})
+	m.Push("u1", gate.OfflineMessage{Topic: "c", Body: []byte("9")})
+	msgs, _ := m.Pull("u1")
+	if len(msgs) != 2 || msgs[0].Topic != "b" {
+		t.Fatalf("unexpected messages %v", msgs)
+	}
+}
+
+func TestFileMailboxCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	box, err := NewFileMailbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := box.(*fileMailbox)
+	m.Push("u1", gate.OfflineMessage{Topic: "a", Body: []byte("1")})
+	m.Push("u1", gate.OfflineMessage{Topic: "b", Body: []byte("2")})
+	//截断最后一条消息
+	data, _ := ioutil.ReadFile(m.path("u1"))
+	ioutil.WriteFile(m.path("u1"), data[:len(data)-1], 0644)
+
+	if err := m.Push("u1", gate.OfflineMessage{Topic: "d", Body: []byte("4")}); err != nil {
+		t.Fatalf("Push on a corrupt mailbox: %v", err)
+	}
+	msgs, err := m.Pull("u1")
+	if err != nil {
+		t.Fatalf("Pull on a repaired mailbox: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].Topic != "a" || msgs[1].Topic != "d" {
+		t.Fatalf("unexpected messages %v", msgs)
+	}
+
+	//声明了超长body的记录
+	m.Push("u1", gate.OfflineMessage{Topic: "a", Body: []byte("1")})
+	data, _ = ioutil.ReadFile(m.path("u1"))
+	data = append(data, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 'c', 0xff, 0xff, 0xff, 0xff)
+	ioutil.WriteFile(m.path("u1"), data, 0644)
+	if msgs, err := m.Pull("u1"); err != nil || len(msgs) != 1 {
+		t.Fatalf("Pull = %v %v", msgs, err)
+	}
+
+	long := gate.OfflineMessage{Topic: string(make([]byte, 65536))}
+	if err := m.Push("u1", long); err != ErrTopicTooLong {
+		t.Fatalf("expected ErrTopicTooLong, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package mailbox
+
+import (
+	"sync"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+)
+
+type memoryMailbox struct {
+	opts  Options
+	lock  sync.Mutex
+	boxes map[string][]gate.OfflineMessage
+}
+
+/**
+内存离线消息存储,进程重启后消息丢失
+*/
+func NewMemoryMailbox(opts ...Option) gate.MailboxStorage {
+	return &memoryMailbox{
+		opts:  NewOptions(opts...),
+		boxes: map[string][]gate.OfflineMessage{},
+	}
+}
+
+func (m *memoryMailbox) Push(Userid string, msg gate.OfflineMessage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.boxes[Userid] = trim(append(m.boxes[Userid], msg), m.opts, time.Now())
+	return nil
+}
+
+func (m *memoryMailbox) Pull(Userid string) ([]gate.OfflineMessage, error) {
+	m.lock.Lock()
+	msgs := m.boxes[Userid]
+	delete(m.boxes, Userid)
+	m.lock.Unlock()
+	return trim(msgs, m.opts, time.Now()), nil
+}
+
+/**
+丢弃过期的消息,并按数量和字节数上限丢弃最早的消息
+*/
+func trim(msgs []gate.OfflineMessage, opts Options, now time.Time) []gate.OfflineMessage {
+	alive := msgs[:0]
+	for _, msg := range msgs {
+		if msg.ExpireAt.IsZero() || msg.ExpireAt.After(now) {
+			alive = append(alive, msg)
+		}
+	}
+	if opts.MaxNum > 0 && len(alive) > opts.MaxNum {
+		alive = alive[len(alive)-opts.MaxNum:]
+	}
+	if opts.MaxBytes > 0 {
+		size := 0
+		for i := len(alive) - 1; i >= 0; i-- {
+			size += len(alive[i].Topic) + len(alive[i].Body)
+			if size > opts.MaxBytes {
+				alive = alive[i+1:]
+				break
+			}
+		}
+	}
+	if len(alive) == 0 {
+		return nil
+	}
+	return alive
+}
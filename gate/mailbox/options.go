@@ -0,0 +1,48 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mailbox 离线消息存储的内存和本地磁盘实现
+package mailbox
+
+type Option func(*Options)
+
+type Options struct {
+	MaxNum   int //每个用户最多缓存的消息数,超出后丢弃最早的消息,0表示不限制
+	MaxBytes int //每个用户最多缓存的消息字节数,超出后丢弃最早的消息,0表示不限制
+}
+
+func NewOptions(opts ...Option) Options {
+	opt := Options{
+		MaxNum:   100,
+		MaxBytes: 1024 * 1024,
+	}
+
+	for _, o := range opts {
+		o(&opt)
+	}
+
+	return opt
+}
+
+func MaxNum(s int) Option {
+	return func(o *Options) {
+		o.MaxNum = s
+	}
+}
+
+func MaxBytes(s int) Option {
+	return func(o *Options) {
+		o.MaxBytes = s
+	}
+}
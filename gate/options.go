@@ -13,7 +13,12 @@
 // limitations under the License.
 package gate
 
-import "time"
+import (
+	"crypto/ed25519"
+	"net/http"
+	"os"
+	"time"
+)
 
 type Option func(*Options)
 
@@ -24,9 +29,78 @@ type Options struct {
 	OverTime        time.Duration
 	RouteHandler    RouteHandler
 	StorageHandler  StorageHandler
+	MailboxStorage  MailboxStorage
+	PresenceHandler PresenceHandler
+	// 定期为本网关已绑定Userid的Session续期在线索引,需要小于PresenceHandler记录的有效期,0表示不续期
+	PresenceRefresh time.Duration
 	AgentLearner    AgentLearner
 	SessionLearner  SessionLearner
 	GateHandler     GateHandler
+	// 二进制协议(Protocol=binary)的帧编解码器
+	FrameCodec FrameCodec
+	// 断线会话保留时间(MQTT clean-session=false),0表示不保留
+	SessionResumeTTL time.Duration
+	// 会话保留期间最多缓存的待发送消息数
+	SessionResumeMaxPending int
+	// 离线消息有效期,0表示不过期
+	MailboxTTL time.Duration
+	// 同一个Userid最多同时在线的Session数(跨网关),0表示不限制
+	MaxLoginSessions int
+	// 超过MaxLoginSessions时的处理策略
+	LoginPolicy LoginPolicy
+	// 被踢下线时通知客户端的topic
+	KickTopic string
+	// 每个连接每秒允许的消息数,0表示不限制
+	SessionRateLimit float64
+	SessionRateBurst int
+	// 同一个IP所有连接每秒允许的消息数,0表示不限制
+	IPRateLimit float64
+	IPRateBurst int
+	// 超过限流速率时的处理策略
+	RateLimitAction RateLimitAction
+	// 每个连接发送队列的高水位(消息数)
+	OutboundHighWater int
+	// 每个连接发送队列的高水位(字节数),0表示不限制
+	OutboundHighWaterBytes int
+	// 发送队列超过高水位时的处理策略
+	OutboundPolicy OutboundPolicy
+	// 是否允许mqtt/binary协议的客户端协商负载压缩
+	PayloadCompression bool
+	// 小于这个字节数的消息不压缩(负载压缩和websocket permessage-deflate)
+	CompressThreshold int
+	// flate压缩级别
+	CompressLevel int
+	// 是否允许mqtt/binary协议的客户端通过密钥交换启用负载加密
+	PayloadEncryption bool
+	// 是否要求客户端必须先完成密钥交换,否则拒绝所有消息
+	RequireEncryption bool
+	// 签名密钥交换的Ed25519私钥,客户端用对应的公钥验证网关的身份
+	HandshakeKey ed25519.PrivateKey
+	// websocket升级之前调用,可以根据cookie或query中的令牌设置Session的Userid和Settings
+	// 返回错误时拒绝连接
+	WSHandshakeHandler func(r *http.Request, session Session) error
+	// 排空网关时通知客户端重连到其他网关的topic
+	DrainTopic string
+	// 排空网关时通知客户端的消息
+	DrainMessage string
+	// 排空网关时逐步关闭所有连接的时间
+	DrainWindow time.Duration
+	// 收到这个信号时排空网关,例如syscall.SIGUSR1,为nil时不监听
+	DrainSignal os.Signal
+	// 模块退出时先排空网关,DrainWindow需要小于应用退出的超时时间
+	DrainOnShutdown bool
+	// 通过nats发布Session变化事件,其他模块用basegate.SubscribeSessionEvents订阅
+	PublishSessionEvents bool
+	// 路由表,匹配的消息按路由转发,不匹配的消息仍然交给RouteHandler或者按 moduleType/HD_handler[/msgid] 转发
+	Routes []Route
+	// 按模块类型配置请求的路由key来源(格式同Route.Hash),例如 {"room":"setting:RoomId"}
+	// 配置了key的模块类型按带负载上限的一致性哈希(rendezvous)选择实例,相同key的请求落到同一个实例,
+	// 取不到key时使用Userid,没有Userid时使用网关的ServerId
+	// 没有配置key的模块类型按Userid选择实例,没有Userid时随机选择
+	RouteKeys map[string]string
+	// 一致性哈希的负载系数,每个实例分配的key数不超过平均值的HashLoadFactor倍
+	// 没有实例达到上限时所有网关对相同的key选择相同的实例,小于等于0时不限制负载
+	HashLoadFactor float64
 }
 
 func NewOptions(opts ...Option) Options {
@@ -35,6 +109,20 @@ func NewOptions(opts ...Option) Options {
 		BufSize:         2048,
 		Heartbeat:       time.Minute,
 		OverTime:        time.Second * 10,
+
+		SessionResumeMaxPending: 100,
+		MailboxTTL:              time.Minute * 10,
+		PresenceRefresh:         time.Second * 30,
+		LoginPolicy:             KickOld,
+		KickTopic:               "$gate/kick",
+		OutboundHighWater:       1024,
+		OutboundPolicy:          OutboundDisconnect,
+		CompressThreshold:       1024,
+		CompressLevel:           -1, //flate.DefaultCompression
+		DrainTopic:              "$gate/reconnect",
+		DrainMessage:            "server maintenance, please reconnect",
+		DrainWindow:             time.Second * 30,
+		HashLoadFactor:          1.25,
 	}
 
 	for _, o := range opts {
@@ -76,6 +164,21 @@ func SetStorageHandler(s StorageHandler) Option {
 		o.StorageHandler = s
 	}
 }
+func SetMailboxStorage(s MailboxStorage) Option {
+	return func(o *Options) {
+		o.MailboxStorage = s
+	}
+}
+func SetPresenceHandler(s PresenceHandler) Option {
+	return func(o *Options) {
+		o.PresenceHandler = s
+	}
+}
+func PresenceRefresh(s time.Duration) Option {
+	return func(o *Options) {
+		o.PresenceRefresh = s
+	}
+}
 func SetAgentLearner(s AgentLearner) Option {
 	return func(o *Options) {
 		o.AgentLearner = s
@@ -87,8 +190,178 @@ func SetGateHandler(s GateHandler) Option {
 	}
 }
 
+func SetFrameCodec(s FrameCodec) Option {
+	return func(o *Options) {
+		o.FrameCodec = s
+	}
+}
+
 func SetSessionLearner(s SessionLearner) Option {
 	return func(o *Options) {
 		o.SessionLearner = s
 	}
 }
+
+func SessionResumeTTL(s time.Duration) Option {
+	return func(o *Options) {
+		o.SessionResumeTTL = s
+	}
+}
+
+func SessionResumeMaxPending(s int) Option {
+	return func(o *Options) {
+		o.SessionResumeMaxPending = s
+	}
+}
+
+func MailboxTTL(s time.Duration) Option {
+	return func(o *Options) {
+		o.MailboxTTL = s
+	}
+}
+
+func MaxLoginSessions(s int) Option {
+	return func(o *Options) {
+		o.MaxLoginSessions = s
+	}
+}
+
+func SetLoginPolicy(s LoginPolicy) Option {
+	return func(o *Options) {
+		o.LoginPolicy = s
+	}
+}
+
+func KickTopic(s string) Option {
+	return func(o *Options) {
+		o.KickTopic = s
+	}
+}
+
+/**
+每个连接的消息限流,rate为每秒消息数,burst为允许的突发消息数
+*/
+func SessionRateLimit(rate float64, burst int) Option {
+	return func(o *Options) {
+		o.SessionRateLimit = rate
+		o.SessionRateBurst = burst
+	}
+}
+
+/**
+同一个IP所有连接的消息限流,rate为每秒消息数,burst为允许的突发消息数
+*/
+func IPRateLimit(rate float64, burst int) Option {
+	return func(o *Options) {
+		o.IPRateLimit = rate
+		o.IPRateBurst = burst
+	}
+}
+
+func SetRateLimitAction(s RateLimitAction) Option {
+	return func(o *Options) {
+		o.RateLimitAction = s
+	}
+}
+
+/**
+发送队列高水位,messages为消息数,bytes为字节数(0表示不限制)
+*/
+func OutboundHighWater(messages int, bytes int) Option {
+	return func(o *Options) {
+		o.OutboundHighWater = messages
+		o.OutboundHighWaterBytes = bytes
+	}
+}
+
+func SetOutboundPolicy(s OutboundPolicy) Option {
+	return func(o *Options) {
+		o.OutboundPolicy = s
+	}
+}
+
+/**
+允许客户端协商负载压缩,threshold为压缩的最小字节数,level为flate压缩级别
+*/
+func PayloadCompression(threshold int, level int) Option {
+	return func(o *Options) {
+		o.PayloadCompression = true
+		o.CompressThreshold = threshold
+		o.CompressLevel = level
+	}
+}
+
+/**
+允许客户端通过密钥交换启用负载加密,required为true时未加密的消息会被拒绝
+key用于签名密钥交换,客户端需要预先配置对应的公钥
+*/
+func PayloadEncryption(key ed25519.PrivateKey, required bool) Option {
+	return func(o *Options) {
+		o.PayloadEncryption = true
+		o.RequireEncryption = required
+		o.HandshakeKey = key
+	}
+}
+
+func SetWSHandshakeHandler(s func(r *http.Request, session Session) error) Option {
+	return func(o *Options) {
+		o.WSHandshakeHandler = s
+	}
+}
+
+func DrainTopic(s string) Option {
+	return func(o *Options) {
+		o.DrainTopic = s
+	}
+}
+
+func DrainMessage(s string) Option {
+	return func(o *Options) {
+		o.DrainMessage = s
+	}
+}
+
+func DrainWindow(s time.Duration) Option {
+	return func(o *Options) {
+		o.DrainWindow = s
+	}
+}
+
+func DrainSignal(s os.Signal) Option {
+	return func(o *Options) {
+		o.DrainSignal = s
+	}
+}
+
+func DrainOnShutdown(s bool) Option {
+	return func(o *Options) {
+		o.DrainOnShutdown = s
+	}
+}
+
+func PublishSessionEvents(s bool) Option {
+	return func(o *Options) {
+		o.PublishSessionEvents = s
+	}
+}
+
+func Routes(routes ...Route) Option {
+	return func(o *Options) {
+		o.Routes = append(o.Routes, routes...)
+	}
+}
+
+func RouteKey(moduleType string, source string) Option {
+	return func(o *Options) {
+		if o.RouteKeys == nil {
+			o.RouteKeys = map[string]string{}
+		}
+		o.RouteKeys[moduleType] = source
+	}
+}
+
+func HashLoadFactor(factor float64) Option {
+	return func(o *Options) {
+		o.HashLoadFactor = factor
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package presence
+
+import (
+	"sync"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+)
+
+type memoryPresence struct {
+	opts  Options
+	lock  sync.Mutex
+	users map[string]map[gate.Location]time.Time
+}
+
+/**
+内存在线索引,只能在同一个进程内共享(单进程部署或者测试)
+*/
+func NewMemoryPresence(opts ...Option) gate.PresenceHandler {
+	return &memoryPresence{
+		opts:  NewOptions(opts...),
+		users: map[string]map[gate.Location]time.Time{},
+	}
+}
+
+func (p *memoryPresence) Online(loc gate.Location) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	locs, ok := p.users[loc.Userid]
+	if !ok {
+		locs = map[gate.Location]time.Time{}
+		p.users[loc.Userid] = locs
+	}
+	locs[loc] = time.Now().Add(p.opts.TTL)
+	return nil
+}
+
+func (p *memoryPresence) Offline(loc gate.Location) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if locs, ok := p.users[loc.Userid]; ok {
+		delete(locs, loc)
+		if len(locs) == 0 {
+			delete(p.users, loc.Userid)
+		}
+	}
+	return nil
+}
+
+func (p *memoryPresence) Locate(Userid string) ([]gate.Location, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	var result []gate.Location
+	for loc, expireAt := range p.users[Userid] {
+		if expireAt.After(now) {
+			result = append(result, loc)
+		} else {
+			delete(p.users[Userid], loc)
+		}
+	}
+	if len(result) == 0 {
+		delete(p.users, Userid)
+	}
+	return result, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package presence 用户在线索引(gate.PresenceHandler)的内存和redis实现
+package presence
+
+import "time"
+
+type Option func(*Options)
+
+type Options struct {
+	TTL    time.Duration //在线记录的有效期,网关按gate.PresenceRefresh定期续期,网关崩溃后记录在TTL后过期
+	Prefix string        //redis中key的前缀
+}
+
+func NewOptions(opts ...Option) Options {
+	opt := Options{
+		TTL:    time.Second * 90,
+		Prefix: "mqant:presence:",
+	}
+
+	for _, o := range opts {
+		o(&opt)
+	}
+
+	return opt
+}
+
+func TTL(s time.Duration) Option {
+	return func(o *Options) {
+		o.TTL = s
+	}
+}
+
+func Prefix(s string) Option {
+	return func(o *Options) {
+		o.Prefix = s
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package presence
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+)
+
+func testPresence(t *testing.T, p gate.PresenceHandler) {
+	a := gate.Location{Userid: "u1", Serverid: "gate@1", Sessionid: "s1"}
+	b := gate.Location{Userid: "u1", Serverid: "gate@2", Sessionid: "s2"}
+	p.Online(a)
+	p.Online(b)
+	locs, err := p.Locate("u1")
+	if err != nil || len(locs) != 2 {
+		t.Fatalf("Locate = %v %v", locs, err)
+	}
+	p.Offline(a)
+	locs, _ = p.Locate("u1")
+	if len(locs) != 1 || locs[0] != b {
+		t.Fatalf("Locate after Offline = %v", locs)
+	}
+	//没有续期的记录过期
+	time.Sleep(150 * time.Millisecond)
+	p.Online(a)
+	time.Sleep(100 * time.Millisecond)
+	locs, _ = p.Locate("u1")
+	if len(locs) != 1 || locs[0] != a {
+		t.Fatalf("expired locations should be dropped, got %v", locs)
+	}
+	if locs, _ := p.Locate("nobody"); len(locs) != 0 {
+		t.Fatalf("Locate unknown user = %v", locs)
+	}
+}
+
+func TestMemoryPresence(t *testing.T) {
+	testPresence(t, NewMemoryPresence(TTL(200*time.Millisecond)))
+}
+
+/**
+只实现了ZADD/ZREM/ZRANGE/ZREMRANGEBYSCORE/PEXPIRE的redis替身
+*/
+type fakeRedis struct {
+	lock sync.Mutex
+	sets map[string]map[string]int64
+}
+
+func (r *fakeRedis) Do(commandName string, args ...interface{}) (interface{}, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := args[0].(string)
+	set := r.sets[key]
+	switch commandName {
+	case "ZADD":
+		if set == nil {
+			set = map[string]int64{}
+			r.sets[key] = set
+		}
+		set[args[2].(string)] = args[1].(int64)
+	case "ZREM":
+		delete(set, args[1].(string))
+	case "ZREMRANGEBYSCORE":
+		max, _ := strconv.ParseInt(args[2].(string), 10, 64)
+		for m, score := range set {
+			if score <= max {
+				delete(set, m)
+			}
+		}
+	case "ZRANGE":
+		if len(set) == 0 {
+			return []interface{}{}, nil
+		}
+		members := make([]string, 0, len(set))
+		for m := range set {
+			members = append(members, m)
+		}
+		sort.Slice(members, func(i, j int) bool { return set[members[i]] < set[members[j]] })
+		reply := make([]interface{}, 0, len(members))
+		for _, m := range members {
+			reply = append(reply, []byte(m))
+		}
+		return reply, nil
+	}
+	return int64(1), nil
+}
+
+func TestRedisPresence(t *testing.T) {
+	r := &fakeRedis{sets: map[string]map[string]int64{}}
+	testPresence(t, NewRedisPresence(r, TTL(200*time.Millisecond)))
+	if _, ok := r.sets["mqant:presence:u1"]; !ok {
+		t.Fatal("keys should use the configured prefix")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package presence
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/gate/storage"
+)
+
+type redisPresence struct {
+	opts   Options
+	client storage.RedisClient
+}
+
+/**
+兼容redis协议的服务器上的在线索引,所有网关共享
+每个用户一个有序集合,key为Options.Prefix+Userid,成员为Serverid+"\n"+Sessionid+"\n"+LoginAt,分数为过期时间(毫秒)
+查询时先删除已过期的成员,所以各网关的时钟需要大致同步
+*/
+func NewRedisPresence(client storage.RedisClient, opts ...Option) gate.PresenceHandler {
+	return &redisPresence{
+		opts:   NewOptions(opts...),
+		client: client,
+	}
+}
+
+func (p *redisPresence) key(Userid string) string {
+	return p.opts.Prefix + Userid
+}
+
+func member(loc gate.Location) string {
+	return loc.Serverid + "\n" + loc.Sessionid + "\n" + strconv.FormatInt(loc.LoginAt, 10)
+}
+
+func (p *redisPresence) Online(loc gate.Location) error {
+	ttl := int64(p.opts.TTL / time.Millisecond)
+	expireAt := time.Now().UnixNano()/int64(time.Millisecond) + ttl
+	if _, err := p.client.Do("ZADD", p.key(loc.Userid), expireAt, member(loc)); err != nil {
+		return err
+	}
+	//所有成员都过期以后整个key也会过期
+	_, err := p.client.Do("PEXPIRE", p.key(loc.Userid), ttl)
+	return err
+}
+
+func (p *redisPresence) Offline(loc gate.Location) error {
+	_, err := p.client.Do("ZREM", p.key(loc.Userid), member(loc))
+	return err
+}
+
+func (p *redisPresence) Locate(Userid string) ([]gate.Location, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if _, err := p.client.Do("ZREMRANGEBYSCORE", p.key(Userid), "-inf", strconv.FormatInt(now, 10)); err != nil {
+		return nil, err
+	}
+	reply, err := p.client.Do("ZRANGE", p.key(Userid), 0, -1)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	members, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply type %T for ZRANGE", reply)
+	}
+	var locs []gate.Location
+	for _, m := range members {
+		var s string
+		switch v := m.(type) {
+		case []byte:
+			s = string(v)
+		case string:
+			s = v
+		default:
+			return nil, fmt.Errorf("redis: unexpected member type %T for ZRANGE", m)
+		}
+		parts := strings.Split(s, "\n")
+		if len(parts) != 3 {
+			continue
+		}
+		LoginAt, _ := strconv.ParseInt(parts[2], 10, 64)
+		locs = append(locs, gate.Location{Userid: Userid, Serverid: parts[0], Sessionid: parts[1], LoginAt: LoginAt})
+	}
+	return locs, nil
+}
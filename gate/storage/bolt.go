@@ -0,0 +1,153 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+/**
+本地bbolt文件的Session存储,适用于单节点部署,进程重启后数据仍然保留
+值的格式: [8字节过期时间(unix纳秒)][Session序列化数据]
+后台协程每SweepInterval删除一次过期的Session,不再使用时需要调用Close
+*/
+type BoltStorage struct {
+	opts   Options
+	db     *bolt.DB
+	bucket []byte
+	die    chan struct{}
+}
+
+func NewBoltStorage(path string, opts ...Option) (*BoltStorage, error) {
+	options := NewOptions(opts...)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &BoltStorage{
+		opts:   options,
+		db:     db,
+		bucket: []byte(options.Bucket),
+		die:    make(chan struct{}),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(s.bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *BoltStorage) run() {
+	ticker := time.NewTicker(s.opts.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.die:
+			return
+		case <-ticker.C:
+			if err := s.sweep(time.Now()); err != nil {
+				log.Warnf("bolt storage sweep error: %v", err)
+			}
+		}
+	}
+}
+
+func (s *BoltStorage) sweep(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if expired(v, now) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func expired(v []byte, now time.Time) bool {
+	if len(v) < 8 {
+		return true
+	}
+	return int64(binary.BigEndian.Uint64(v)) <= now.UnixNano()
+}
+
+func (s *BoltStorage) encode(data []byte, now time.Time) []byte {
+	v := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(v, uint64(now.Add(s.opts.TTL).UnixNano()))
+	copy(v[8:], data)
+	return v
+}
+
+func (s *BoltStorage) Storage(session gate.Session) error {
+	data, err := session.Serializable()
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(session.GetUserId()), s.encode(data, time.Now()))
+	})
+}
+
+func (s *BoltStorage) Delete(session gate.Session) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(session.GetUserId()))
+	})
+}
+
+func (s *BoltStorage) Query(Userid string) (data []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(s.bucket).Get([]byte(Userid))
+		if v == nil || expired(v, time.Now()) {
+			return nil
+		}
+		//v只在事务内有效
+		data = make([]byte, len(v)-8)
+		copy(data, v[8:])
+		return nil
+	})
+	return
+}
+
+func (s *BoltStorage) Heartbeat(session gate.Session) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		key := []byte(session.GetUserId())
+		v := b.Get(key)
+		now := time.Now()
+		if v == nil || expired(v, now) {
+			return nil
+		}
+		return b.Put(key, s.encode(v[8:], now))
+	})
+	if err != nil {
+		log.Warnf("bolt storage heartbeat error: %v", err)
+	}
+}
+
+func (s *BoltStorage) Close() error {
+	close(s.die)
+	return s.db.Close()
+}
@@ -0,0 +1,101 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+)
+
+type memoryEntry struct {
+	data     []byte
+	expireAt time.Time
+}
+
+type memoryStorage struct {
+	opts      Options
+	lock      sync.Mutex
+	sessions  map[string]*memoryEntry
+	lastSweep time.Time
+}
+
+/**
+内存Session存储,适用于单节点部署,进程重启后数据丢失
+过期的Session在访问时按SweepInterval清理
+*/
+func NewMemoryStorage(opts ...Option) gate.StorageHandler {
+	return &memoryStorage{
+		opts:      NewOptions(opts...),
+		sessions:  map[string]*memoryEntry{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (m *memoryStorage) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < m.opts.SweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for k, e := range m.sessions {
+		if !e.expireAt.After(now) {
+			delete(m.sessions, k)
+		}
+	}
+}
+
+func (m *memoryStorage) Storage(session gate.Session) error {
+	data, err := session.Serializable()
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	m.sweep(now)
+	m.sessions[session.GetUserId()] = &memoryEntry{
+		data:     data,
+		expireAt: now.Add(m.opts.TTL),
+	}
+	return nil
+}
+
+func (m *memoryStorage) Delete(session gate.Session) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.sessions, session.GetUserId())
+	return nil
+}
+
+func (m *memoryStorage) Query(Userid string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	m.sweep(now)
+	e, ok := m.sessions[Userid]
+	if !ok || !e.expireAt.After(now) {
+		return nil, nil
+	}
+	return e.data, nil
+}
+
+func (m *memoryStorage) Heartbeat(session gate.Session) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	if e, ok := m.sessions[session.GetUserId()]; ok && e.expireAt.After(now) {
+		e.expireAt = now.Add(m.opts.TTL)
+	}
+}
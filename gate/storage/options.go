@@ -0,0 +1,66 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage Session持久化(gate.StorageHandler)的内存,本地bbolt和redis实现
+package storage
+
+import "time"
+
+type Option func(*Options)
+
+type Options struct {
+	TTL           time.Duration //Session信息的有效期,Storage和Heartbeat时重新计算
+	SweepInterval time.Duration //清理过期Session的间隔(内存和bbolt)
+	Prefix        string        //redis中key的前缀
+	Bucket        string        //bbolt中保存Session的bucket
+}
+
+func NewOptions(opts ...Option) Options {
+	opt := Options{
+		TTL:           time.Hour * 24,
+		SweepInterval: time.Minute,
+		Prefix:        "mqant:session:",
+		Bucket:        "sessions",
+	}
+
+	for _, o := range opts {
+		o(&opt)
+	}
+
+	return opt
+}
+
+func TTL(s time.Duration) Option {
+	return func(o *Options) {
+		o.TTL = s
+	}
+}
+
+func SweepInterval(s time.Duration) Option {
+	return func(o *Options) {
+		o.SweepInterval = s
+	}
+}
+
+func Prefix(s string) Option {
+	return func(o *Options) {
+		o.Prefix = s
+	}
+}
+
+func Bucket(s string) Option {
+	return func(o *Options) {
+		o.Bucket = s
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/log"
+)
+
+/**
+执行redis命令,*RedisConn和redigo的redis.Conn都满足这个接口
+回复中的批量字符串为[]byte,空回复为nil
+*/
+type RedisClient interface {
+	Do(commandName string, args ...interface{}) (reply interface{}, err error)
+}
+
+type redisStorage struct {
+	opts   Options
+	client RedisClient
+}
+
+/**
+兼容redis协议的服务器上的Session存储,多个网关可以共享
+key为Options.Prefix+Userid,过期由服务器处理
+*/
+func NewRedisStorage(client RedisClient, opts ...Option) gate.StorageHandler {
+	return &redisStorage{
+		opts:   NewOptions(opts...),
+		client: client,
+	}
+}
+
+func (s *redisStorage) key(Userid string) string {
+	return s.opts.Prefix + Userid
+}
+
+func (s *redisStorage) ttl() int64 {
+	return int64(s.opts.TTL / time.Millisecond)
+}
+
+func (s *redisStorage) Storage(session gate.Session) error {
+	data, err := session.Serializable()
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Do("SET", s.key(session.GetUserId()), data, "PX", s.ttl())
+	return err
+}
+
+func (s *redisStorage) Delete(session gate.Session) error {
+	_, err := s.client.Do("DEL", s.key(session.GetUserId()))
+	return err
+}
+
+func (s *redisStorage) Query(Userid string) ([]byte, error) {
+	reply, err := s.client.Do("GET", s.key(Userid))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	switch v := reply.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %T for GET", reply)
+}
+
+func (s *redisStorage) Heartbeat(session gate.Session) {
+	if _, err := s.client.Do("PEXPIRE", s.key(session.GetUserId()), s.ttl()); err != nil {
+		log.Warnf("redis storage heartbeat error: %v", err)
+	}
+}
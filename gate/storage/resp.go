@@ -0,0 +1,230 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+/**
+redis返回的错误回复
+*/
+type RedisError string
+
+func (e RedisError) Error() string { return string(e) }
+
+var errRedisProtocol = errors.New("redis: invalid reply")
+
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+/**
+最简单的RESP协议客户端,兼容redis协议的服务器(redis,kvrocks,pika等)都可以使用
+空闲连接放在连接池中复用,出错的连接直接关闭
+*/
+type RedisConn struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *respConn
+}
+
+/**
+password为空时不认证,db为0时不切换数据库
+*/
+func DialRedis(addr string, password string, db int) *RedisConn {
+	return &RedisConn{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  time.Second * 5,
+		idle:     make(chan *respConn, 16),
+	}
+}
+
+func (c *RedisConn) get() (*respConn, error) {
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &respConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if c.password != "" {
+		if _, err := c.do(rc, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.do(rc, "SELECT", c.db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (c *RedisConn) put(rc *respConn) {
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+}
+
+/**
+执行一条命令,回复按类型返回 string(简单字符串),int64,[]byte(批量字符串),[]interface{}(数组)
+空回复返回nil,错误回复返回RedisError
+*/
+func (c *RedisConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(rc, commandName, args...)
+	if _, ok := err.(RedisError); err != nil && !ok {
+		rc.conn.Close()
+		return nil, err
+	}
+	c.put(rc)
+	return reply, err
+}
+
+func (c *RedisConn) do(rc *respConn, commandName string, args ...interface{}) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := writeCommand(rc.w, commandName, args...); err != nil {
+		return nil, err
+	}
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(rc.r)
+}
+
+/**
+关闭连接池中的空闲连接
+*/
+func (c *RedisConn) Close() error {
+	for {
+		select {
+		case rc := <-c.idle:
+			rc.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func writeBulk(w *bufio.Writer, b []byte) {
+	w.WriteString("$")
+	w.WriteString(strconv.Itoa(len(b)))
+	w.WriteString("\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func writeCommand(w *bufio.Writer, commandName string, args ...interface{}) error {
+	w.WriteString("*")
+	w.WriteString(strconv.Itoa(len(args) + 1))
+	w.WriteString("\r\n")
+	writeBulk(w, []byte(commandName))
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			writeBulk(w, []byte(v))
+		case []byte:
+			writeBulk(w, v)
+		case int:
+			writeBulk(w, []byte(strconv.Itoa(v)))
+		case int64:
+			writeBulk(w, []byte(strconv.FormatInt(v, 10)))
+		default:
+			return fmt.Errorf("redis: unsupported argument type %T", arg)
+		}
+	}
+	return nil
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		reply := make([]interface{}, n)
+		for i := range reply {
+			v, err := readReply(r)
+			if e, ok := err.(RedisError); ok {
+				v = e
+			} else if err != nil {
+				return nil, err
+			}
+			reply[i] = v
+		}
+		return reply, nil
+	}
+	return nil, errRedisProtocol
+}
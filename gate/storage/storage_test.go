@@ -0,0 +1,236 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/gate"
+	"github.com/leonlau/mqant/v2/gate/base"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newSession(t *testing.T, Userid string, settings map[string]string) gate.Session {
+	session, err := basegate.NewSessionByMap(nil, map[string]interface{}{
+		"Userid":    Userid,
+		"Sessionid": "s-" + Userid,
+		"Settings":  settings,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func testStorage(t *testing.T, s gate.StorageHandler) {
+	if err := s.Storage(newSession(t, "u1", map[string]string{"level": "3"})); err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.Query("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := basegate.NewSession(nil, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.GetUserId() != "u1" || session.Get("level") != "3" {
+		t.Fatalf("unexpected session %v %v", session.GetUserId(), session.GetSettings())
+	}
+	if data, err := s.Query("u2"); err != nil || data != nil {
+		t.Fatalf("Query unknown user = %v %v", data, err)
+	}
+
+	//心跳延长有效期,TTL为200ms
+	time.Sleep(120 * time.Millisecond)
+	s.Heartbeat(session)
+	time.Sleep(120 * time.Millisecond)
+	if data, err := s.Query("u1"); err != nil || data == nil {
+		t.Fatalf("session should be kept alive by heartbeat: %v", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if data, err := s.Query("u1"); err != nil || data != nil {
+		t.Fatalf("session should be expired: %v", err)
+	}
+
+	if err := s.Storage(session); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(session); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := s.Query("u1"); err != nil || data != nil {
+		t.Fatalf("session should be deleted: %v", err)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryStorage(TTL(200*time.Millisecond)))
+}
+
+func TestBoltStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewBoltStorage(filepath.Join(dir, "sessions.db"), TTL(200*time.Millisecond), SweepInterval(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStorage(t, s)
+
+	//过期的数据被后台清理
+	s.Storage(newSession(t, "u3", nil))
+	time.Sleep(300 * time.Millisecond)
+	var n int
+	s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(s.bucket).Stats().KeyN
+		return nil
+	})
+	if n != 0 {
+		t.Fatalf("expired sessions should be swept, %d left", n)
+	}
+}
+
+/**
+只实现了SET/GET/DEL/PEXPIRE/AUTH的redis替身
+*/
+type fakeRedis struct {
+	ln   net.Listener
+	lock sync.Mutex
+	data map[string]string
+	ttl  map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{ln: ln, data: map[string]string{}, ttl: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(br)
+		if err != nil {
+			return
+		}
+		args := make([]string, 0)
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		conn.Write([]byte(r.exec(args)))
+	}
+}
+
+func (r *fakeRedis) get(key string) (string, bool) {
+	if at, ok := r.ttl[key]; ok && !at.After(time.Now()) {
+		delete(r.data, key)
+		delete(r.ttl, key)
+	}
+	v, ok := r.data[key]
+	return v, ok
+}
+
+func (r *fakeRedis) exec(args []string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		if args[1] != "secret" {
+			return "-ERR invalid password\r\n"
+		}
+		return "+OK\r\n"
+	case "SET":
+		r.data[args[1]] = args[2]
+		delete(r.ttl, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			r.ttl[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "GET":
+		v, ok := r.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "DEL":
+		_, ok := r.get(args[1])
+		delete(r.data, args[1])
+		delete(r.ttl, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "PEXPIRE":
+		if _, ok := r.get(args[1]); !ok {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[2])
+		r.ttl[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisStorage(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.ln.Close()
+	client := DialRedis(r.ln.Addr().String(), "secret", 0)
+	defer client.Close()
+	s := NewRedisStorage(client, TTL(200*time.Millisecond))
+	testStorage(t, s)
+	s.Storage(newSession(t, "u4", nil))
+	r.lock.Lock()
+	_, ok := r.data["mqant:session:u4"]
+	r.lock.Unlock()
+	if !ok {
+		t.Fatal("keys should use the configured prefix")
+	}
+
+	if _, err := client.Do("INCR", "x"); err == nil {
+		t.Fatal("expected an error reply")
+	} else if _, ok := err.(RedisError); !ok {
+		t.Fatalf("expected RedisError, got %T", err)
+	}
+	if _, err := DialRedis(r.ln.Addr().String(), "wrong", 0).Do("GET", "x"); err == nil {
+		t.Fatal("expected auth failure")
+	}
+}
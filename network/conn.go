@@ -22,3 +22,10 @@ type Conn interface {
 	Destroy()
 	doDestroy()
 }
+
+// 读写超时,与net包的超时错误行为一致
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
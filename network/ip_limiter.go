@@ -0,0 +1,70 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"net"
+	"sync"
+)
+
+/**
+限制每个IP同时建立的连接数
+*/
+type ipConnLimiter struct {
+	sync.Mutex
+	max    int
+	counts map[string]int
+}
+
+func newIPConnLimiter(max int) *ipConnLimiter {
+	return &ipConnLimiter{
+		max:    max,
+		counts: map[string]int{},
+	}
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// 超过上限时返回false
+func (l *ipConnLimiter) acquire(ip string) bool {
+	if l == nil || l.max <= 0 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.counts[ip] >= l.max {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+func (l *ipConnLimiter) release(ip string) {
+	if l == nil || l.max <= 0 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.counts[ip] <= 1 {
+		delete(l.counts, ip)
+	} else {
+		l.counts[ip]--
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import "testing"
+
+func TestIPConnLimiter(t *testing.T) {
+	l := newIPConnLimiter(2)
+	ip := hostOf("10.0.0.1:5000")
+	if !l.acquire(ip) || !l.acquire(ip) {
+		t.Fatal("acquire under limit failed")
+	}
+	if l.acquire(ip) {
+		t.Fatal("acquire over limit succeeded")
+	}
+	if !l.acquire("10.0.0.2") {
+		t.Fatal("limit should be per ip")
+	}
+	l.release(ip)
+	if !l.acquire(ip) {
+		t.Fatal("acquire after release failed")
+	}
+	var unlimited *ipConnLimiter
+	if !unlimited.acquire(ip) {
+		t.Fatal("nil limiter should not limit")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+/**
+KCP参数
+*/
+type KCPOptions struct {
+	NoDelay      int  // 0:关闭(默认) 1:开启
+	Interval     int  // 内部flush间隔,毫秒,默认100
+	Resend       int  // 快速重传,0:关闭
+	NoCongestion int  // 1:关闭拥塞控制
+	SndWnd       int  // 发送窗口,单位为包,默认32
+	RcvWnd       int  // 接收窗口,单位为包,默认128
+	MTU          int  // 默认1400
+	VerifyAddr   bool // 建立会话前先完成地址验证握手(见KCPHandshake),客户端和服务端需要一致
+}
+
+/**
+以KCP协议在UDP上实现的可靠连接(github.com/xtaci/kcp-go)
+服务端所有连接共用一个UDP socket,客户端(DialKCP)独占一个
+*/
+type KCPConn struct {
+	*kcp.UDPSession
+	udp       net.PacketConn //DialKCP创建的UDP socket,需要自己关闭
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func newKCPConn(sess *kcp.UDPSession, opts KCPOptions) *KCPConn {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = 100
+	}
+	sess.SetNoDelay(opts.NoDelay, interval, opts.Resend, opts.NoCongestion)
+	sess.SetWindowSize(opts.SndWnd, opts.RcvWnd)
+	if opts.MTU > 0 {
+		sess.SetMtu(opts.MTU)
+	}
+	//上层协议自己分帧,按字节流收发
+	sess.SetStreamMode(true)
+	sess.SetACKNoDelay(opts.NoDelay != 0)
+	return &KCPConn{UDPSession: sess}
+}
+
+/**
+连接到KCP服务器,开启VerifyAddr时先完成地址验证的握手再建立KCP会话
+*/
+func DialKCP(addr string, opts KCPOptions) (*KCPConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.VerifyAddr {
+		if err := KCPHandshake(udp, raddr); err != nil {
+			udp.Close()
+			return nil, err
+		}
+	}
+	sess, err := kcp.NewConn(raddr.String(), nil, 0, 0, udp)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	c := newKCPConn(sess, opts)
+	c.udp = udp
+	return c, nil
+}
+
+/**
+kcp-go超时返回的错误没有实现net.Error,转换成与net包一致的超时错误
+*/
+func kcpError(err error) error {
+	if err != nil && errors.Cause(err).Error() == "timeout" {
+		return timeoutError{}
+	}
+	return err
+}
+
+func (c *KCPConn) Read(b []byte) (int, error) {
+	n, err := c.UDPSession.Read(b)
+	return n, kcpError(err)
+}
+
+func (c *KCPConn) Write(b []byte) (int, error) {
+	n, err := c.UDPSession.Write(b)
+	return n, kcpError(err)
+}
+
+func (c *KCPConn) doDestroy() {
+	c.closeOnce.Do(func() {
+		c.UDPSession.Close()
+		if c.udp != nil {
+			c.udp.Close()
+		}
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+func (c *KCPConn) Destroy() {
+	c.doDestroy()
+}
+
+func (c *KCPConn) Close() error {
+	c.doDestroy()
+	return nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+KCP的地址验证握手(KCPOptions.VerifyAddr开启时),服务端确认客户端能收到发往它的源地址的报文之后才把报文交给KCP,
+伪造源地址的UDP报文不会创建会话,也不会占用服务端的内存和协程
+开启后普通的kcp-go客户端需要先在自己的UDP socket上调用KCPHandshake,再用这个socket建立KCP会话
+	客户端 -> 服务端  magic+kcpHello+填充,共kcpHelloSize字节,不小于服务端的回复,不能用来放大流量
+	服务端 -> 客户端  magic+kcpCookie+cookie(kcpCookieSize字节)
+	客户端 -> 服务端  magic+kcpVerify+cookie
+	服务端 -> 客户端  magic+kcpAck
+cookie为 HMAC-SHA256(随机密钥, 时间片+客户端地址) 的前kcpCookieSize字节,服务端不为未验证的地址保存任何状态
+验证通过的地址在kcpVerifiedIdle内没有报文或者连接关闭之后需要重新握手
+KCP报文的第5个字节是命令(81-84),不会与握手报文混淆
+*/
+const (
+	kcpMagic            = "mqkc"
+	kcpHello            = 1
+	kcpCookie           = 2
+	kcpVerify           = 3
+	kcpAck              = 4
+	kcpHelloSize        = 64
+	kcpCookieSize       = 16
+	kcpCookiePeriod     = 30 * time.Second
+	kcpVerifiedIdle     = 5 * time.Minute
+	kcpHandshakeTimeout = time.Second
+	kcpHandshakeRetries = 5
+	kcpMaxVerified      = 10000 //没有设置MaxConnNum时最多同时验证通过的地址数
+)
+
+func kcpPacket(typ byte, payload []byte, size int) []byte {
+	b := make([]byte, len(kcpMagic)+1+len(payload), size)
+	copy(b, kcpMagic)
+	b[len(kcpMagic)] = typ
+	copy(b[len(kcpMagic)+1:], payload)
+	return b[:cap(b)]
+}
+
+/**
+服务端的UDP socket,只把验证通过的地址的报文交给KCP
+*/
+type kcpCookieConn struct {
+	net.PacketConn
+	secret    []byte
+	max       int //最多同时验证通过的地址数
+	lock      sync.Mutex
+	verified  map[string]time.Time
+	lastSweep time.Time
+}
+
+func newKCPCookieConn(conn net.PacketConn, max int) (*kcpCookieConn, error) {
+	if max <= 0 {
+		max = kcpMaxVerified
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &kcpCookieConn{
+		PacketConn: conn,
+		secret:     secret,
+		max:        max,
+		verified:   map[string]time.Time{},
+		lastSweep:  time.Now(),
+	}, nil
+}
+
+func (c *kcpCookieConn) cookie(addr net.Addr, period int64) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	binary.Write(mac, binary.BigEndian, period)
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:kcpCookieSize]
+}
+
+func (c *kcpCookieConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if c.handshake(b[:n], addr) {
+			continue
+		}
+		if c.allowed(addr) {
+			return n, addr, nil
+		}
+	}
+}
+
+/**
+处理握手报文,返回false表示不是握手报文
+*/
+func (c *kcpCookieConn) handshake(p []byte, addr net.Addr) bool {
+	if len(p) <= len(kcpMagic) || string(p[:len(kcpMagic)]) != kcpMagic {
+		return false
+	}
+	period := time.Now().UnixNano() / int64(kcpCookiePeriod)
+	switch p[len(kcpMagic)] {
+	case kcpHello:
+		if len(p) == kcpHelloSize {
+			c.PacketConn.WriteTo(kcpPacket(kcpCookie, c.cookie(addr, period), len(kcpMagic)+1+kcpCookieSize), addr)
+		}
+	case kcpVerify:
+		cookie := p[len(kcpMagic)+1:]
+		if len(cookie) != kcpCookieSize {
+			return true
+		}
+		//接受上一个时间片的cookie,避免在时间片的边界上握手失败
+		if hmac.Equal(cookie, c.cookie(addr, period)) || hmac.Equal(cookie, c.cookie(addr, period-1)) {
+			if c.verify(addr) {
+				c.PacketConn.WriteTo(kcpPacket(kcpAck, nil, len(kcpMagic)+1), addr)
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *kcpCookieConn) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < kcpVerifiedIdle/2 {
+		return
+	}
+	c.lastSweep = now
+	for key, last := range c.verified {
+		if now.Sub(last) >= kcpVerifiedIdle {
+			delete(c.verified, key)
+		}
+	}
+}
+
+func (c *kcpCookieConn) verify(addr net.Addr) bool {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sweep(now)
+	key := addr.String()
+	if _, ok := c.verified[key]; !ok && len(c.verified) >= c.max {
+		return false
+	}
+	c.verified[key] = now
+	return true
+}
+
+func (c *kcpCookieConn) allowed(addr net.Addr) bool {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sweep(now)
+	key := addr.String()
+	if _, ok := c.verified[key]; !ok {
+		return false
+	}
+	c.verified[key] = now
+	return true
+}
+
+/**
+连接关闭后这个地址需要重新握手
+*/
+func (c *kcpCookieConn) forget(addr net.Addr) {
+	c.lock.Lock()
+	delete(c.verified, addr.String())
+	c.lock.Unlock()
+}
+
+/**
+客户端的握手,成功后conn上的报文才会被服务端交给KCP,例如
+	udp, _ := net.ListenUDP("udp", nil)
+	network.KCPHandshake(udp, raddr)
+	sess, _ := kcp.NewConn(raddr.String(), nil, 0, 0, udp)
+*/
+func KCPHandshake(conn net.PacketConn, raddr net.Addr) error {
+	defer conn.SetReadDeadline(time.Time{})
+	cookie, err := kcpExchange(conn, raddr, kcpPacket(kcpHello, nil, kcpHelloSize), kcpCookie)
+	if err != nil {
+		return err
+	}
+	if len(cookie) != kcpCookieSize {
+		return fmt.Errorf("kcp handshake with %s: invalid cookie", raddr)
+	}
+	_, err = kcpExchange(conn, raddr, kcpPacket(kcpVerify, cookie, len(kcpMagic)+1+kcpCookieSize), kcpAck)
+	return err
+}
+
+/**
+重复发送req直到收到服务端类型为reply的回复,返回回复中类型之后的内容
+*/
+func kcpExchange(conn net.PacketConn, raddr net.Addr, req []byte, reply byte) ([]byte, error) {
+	buf := make([]byte, 1500)
+	for i := 0; i < kcpHandshakeRetries; i++ {
+		if _, err := conn.WriteTo(req, raddr); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(kcpHandshakeTimeout))
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if from.String() == raddr.String() && n > len(kcpMagic) && string(buf[:len(kcpMagic)]) == kcpMagic && buf[len(kcpMagic)] == reply {
+				return append([]byte(nil), buf[len(kcpMagic)+1:n]...), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("kcp handshake with %s timed out", raddr)
+}
@@ -0,0 +1,184 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"net"
+	"sync"
+
+	"github.com/leonlau/mqant/v2/log"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+/**
+KCP(UDP可靠传输)服务器
+开启VerifyAddr时客户端需要先完成地址验证的握手(见KCPHandshake),未验证的地址发来的报文直接丢弃
+*/
+type KCPServer struct {
+	Addr         string
+	MaxConnNum   int
+	MaxConnPerIP int //每个IP最多同时建立的连接数,0表示不限制
+	KCPOptions
+	NewAgent   func(*KCPConn) Agent
+	udp        net.PacketConn
+	cookies    *kcpCookieConn
+	ln         *kcp.Listener
+	conns      map[*KCPConn]struct{}
+	ipConns    *ipConnLimiter
+	mutexConns sync.Mutex
+	wgLn       sync.WaitGroup
+	wgConns    sync.WaitGroup
+	stopAccept bool
+}
+
+func (server *KCPServer) Start() {
+	if err := server.init(); err != nil {
+		log.Warnf("%v", err)
+		return
+	}
+	log.Infof("KCP Listen :%s", server.Addr)
+	go server.run()
+}
+
+func (server *KCPServer) init() error {
+	conn, err := net.ListenPacket("udp", server.Addr)
+	if err != nil {
+		return err
+	}
+	udp := conn
+	if server.VerifyAddr {
+		//验证通过但还没有建立连接的地址也要限制,否则可以绕过MaxConnNum占用内存
+		cookies, err := newKCPCookieConn(conn, server.MaxConnNum*2)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		server.cookies = cookies
+		udp = cookies
+	}
+	ln, err := kcp.ServeConn(nil, 0, 0, udp)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if server.NewAgent == nil {
+		log.Warnf("NewAgent must not be nil")
+	}
+	server.udp = udp
+	server.ln = ln
+	server.conns = map[*KCPConn]struct{}{}
+	server.ipConns = newIPConnLimiter(server.MaxConnPerIP)
+	//在启动run之前计数,Close不会错过还没有开始运行的run
+	server.wgLn.Add(1)
+	return nil
+}
+
+/**
+连接关闭或者被拒绝后这个地址需要重新握手
+*/
+func (server *KCPServer) forget(addr net.Addr) {
+	if server.cookies != nil {
+		server.cookies.forget(addr)
+	}
+}
+
+/**
+拒绝这个会话
+*/
+func (server *KCPServer) reject(sess *kcp.UDPSession, format string, a ...interface{}) {
+	sess.Close()
+	server.forget(sess.RemoteAddr())
+	log.Warnf(format, a...)
+}
+
+func (server *KCPServer) run() {
+	defer server.wgLn.Done()
+
+	for {
+		sess, err := server.ln.AcceptKCP()
+		if err != nil {
+			return
+		}
+		ip := hostOf(sess.RemoteAddr().String())
+		server.mutexConns.Lock()
+		if server.stopAccept {
+			server.mutexConns.Unlock()
+			server.reject(sess, "kcp server stopped accepting")
+			continue
+		}
+		if server.MaxConnNum > 0 && len(server.conns) >= server.MaxConnNum {
+			server.mutexConns.Unlock()
+			server.reject(sess, "too many connections")
+			continue
+		}
+		if !server.ipConns.acquire(ip) {
+			server.mutexConns.Unlock()
+			server.reject(sess, "too many connections from %s", ip)
+			continue
+		}
+		kcpConn := newKCPConn(sess, server.KCPOptions)
+		remote := sess.RemoteAddr()
+		kcpConn.onClose = func() {
+			server.mutexConns.Lock()
+			delete(server.conns, kcpConn)
+			server.mutexConns.Unlock()
+			server.ipConns.release(ip)
+			server.forget(remote)
+		}
+		server.conns[kcpConn] = struct{}{}
+		server.wgConns.Add(1)
+		server.mutexConns.Unlock()
+
+		go func() {
+			agent := server.NewAgent(kcpConn)
+			agent.Run()
+
+			// cleanup
+			kcpConn.Close()
+			agent.OnClose()
+
+			server.wgConns.Done()
+		}()
+	}
+}
+
+/**
+不再接受新的连接,已经建立的连接不受影响
+*/
+func (server *KCPServer) StopAccept() {
+	server.mutexConns.Lock()
+	server.stopAccept = true
+	server.mutexConns.Unlock()
+}
+
+func (server *KCPServer) Close() {
+	if server.ln == nil {
+		return
+	}
+	server.ln.Close()
+	server.udp.Close()
+	server.wgLn.Wait()
+
+	server.mutexConns.Lock()
+	conns := make([]*KCPConn, 0, len(server.conns))
+	for conn := range server.conns {
+		conns = append(conns, conn)
+	}
+	server.mutexConns.Unlock()
+	//onClose需要mutexConns
+	for _, conn := range conns {
+		conn.Close()
+	}
+	server.wgConns.Wait()
+}
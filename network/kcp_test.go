@@ -0,0 +1,214 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+type echoAgent struct {
+	conn Conn
+}
+
+func (a *echoAgent) Run() error {
+	_, err := io.Copy(a.conn, a.conn)
+	return err
+}
+
+func (a *echoAgent) OnClose() error {
+	return nil
+}
+
+var testKCPOptions = KCPOptions{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+
+func startKCPServer(t *testing.T, server *KCPServer, opts KCPOptions) string {
+	server.Addr = "127.0.0.1:0"
+	server.KCPOptions = opts
+	if err := server.init(); err != nil {
+		t.Fatal(err)
+	}
+	go server.run()
+	return server.udp.LocalAddr().String()
+}
+
+func TestKCPEcho(t *testing.T) {
+	verified := testKCPOptions
+	verified.VerifyAddr = true
+	for _, opts := range []KCPOptions{testKCPOptions, verified} {
+		testKCPEcho(t, opts)
+	}
+}
+
+func testKCPEcho(t *testing.T, opts KCPOptions) {
+	server := &KCPServer{
+		NewAgent: func(conn *KCPConn) Agent {
+			return &echoAgent{conn: conn}
+		},
+	}
+	addr := startKCPServer(t, server, opts)
+	defer server.Close()
+
+	conn, err := DialKCP(addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	//大于mss,需要分成多个包
+	msg := bytes.Repeat([]byte("0123456789"), 1000)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("echo mismatch")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 10))
+	if ne, ok := err.(interface{ Timeout() bool }); !ok || !ne.Timeout() {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
+func TestKCPMaxConnPerIP(t *testing.T) {
+	var agents int32
+	server := &KCPServer{
+		MaxConnPerIP: 1,
+		NewAgent: func(conn *KCPConn) Agent {
+			atomic.AddInt32(&agents, 1)
+			return &echoAgent{conn: conn}
+		},
+	}
+	addr := startKCPServer(t, server, testKCPOptions)
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := DialKCP(addr, testKCPOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		//服务端收到第一个KCP报文时才创建会话
+		conn.Write([]byte("x"))
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&agents); n != 1 {
+		t.Fatalf("%d agents created, want 1", n)
+	}
+}
+
+func TestKCPStockClient(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		var agents int32
+		server := &KCPServer{
+			NewAgent: func(conn *KCPConn) Agent {
+				atomic.AddInt32(&agents, 1)
+				return &echoAgent{conn: conn}
+			},
+		}
+		opts := testKCPOptions
+		opts.VerifyAddr = verify
+		addr := startKCPServer(t, server, opts)
+		//没有握手的kcp-go客户端只能连接没有开启VerifyAddr的服务器
+		sess, err := kcp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess.Write([]byte("x"))
+		time.Sleep(200 * time.Millisecond)
+		if n := atomic.LoadInt32(&agents); (n == 1) == verify {
+			t.Fatalf("VerifyAddr %v: %d agents created", verify, n)
+		}
+		sess.Close()
+		server.Close()
+	}
+}
+
+func TestKCPCookie(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := newKCPCookieConn(conn, 0)
+	defer server.Close()
+	delivered := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			delivered <- string(buf[:n])
+		}
+	}()
+	expect := func(want string) {
+		select {
+		case got := <-delivered:
+			if got != want {
+				t.Fatalf("delivered %q, want %q", got, want)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if want != "" {
+				t.Fatalf("%q was not delivered", want)
+			}
+		}
+	}
+
+	client, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer client.Close()
+	//未验证的地址的报文直接丢弃,过短的hello不回复
+	client.WriteTo([]byte("spoofed"), server.LocalAddr())
+	client.WriteTo(kcpPacket(kcpHello, nil, len(kcpMagic)+1), server.LocalAddr())
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := client.ReadFrom(make([]byte, 100)); err == nil {
+		t.Fatalf("short hello got a %d byte reply", n)
+	}
+	expect("")
+	//伪造的cookie不能通过验证
+	client.WriteTo(kcpPacket(kcpVerify, make([]byte, kcpCookieSize), len(kcpMagic)+1+kcpCookieSize), server.LocalAddr())
+	client.WriteTo([]byte("forged"), server.LocalAddr())
+	expect("")
+
+	if err := KCPHandshake(client, server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	client.WriteTo([]byte("verified"), server.LocalAddr())
+	expect("verified")
+
+	server.forget(client.LocalAddr())
+	client.WriteTo([]byte("forgotten"), server.LocalAddr())
+	expect("")
+
+	//验证通过的地址数有上限
+	if server.max != kcpMaxVerified {
+		t.Fatalf("default limit %d, want %d", server.max, kcpMaxVerified)
+	}
+	server.max = 1
+	if !server.verify(client.LocalAddr()) || server.verify(server.LocalAddr()) {
+		t.Fatal("verified addresses must be limited")
+	}
+}
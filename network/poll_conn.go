@@ -0,0 +1,309 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var errPollClosed = errors.New("poll conn closed")
+var errPollOverflow = errors.New("poll conn pending data overflow")
+var errPollInboundFull = errors.New("poll conn inbound data overflow")
+
+type pollAddr string
+
+func (a pollAddr) Network() string { return "http" }
+func (a pollAddr) String() string  { return string(a) }
+
+type pollChunk struct {
+	seq  uint64
+	text bool
+	data []byte
+}
+
+/**
+在HTTP长轮询/SSE上模拟的连接
+客户端POST的数据作为Read的输入,Write的数据由客户端轮询或SSE取走
+每一段数据有递增的序号,客户端确认之前一直保留,响应丢失时客户端以原来的确认号重新请求即可取回
+*/
+type PollConn struct {
+	sync.Mutex
+	token      string
+	remote     pollAddr
+	local      net.Addr
+	in         bytes.Buffer //客户端发来还没有被读取的数据
+	out        []pollChunk  //等待客户端确认的数据
+	outSize    int
+	seq        uint64 //最后写入的数据序号
+	delivered  uint64 //已经发给客户端的最大序号
+	maxPending int
+	maxInbound int    //客户端发来还没有被读取的最大字节数
+	subject    string //mTLS时已验证的客户端证书主题
+	readEvent  chan int
+	writeEvent chan int
+	die        chan struct{}
+	rd         time.Time
+	lastActive time.Time
+	closeFlag  bool
+	onClose    func()
+}
+
+func newPollConn(token string, remote string, local net.Addr, maxPending int, maxInbound int) *PollConn {
+	return &PollConn{
+		token:      token,
+		remote:     pollAddr(remote),
+		local:      local,
+		maxPending: maxPending,
+		maxInbound: maxInbound,
+		readEvent:  make(chan int, 1),
+		writeEvent: make(chan int, 1),
+		die:        make(chan struct{}),
+		lastActive: time.Now(),
+	}
+}
+
+func notify(ch chan int) {
+	select {
+	case ch <- 1:
+	default:
+	}
+}
+
+// 客户端令牌,重新请求时用于找回同一个连接
+func (c *PollConn) Token() string {
+	return c.token
+}
+
+// mTLS时已验证的客户端证书主题
+func (c *PollConn) PeerSubject() string {
+	return c.subject
+}
+
+// 客户端发来的数据,agent来不及读取时拒绝
+func (c *PollConn) push(remote string, b []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closeFlag {
+		return errPollClosed
+	}
+	if c.maxInbound > 0 && c.in.Len()+len(b) > c.maxInbound {
+		return errPollInboundFull
+	}
+	c.remote = pollAddr(remote)
+	c.lastActive = time.Now()
+	c.in.Write(b)
+	notify(c.readEvent)
+	return nil
+}
+
+// 丢弃客户端已经确认收到的数据
+func (c *PollConn) ack(seq uint64) {
+	c.Lock()
+	defer c.Unlock()
+	c.trim(seq)
+}
+
+func (c *PollConn) trim(seq uint64) {
+	n := 0
+	for n < len(c.out) && c.out[n].seq <= seq {
+		c.outSize -= len(c.out[n].data)
+		n++
+	}
+	c.out = c.out[n:]
+}
+
+// 已经发给客户端但还没有确认的最大序号
+func (c *PollConn) sent() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.delivered
+}
+
+// 数据已经写入响应
+func (c *PollConn) markSent(seq uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if seq > c.delivered {
+		c.delivered = seq
+	}
+}
+
+// 取走序号大于after的数据,没有数据时等待直到超时或者done关闭(请求结束)
+func (c *PollConn) pull(after uint64, timeout time.Duration, done <-chan struct{}) ([]pollChunk, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.Lock()
+		c.lastActive = time.Now()
+		i := 0
+		for i < len(c.out) && c.out[i].seq <= after {
+			i++
+		}
+		if i < len(c.out) {
+			out := append([]pollChunk(nil), c.out[i:]...)
+			c.Unlock()
+			return out, nil
+		}
+		if c.closeFlag {
+			c.Unlock()
+			return nil, errPollClosed
+		}
+		c.Unlock()
+		select {
+		case <-c.writeEvent:
+		case <-c.die:
+		case <-done:
+			return nil, nil
+		case <-timer.C:
+			return nil, nil
+		}
+	}
+}
+
+func (c *PollConn) idle() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	return time.Since(c.lastActive)
+}
+
+func (c *PollConn) write(text bool, b []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closeFlag {
+		return 0, errPollClosed
+	}
+	if c.maxPending > 0 && c.outSize+len(b) > c.maxPending {
+		//先丢弃已经发出但没有确认的数据,客户端大概率已经收到
+		for len(c.out) > 0 && c.out[0].seq <= c.delivered && c.outSize+len(b) > c.maxPending {
+			c.trim(c.out[0].seq)
+		}
+		if c.outSize+len(b) > c.maxPending {
+			return 0, errPollOverflow
+		}
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	c.seq++
+	c.out = append(c.out, pollChunk{seq: c.seq, text: text, data: data})
+	c.outSize += len(b)
+	notify(c.writeEvent)
+	return len(b), nil
+}
+
+func (c *PollConn) Write(b []byte) (int, error) {
+	return c.write(false, b)
+}
+
+/**
+以消息为单位写入,websocket.TextMessage(1)的消息在SSE中原样发送,其他类型以base64编码
+*/
+func (c *PollConn) WriteMessage(messageType int, p []byte) error {
+	_, err := c.write(messageType == 1, p)
+	return err
+}
+
+// goroutine not safe
+func (c *PollConn) Read(p []byte) (n int, err error) {
+	for {
+		c.Lock()
+		if c.in.Len() > 0 {
+			n, err = c.in.Read(p)
+			c.Unlock()
+			return
+		}
+		if c.closeFlag {
+			c.Unlock()
+			return 0, io.EOF
+		}
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !c.rd.IsZero() {
+			d := time.Until(c.rd)
+			if d <= 0 {
+				c.Unlock()
+				return 0, timeoutError{}
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		c.Unlock()
+
+		select {
+		case <-c.readEvent:
+		case <-c.die:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (c *PollConn) doDestroy() {
+	if c.closeFlag {
+		return
+	}
+	c.closeFlag = true
+	close(c.die)
+	if c.onClose != nil {
+		go c.onClose()
+	}
+}
+
+func (c *PollConn) Destroy() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.doDestroy()
+}
+
+func (c *PollConn) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.doDestroy()
+	return nil
+}
+
+func (c *PollConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *PollConn) RemoteAddr() net.Addr {
+	c.Lock()
+	defer c.Unlock()
+	return c.remote
+}
+
+// A zero value for t means I/O operations will not time out.
+func (c *PollConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *PollConn) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	c.rd = t
+	return nil
+}
+
+// 写入不会阻塞,忽略写超时
+func (c *PollConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
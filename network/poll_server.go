@@ -0,0 +1,422 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonlau/mqant/v2/log"
+)
+
+// 携带令牌的cookie,便于负载均衡按令牌保持会话
+const PollTokenCookie = "mqant_poll"
+
+/**
+HTTP长轮询/SSE服务器,用于无法使用websocket的网络环境
+	POST {Path}/connect  建立连接,返回令牌
+	POST {Path}/send     发送数据,请求体即为数据
+	GET  {Path}/poll     长轮询,取走等待发送的数据,超时返回204
+	GET  {Path}/sse      以Server-Sent Events持续接收数据
+	POST {Path}/close    关闭连接
+令牌可以放在 X-Poll-Token 请求头或 mqant_poll cookie 中,不接受URL参数,避免令牌出现在访问日志中
+poll的响应头 X-Poll-Seq 为最后一段数据的序号,下一次poll通过 X-Poll-Ack 请求头确认,
+没有确认的数据在下一次poll时重发;sse的每个事件带有id,断线重连时浏览器通过 Last-Event-ID 确认
+*/
+type PollServer struct {
+	Addr           string
+	Path           string
+	Tls            bool //是否支持tls
+	CertFile       string
+	KeyFile        string
+	MaxConnNum     int
+	MaxConnPerIP   int //每个IP最多同时建立的连接数,0表示不限制
+	MaxBodySize    int64
+	MaxHeaderBytes int           //请求头的最大字节数,令牌和cookie都在请求头中
+	MaxPending     int           //每个连接等待客户端取走的最大字节数
+	MaxInbound     int           //每个连接客户端发来还没有被读取的最大字节数,超过时send返回429
+	PollTimeout    time.Duration //长轮询最长等待时间
+	IdleTimeout    time.Duration //超过这个时间没有任何请求则关闭连接
+	NewAgent       func(*PollConn) Agent
+	//客户端证书的CA,不为空时开启mTLS
+	ClientCAFile      string
+	RequireClientCert bool
+	//可信代理(IP或CIDR),来自这些地址的请求使用X-Forwarded-For中的客户端地址
+	TrustedProxies []string
+	trusted        *trustedProxies
+	ln             net.Listener
+	server         *http.Server
+	certs          io.Closer
+	conns          map[string]*PollConn
+	ipConns        *ipConnLimiter
+	mutexConns     sync.Mutex
+	wg             sync.WaitGroup
+	die            chan struct{}
+	stopAccept     bool
+}
+
+func (server *PollServer) Start() {
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Warnf("%v", err)
+		return
+	}
+	server.init()
+	server.ln = ln
+	server.server = &http.Server{
+		Addr:           server.Addr,
+		Handler:        server,
+		MaxHeaderBytes: server.MaxHeaderBytes,
+	}
+	if server.Tls {
+		server.server.TLSConfig, server.certs, err = NewTLSConfig(server.CertFile, server.KeyFile, server.ClientCAFile, server.RequireClientCert)
+		if err != nil {
+			log.Warnf("poll_server tls :%v", err)
+		}
+	}
+	log.Infof("Poll Listen :%s", server.Addr)
+	go func() {
+		if server.Tls {
+			//证书由TLSConfig.GetCertificate提供
+			err = server.server.ServeTLS(ln, "", "")
+		} else {
+			err = server.server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Warnf("poll server: %v", err)
+		}
+	}()
+}
+
+func (server *PollServer) init() {
+	if server.Path == "" {
+		server.Path = "/poll"
+	}
+	server.Path = strings.TrimRight(server.Path, "/")
+	if server.MaxBodySize <= 0 {
+		server.MaxBodySize = 64 * 1024
+	}
+	if server.MaxHeaderBytes <= 0 {
+		server.MaxHeaderBytes = 1 << 16
+	}
+	if server.MaxPending <= 0 {
+		server.MaxPending = 1 << 20
+	}
+	if server.MaxInbound <= 0 {
+		server.MaxInbound = 1 << 20
+	}
+	if server.PollTimeout <= 0 {
+		server.PollTimeout = 30 * time.Second
+	}
+	if server.IdleTimeout <= 0 {
+		server.IdleTimeout = 2 * server.PollTimeout
+	}
+	if server.NewAgent == nil {
+		log.Warnf("NewAgent must not be nil")
+	}
+	server.conns = map[string]*PollConn{}
+	server.ipConns = newIPConnLimiter(server.MaxConnPerIP)
+	server.trusted = newTrustedProxies(server.TrustedProxies)
+	server.die = make(chan struct{})
+	go server.sweep()
+}
+
+// 关闭长时间没有请求的连接
+func (server *PollServer) sweep() {
+	ticker := time.NewTicker(server.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.die:
+			return
+		case <-ticker.C:
+			var idle []*PollConn
+			server.mutexConns.Lock()
+			for _, conn := range server.conns {
+				if conn.idle() > server.IdleTimeout {
+					idle = append(idle, conn)
+				}
+			}
+			server.mutexConns.Unlock()
+			for _, conn := range idle {
+				conn.Close()
+			}
+		}
+	}
+}
+
+func newPollToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func pollToken(r *http.Request) string {
+	if token := r.Header.Get("X-Poll-Token"); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(PollTokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+/**
+客户端地址,直接连接的是可信代理时使用X-Forwarded-For中的地址
+*/
+func (server *PollServer) remoteAddr(r *http.Request) string {
+	if forwarded := forwardedFor(r.RemoteAddr, r.Header.Get("X-Forwarded-For"), server.trusted); forwarded != "" {
+		return forwarded
+	}
+	return r.RemoteAddr
+}
+
+func (server *PollServer) getConn(r *http.Request) *PollConn {
+	server.mutexConns.Lock()
+	defer server.mutexConns.Unlock()
+	return server.conns[pollToken(r)]
+}
+
+func (server *PollServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, server.Path+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	action := strings.TrimPrefix(r.URL.Path, server.Path+"/")
+	switch action {
+	case "connect":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		server.connect(w, r)
+		return
+	}
+	conn := server.getConn(r)
+	if conn == nil {
+		http.Error(w, "Unknown token", http.StatusGone)
+		return
+	}
+	switch action {
+	case "send":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, server.MaxBodySize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := conn.push(server.remoteAddr(r), b); err != nil {
+			if err == errPollInboundFull {
+				//客户端需要稍后重发
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "poll":
+		//没有确认号的客户端视为已经收到上一次响应中的数据
+		after := conn.sent()
+		if ack := r.Header.Get("X-Poll-Ack"); ack != "" {
+			seq, err := strconv.ParseUint(ack, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid X-Poll-Ack", http.StatusBadRequest)
+				return
+			}
+			after = seq
+		}
+		conn.ack(after)
+		chunks, err := conn.pull(after, server.PollTimeout, r.Context().Done())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		if len(chunks) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Poll-Seq", strconv.FormatUint(chunks[len(chunks)-1].seq, 10))
+		for _, chunk := range chunks {
+			if _, err := w.Write(chunk.data); err != nil {
+				return
+			}
+			if chunk.text {
+				//文本消息以换行分隔
+				w.Write([]byte{'\n'})
+			}
+		}
+		conn.markSent(chunks[len(chunks)-1].seq)
+	case "sse":
+		server.sse(w, r, conn)
+	case "close":
+		conn.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (server *PollServer) connect(w http.ResponseWriter, r *http.Request) {
+	server.mutexConns.Lock()
+	if server.stopAccept {
+		server.mutexConns.Unlock()
+		http.Error(w, "server is draining", http.StatusServiceUnavailable)
+		return
+	}
+	if server.MaxConnNum > 0 && len(server.conns) >= server.MaxConnNum {
+		server.mutexConns.Unlock()
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		log.Warnf("too many connections")
+		return
+	}
+	remote := server.remoteAddr(r)
+	ip := hostOf(remote)
+	if !server.ipConns.acquire(ip) {
+		server.mutexConns.Unlock()
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		log.Warnf("too many connections from %s", ip)
+		return
+	}
+	token := newPollToken()
+	conn := newPollConn(token, remote, pollAddr(server.Addr), server.MaxPending, server.MaxInbound)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.PeerCertificates) > 0 {
+		conn.subject = r.TLS.PeerCertificates[0].Subject.String()
+	}
+	conn.onClose = func() {
+		server.mutexConns.Lock()
+		delete(server.conns, token)
+		server.mutexConns.Unlock()
+		server.ipConns.release(ip)
+	}
+	server.conns[token] = conn
+	server.wg.Add(1)
+	server.mutexConns.Unlock()
+
+	agent := server.NewAgent(conn)
+	go func() {
+		agent.Run()
+
+		// cleanup
+		conn.Close()
+		agent.OnClose()
+
+		server.wg.Done()
+	}()
+
+	http.SetCookie(w, &http.Cookie{Name: PollTokenCookie, Value: token, Path: server.Path, HttpOnly: true, Secure: server.Tls})
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"token":"%s"}`, token)
+}
+
+/**
+文本消息作为data发送,二进制消息以base64编码并标记为binary事件
+*/
+func (server *PollServer) sse(w http.ResponseWriter, r *http.Request, conn *PollConn) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	after := conn.sent()
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		seq, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		after = seq
+	}
+	conn.ack(after)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		chunks, err := conn.pull(after, server.PollTimeout, r.Context().Done())
+		if err != nil {
+			fmt.Fprint(w, "event: close\ndata: \n\n")
+			flusher.Flush()
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			//客户端已经断开,数据留给重连以后的请求
+			return
+		default:
+		}
+		if len(chunks) == 0 {
+			//保持连接
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		for _, chunk := range chunks {
+			if chunk.text {
+				_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", chunk.seq, strings.Replace(string(chunk.data), "\n", "\ndata: ", -1))
+			} else {
+				_, err = fmt.Fprintf(w, "id: %d\nevent: binary\ndata: %s\n\n", chunk.seq, base64.StdEncoding.EncodeToString(chunk.data))
+			}
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		if len(chunks) > 0 {
+			after = chunks[len(chunks)-1].seq
+			conn.markSent(after)
+		}
+	}
+}
+
+/**
+不再接受新的连接,已经建立的连接仍然可以轮询
+*/
+func (server *PollServer) StopAccept() {
+	server.mutexConns.Lock()
+	server.stopAccept = true
+	server.mutexConns.Unlock()
+}
+
+func (server *PollServer) Close() {
+	if server.server == nil {
+		return
+	}
+	close(server.die)
+	server.server.Close()
+
+	server.mutexConns.Lock()
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.mutexConns.Unlock()
+	server.wg.Wait()
+	if server.certs != nil {
+		server.certs.Close()
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pollDo(t *testing.T, method string, url string, token string, body string, header map[string]string) *http.Response {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("X-Poll-Token", token)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func pollConnect(t *testing.T, url string) string {
+	resp, err := http.Post(url+"/poll/connect", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var ret struct{ Token string }
+	json.NewDecoder(resp.Body).Decode(&ret)
+	if ret.Token == "" {
+		t.Fatalf("connect status %d", resp.StatusCode)
+	}
+	return ret.Token
+}
+
+func TestPollEcho(t *testing.T) {
+	server := &PollServer{
+		PollTimeout: time.Second,
+		NewAgent: func(conn *PollConn) Agent {
+			return &echoAgent{conn: conn}
+		},
+	}
+	server.init()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer close(server.die)
+
+	token := pollConnect(t, ts.URL)
+	resp := pollDo(t, "POST", ts.URL+"/poll/send?token="+token, "", "hello", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("token in the query string should be ignored, status %d", resp.StatusCode)
+	}
+	resp = pollDo(t, "POST", ts.URL+"/poll/send", token, "hello", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("send status %d", resp.StatusCode)
+	}
+
+	resp = pollDo(t, "GET", ts.URL+"/poll/poll", token, "", nil)
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "hello" {
+		t.Fatalf("poll got %q", b)
+	}
+
+	pollDo(t, "POST", ts.URL+"/poll/close", token, "", nil).Body.Close()
+	resp = pollDo(t, "GET", ts.URL+"/poll/poll", token, "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("poll after close status %d", resp.StatusCode)
+	}
+}
+
+func TestPollLargeHeaders(t *testing.T) {
+	server := &PollServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *PollConn) Agent {
+			return &echoAgent{conn: conn}
+		},
+	}
+	server.Start()
+	defer server.Close()
+	//鉴权代理和浏览器的cookie可能有几KB
+	req, _ := http.NewRequest("POST", "http://"+server.ln.Addr().String()+"/poll/connect", nil)
+	req.Header.Set("Cookie", "session="+strings.Repeat("x", 8192))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect with large headers status %d", resp.StatusCode)
+	}
+}
+
+func TestPollAck(t *testing.T) {
+	server := &PollServer{
+		PollTimeout: 100 * time.Millisecond,
+		NewAgent: func(conn *PollConn) Agent {
+			return &echoAgent{conn: conn}
+		},
+	}
+	server.init()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer close(server.die)
+	token := pollConnect(t, ts.URL)
+	pollDo(t, "POST", ts.URL+"/poll/send", token, "hello", nil).Body.Close()
+
+	poll := func(ack string) (string, string) {
+		resp := pollDo(t, "GET", ts.URL+"/poll/poll", token, "", map[string]string{"X-Poll-Ack": ack})
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b), resp.Header.Get("X-Poll-Seq")
+	}
+	data, seq := poll("0")
+	if data != "hello" || seq == "" {
+		t.Fatalf("poll = %q seq %q", data, seq)
+	}
+	//响应丢失,以原来的确认号重新请求
+	if again, _ := poll("0"); again != "hello" {
+		t.Fatalf("unacked data should be resent, got %q", again)
+	}
+	if rest, _ := poll(seq); rest != "" {
+		t.Fatalf("acked data should not be resent, got %q", rest)
+	}
+
+	//SSE断线重连时通过Last-Event-ID取回没有收到的数据,二进制数据以base64编码("world")
+	pollDo(t, "POST", ts.URL+"/poll/send", token, "world", nil).Body.Close()
+	resp := pollDo(t, "GET", ts.URL+"/poll/sse", token, "", map[string]string{"Last-Event-ID": seq})
+	event := make([]byte, 64)
+	n, _ := resp.Body.Read(event)
+	resp.Body.Close()
+	if !strings.Contains(string(event[:n]), "data: d29ybGQ=") {
+		t.Fatalf("sse event %q", event[:n])
+	}
+	resp = pollDo(t, "GET", ts.URL+"/poll/sse", token, "", map[string]string{"Last-Event-ID": seq})
+	n, _ = resp.Body.Read(event)
+	resp.Body.Close()
+	if !strings.Contains(string(event[:n]), "data: d29ybGQ=") {
+		t.Fatalf("unacked sse event should be resent, got %q", event[:n])
+	}
+}
+
+func TestPollMaxConnPerIP(t *testing.T) {
+	server := &PollServer{
+		MaxConnPerIP: 1,
+		NewAgent: func(conn *PollConn) Agent {
+			return &echoAgent{conn: conn}
+		},
+	}
+	server.init()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer close(server.die)
+	token := pollConnect(t, ts.URL)
+	resp, err := http.Post(ts.URL+"/poll/connect", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("second connect status %d", resp.StatusCode)
+	}
+	//关闭以后释放名额
+	pollDo(t, "POST", ts.URL+"/poll/close", token, "", nil).Body.Close()
+	time.Sleep(50 * time.Millisecond)
+	pollConnect(t, ts.URL)
+}
+
+type blockedAgent struct {
+	done chan struct{}
+}
+
+func (a *blockedAgent) Run() error {
+	<-a.done
+	return nil
+}
+
+func (a *blockedAgent) OnClose() error {
+	return nil
+}
+
+func TestPollMaxInbound(t *testing.T) {
+	agent := &blockedAgent{done: make(chan struct{})}
+	server := &PollServer{
+		MaxInbound: 8,
+		NewAgent: func(conn *PollConn) Agent {
+			return agent
+		},
+	}
+	server.init()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer close(server.die)
+	defer close(agent.done)
+	token := pollConnect(t, ts.URL)
+	//agent不读取时客户端发来的数据不能无限堆积
+	for _, want := range []int{http.StatusNoContent, http.StatusTooManyRequests} {
+		resp := pollDo(t, "POST", ts.URL+"/poll/send", token, "12345", nil)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("send status %d, want %d", resp.StatusCode, want)
+		}
+	}
+}
+
+func TestPollForwardedFor(t *testing.T) {
+	conns := make(chan *PollConn, 2)
+	server := &PollServer{
+		Tls:            true,
+		MaxConnPerIP:   1,
+		TrustedProxies: []string{"127.0.0.1"},
+		NewAgent: func(conn *PollConn) Agent {
+			conns <- conn
+			return &echoAgent{conn: conn}
+		},
+	}
+	server.init()
+	//tls由前面的代理终止,这里只检查cookie的属性
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer close(server.die)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		resp := pollDo(t, "POST", ts.URL+"/poll/connect", "", "", map[string]string{"X-Forwarded-For": ip})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("connect from %s status %d", ip, resp.StatusCode)
+		}
+		if cookies := resp.Cookies(); len(cookies) != 1 || !cookies[0].Secure {
+			t.Fatalf("token cookie should be Secure, got %v", cookies)
+		}
+		if remote := (<-conns).RemoteAddr().String(); remote != ip {
+			t.Fatalf("RemoteAddr %s, want %s", remote, ip)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonlau/mqant/v2/log"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+/**
+可信代理列表,支持单个IP和CIDR
+*/
+type trustedProxies struct {
+	nets []*net.IPNet
+}
+
+func newTrustedProxies(proxies []string) *trustedProxies {
+	t := &trustedProxies{}
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			log.Warnf("invalid trusted proxy %s: %v", p, err)
+			continue
+		}
+		t.nets = append(t.nets, n)
+	}
+	return t
+}
+
+func (t *trustedProxies) empty() bool {
+	return t == nil || len(t.nets) == 0
+}
+
+func (t *trustedProxies) contains(ip string) bool {
+	if t == nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range t.nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+解析PROXY protocol头的listener
+只解析来自可信代理的连接,其他连接原样返回,trusted为空时不解析任何PROXY头
+*/
+type proxyListener struct {
+	net.Listener
+	trusted *trustedProxies
+	timeout time.Duration
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted.contains(hostOf(conn.RemoteAddr().String())) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+/**
+第一次读取或者获取RemoteAddr时才读取PROXY头,不阻塞Accept
+*/
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	once    sync.Once
+	timeout time.Duration
+	remote  net.Addr
+	err     error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.remote, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			log.Warnf("proxy protocol from %s: %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+/**
+读取PROXY protocol v1或v2的头,返回客户端的真实地址
+LOCAL命令(例如负载均衡的健康检查)和UNKNOWN协议返回nil
+*/
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		return readProxyV1(r)
+	case proxyV2Signature[0]:
+		return readProxyV2(r)
+	default:
+		return nil, fmt.Errorf("missing proxy protocol header")
+	}
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	//v1的头最长107字节
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid proxy protocol v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, fmt.Errorf("invalid proxy protocol v2 header")
+	}
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0F {
+	case 0x0: //LOCAL
+		return nil, nil
+	case 0x1: //PROXY
+	default:
+		return nil, fmt.Errorf("invalid proxy protocol v2 command")
+	}
+	switch header[13] >> 4 {
+	case 0x1: //AF_INET
+		if length < 12 {
+			return nil, fmt.Errorf("invalid proxy protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: //AF_INET6
+		if length < 36 {
+			return nil, fmt.Errorf("invalid proxy protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		//AF_UNSPEC 和 AF_UNIX 没有可用的IP
+		return nil, nil
+	}
+}
+
+/**
+从X-Forwarded-For中取出客户端地址,只有直接连接的是可信代理时才使用
+从右向左跳过可信代理,第一个不可信的地址就是客户端
+*/
+func forwardedFor(remoteAddr string, xff string, trusted *trustedProxies) string {
+	if xff == "" || !trusted.contains(hostOf(remoteAddr)) {
+		return ""
+	}
+	ips := strings.Split(xff, ",")
+	client := ""
+	for i := len(ips) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(ips[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		client = ip
+		if !trusted.contains(ip) {
+			break
+		}
+	}
+	return client
+}
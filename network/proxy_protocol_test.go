@@ -0,0 +1,116 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestProxyProtocolV1(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nhello"))
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "192.168.0.1:56324" {
+		t.Fatalf("got %s", addr)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "hello" {
+		t.Fatalf("payload after header got %q", rest)
+	}
+
+	addr, err = readProxyHeader(bufio.NewReader(bytes.NewBufferString("PROXY UNKNOWN\r\n")))
+	if err != nil || addr != nil {
+		t.Fatalf("UNKNOWN got %v %v", addr, err)
+	}
+	if _, err := readProxyHeader(bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n"))); err == nil {
+		t.Fatal("missing header should fail")
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.Write([]byte{0x21, 0x11})
+	binary.Write(&buf, binary.BigEndian, uint16(12))
+	buf.Write(net.ParseIP("10.1.2.3").To4())
+	buf.Write(net.ParseIP("10.0.0.1").To4())
+	binary.Write(&buf, binary.BigEndian, uint16(4000))
+	binary.Write(&buf, binary.BigEndian, uint16(3563))
+	buf.WriteString("hello")
+	r := bufio.NewReader(&buf)
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "10.1.2.3:4000" {
+		t.Fatalf("got %s", addr)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "hello" {
+		t.Fatalf("payload after header got %q", rest)
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	trusted := newTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if ip := forwardedFor("10.0.0.5:1234", "1.2.3.4, 192.168.1.1", trusted); ip != "1.2.3.4" {
+		t.Fatalf("got %s", ip)
+	}
+	if ip := forwardedFor("10.0.0.5:1234", "6.6.6.6, 1.2.3.4", trusted); ip != "1.2.3.4" {
+		t.Fatalf("spoofed entries must be ignored, got %s", ip)
+	}
+	if ip := forwardedFor("8.8.8.8:1234", "1.2.3.4", trusted); ip != "" {
+		t.Fatalf("untrusted peer must be ignored, got %s", ip)
+	}
+}
+
+func TestProxyListenerTrusted(t *testing.T) {
+	remote := func(trusted []string) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		pl := &proxyListener{Listener: ln, trusted: newTrustedProxies(trusted)}
+		go func() {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err == nil {
+				conn.Write([]byte("PROXY TCP4 1.2.3.4 127.0.0.1 5000 80\r\n"))
+				defer conn.Close()
+			}
+		}()
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return hostOf(conn.RemoteAddr().String())
+	}
+	if ip := remote([]string{"127.0.0.1"}); ip != "1.2.3.4" {
+		t.Fatalf("trusted proxy header got %s", ip)
+	}
+	if ip := remote([]string{"10.0.0.0/8"}); ip != "127.0.0.1" {
+		t.Fatalf("untrusted peer must keep its address, got %s", ip)
+	}
+	if ip := remote(nil); ip != "127.0.0.1" {
+		t.Fatalf("empty trusted list must not trust anyone, got %s", ip)
+	}
+}
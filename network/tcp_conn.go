@@ -41,7 +41,9 @@ func newTCPConn(conn net.Conn) *TCPConn {
 }
 
 func (tcpConn *TCPConn) doDestroy() {
-	tcpConn.conn.(*net.TCPConn).SetLinger(0)
+	if conn, ok := tcpConn.conn.(*net.TCPConn); ok {
+		conn.SetLinger(0)
+	}
 	tcpConn.conn.Close()
 
 	if !tcpConn.closeFlag {
@@ -82,6 +84,11 @@ func (tcpConn *TCPConn) Read(b []byte) (int, error) {
 	return tcpConn.conn.Read(b)
 }
 
+//mTLS时已验证的客户端证书主题
+func (tcpConn *TCPConn) PeerSubject() string {
+	return peerSubject(tcpConn.conn)
+}
+
 func (tcpConn *TCPConn) LocalAddr() net.Addr {
 	return tcpConn.conn.LocalAddr()
 }
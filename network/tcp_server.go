@@ -15,6 +15,7 @@ package network
 
 import (
 	"crypto/tls"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -23,16 +24,26 @@ import (
 )
 
 type TCPServer struct {
-	Addr       string
-	Tls        bool //是否支持tls
-	CertFile   string
-	KeyFile    string
-	MaxConnNum int
-	NewAgent   func(*TCPConn) Agent
-	ln         net.Listener
-	mutexConns sync.Mutex
-	wgLn       sync.WaitGroup
-	wgConns    sync.WaitGroup
+	Addr         string
+	Tls          bool //是否支持tls
+	CertFile     string
+	KeyFile      string
+	MaxConnNum   int
+	MaxConnPerIP int //每个IP最多同时建立的连接数,0表示不限制
+	NewAgent     func(*TCPConn) Agent
+	//客户端证书的CA,不为空时开启mTLS
+	ClientCAFile      string
+	RequireClientCert bool
+	//在负载均衡之后时解析PROXY protocol(v1/v2)头获取客户端真实地址
+	ProxyProtocol bool
+	//只解析来自这些地址(IP或CIDR)的PROXY头,为空时不开启ProxyProtocol
+	TrustedProxies []string
+	ln             net.Listener
+	certs          io.Closer
+	ipConns        *ipConnLimiter
+	mutexConns     sync.Mutex
+	wgLn           sync.WaitGroup
+	wgConns        sync.WaitGroup
 }
 
 func (server *TCPServer) Start() {
@@ -50,11 +61,24 @@ func (server *TCPServer) init() {
 	if server.NewAgent == nil {
 		log.Warnf("NewAgent must not be nil")
 	}
+	if server.ProxyProtocol && ln != nil {
+		trusted := newTrustedProxies(server.TrustedProxies)
+		if trusted.empty() {
+			//任何人都可以伪造PROXY头
+			log.Warnf("ProxyProtocol disabled: TrustedProxies is empty")
+		} else {
+			//PROXY头在TLS握手之前
+			ln = &proxyListener{
+				Listener: ln,
+				trusted:  trusted,
+				timeout:  5 * time.Second,
+			}
+		}
+	}
 	if server.Tls {
-		tlsConf := new(tls.Config)
-		tlsConf.Certificates = make([]tls.Certificate, 1)
-		tlsConf.Certificates[0], err = tls.LoadX509KeyPair(server.CertFile, server.KeyFile)
+		tlsConf, certs, err := NewTLSConfig(server.CertFile, server.KeyFile, server.ClientCAFile, server.RequireClientCert)
 		if err == nil {
+			server.certs = certs
 			ln = tls.NewListener(ln, tlsConf)
 			log.Info("TCP Listen TLS load success")
 		} else {
@@ -63,6 +87,7 @@ func (server *TCPServer) init() {
 	}
 
 	server.ln = ln
+	server.ipConns = newIPConnLimiter(server.MaxConnPerIP)
 }
 func (server *TCPServer) run() {
 	server.wgLn.Add(1)
@@ -88,23 +113,42 @@ func (server *TCPServer) run() {
 			return
 		}
 		tempDelay = 0
-		tcpConn := newTCPConn(conn)
-		agent := server.NewAgent(tcpConn)
+		server.wgConns.Add(1)
 		go func() {
-			server.wgConns.Add(1)
+			defer server.wgConns.Done()
+			//使用PROXY protocol时获取地址需要读取PROXY头,不能在Accept的协程中进行
+			ip := hostOf(conn.RemoteAddr().String())
+			if !server.ipConns.acquire(ip) {
+				conn.Close()
+				log.Warnf("too many connections from %s", ip)
+				return
+			}
+			tcpConn := newTCPConn(conn)
+			agent := server.NewAgent(tcpConn)
 			agent.Run()
 
 			// cleanup
 			tcpConn.Close()
 			agent.OnClose()
-
-			server.wgConns.Done()
+			server.ipConns.release(ip)
 		}()
 	}
 }
 
+/**
+关闭监听,不再接受新的连接,已经建立的连接不受影响
+*/
+func (server *TCPServer) StopAccept() {
+	if server.ln != nil {
+		server.ln.Close()
+	}
+}
+
 func (server *TCPServer) Close() {
 	server.ln.Close()
 	server.wgLn.Wait()
 	server.wgConns.Wait()
+	if server.certs != nil {
+		server.certs.Close()
+	}
 }
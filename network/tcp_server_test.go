@@ -0,0 +1,69 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type tcpEchoAgent struct {
+	conn *TCPConn
+}
+
+func (a *tcpEchoAgent) Run() error {
+	buf := make([]byte, 1024)
+	for {
+		n, err := a.conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		a.conn.Write(buf[:n])
+	}
+}
+
+func (a *tcpEchoAgent) OnClose() error {
+	return nil
+}
+
+func TestTCPStopAccept(t *testing.T) {
+	server := &TCPServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *TCPConn) Agent {
+			return &tcpEchoAgent{conn: conn}
+		},
+	}
+	server.Start()
+	addr := server.ln.Addr().String()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.StopAccept()
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Fatal("new connections must be refused after StopAccept")
+	}
+	//已经建立的连接不受影响
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo got %q %v", buf, err)
+	}
+	conn.Close()
+	server.Close()
+}
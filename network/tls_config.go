@@ -0,0 +1,195 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/leonlau/mqant/v2/log"
+)
+
+//检查证书文件是否修改的最小间隔
+const certCheckInterval = 10 * time.Second
+
+/**
+证书热更新,证书文件修改后或者进程收到SIGHUP时重新加载
+已经建立的连接不受影响,新的连接使用新的证书,不再使用时需要Close
+*/
+type certReloader struct {
+	certFile  string
+	keyFile   string
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+	sighup    chan os.Signal
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		sighup:   make(chan os.Signal, 1),
+		done:     make(chan struct{}),
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	signal.Notify(r.sighup, syscall.SIGHUP)
+	go r.watch()
+	return r, nil
+}
+
+func (r *certReloader) watch() {
+	for {
+		select {
+		case <-r.sighup:
+			if err := r.reload(); err != nil {
+				log.Warnf("reload certificate %s: %v", r.certFile, err)
+			} else {
+				log.Infof("certificate %s reloaded", r.certFile)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+/**
+停止监听SIGHUP
+*/
+func (r *certReloader) Close() error {
+	r.closeOnce.Do(func() {
+		signal.Stop(r.sighup)
+		close(r.done)
+	})
+	return nil
+}
+
+func (r *certReloader) fileModTime() time.Time {
+	var modTime time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime
+}
+
+func (r *certReloader) reload() error {
+	modTime := r.fileModTime()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	cert, modTime, lastCheck := r.cert, r.modTime, r.lastCheck
+	r.lock.RUnlock()
+	if time.Since(lastCheck) < certCheckInterval {
+		return cert, nil
+	}
+	r.lock.Lock()
+	r.lastCheck = time.Now()
+	r.lock.Unlock()
+	if r.fileModTime().After(modTime) {
+		if err := r.reload(); err != nil {
+			//证书文件可能正在写入,继续使用旧的证书
+			log.Warnf("reload certificate %s: %v", r.certFile, err)
+		} else {
+			log.Infof("certificate %s reloaded", r.certFile)
+			r.lock.RLock()
+			cert = r.cert
+			r.lock.RUnlock()
+		}
+	}
+	return cert, nil
+}
+
+/**
+创建服务端的tls配置,证书支持热更新,关闭监听时需要Close返回的io.Closer
+clientCAFile不为空时校验客户端证书(mTLS),requireClientCert为true时客户端必须提供证书
+*/
+func NewTLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, io.Closer, error) {
+	if requireClientCert && clientCAFile == "" {
+		return nil, nil, fmt.Errorf("RequireClientCert requires ClientCAFile")
+	}
+	tlsConf := &tls.Config{}
+	if clientCAFile != "" {
+		b, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		tlsConf.ClientCAs = pool
+		if requireClientCert {
+			tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConf.GetCertificate = r.GetCertificate
+	return tlsConf, r, nil
+}
+
+/**
+取得tls连接中已验证的客户端证书主题,不是tls连接或者客户端没有提供证书时返回空
+*/
+func peerSubject(conn interface{}) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete {
+		//tls握手在第一次读写时才进行
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		err := tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			return ""
+		}
+		state = tlsConn.ConnectionState()
+	}
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.String()
+}
@@ -0,0 +1,138 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//生成证书,parent为nil时自签名
+func writeTestCert(t *testing.T, dir, name, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestCertReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mqant-tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, dir, "server", "first", nil, nil)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	leaf := func() string {
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ := x509.ParseCertificate(cert.Certificate[0])
+		return c.Subject.CommonName
+	}
+	if cn := leaf(); cn != "first" {
+		t.Fatalf("got %s", cn)
+	}
+	writeTestCert(t, dir, "server", "second", nil, nil)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if cn := leaf(); cn != "first" {
+		t.Fatalf("files must not be checked within certCheckInterval, got %s", cn)
+	}
+	r.lock.Lock()
+	r.lastCheck = time.Time{}
+	r.lock.Unlock()
+	if cn := leaf(); cn != "second" {
+		t.Fatalf("reload got %s", cn)
+	}
+	r.Close()
+	r.Close()
+	select {
+	case <-r.done:
+	default:
+		t.Fatal("Close must stop watching SIGHUP")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mqant-tls")
+	defer os.RemoveAll(dir)
+	ca, caKey := writeTestCert(t, dir, "ca", "test ca", nil, nil)
+	writeTestCert(t, dir, "server", "localhost", ca, caKey)
+	writeTestCert(t, dir, "client", "player-1", ca, caKey)
+	if _, _, err := NewTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), "", true); err == nil {
+		t.Fatal("RequireClientCert without ClientCAFile must fail")
+	}
+	conf, certs, err := NewTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer certs.Close()
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	c1, c2 := net.Pipe()
+	go func() {
+		client := tls.Client(c2, &tls.Config{ServerName: "localhost", RootCAs: roots, Certificates: []tls.Certificate{clientCert}})
+		client.Handshake()
+		client.Close()
+	}()
+	subject := newTCPConn(tls.Server(c1, conf)).PeerSubject()
+	if subject != "CN=player-1" {
+		t.Fatalf("subject got %q", subject)
+	}
+}
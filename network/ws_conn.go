@@ -31,9 +31,16 @@ type WSConn struct {
 	sync.Mutex
 	buf_lock  chan error //当有写入一次数据设置一次
 	buffer    bytes.Buffer
+	buf_mu    sync.Mutex //保护buffer
 	conn      *websocket.Conn
 	readfirst bool
 	closeFlag bool
+	//小于这个字节数的消息不压缩,只在协商了permessage-deflate时有效
+	compressThreshold int
+	//经过可信代理时客户端的真实地址
+	remoteAddr net.Addr
+	//WSServer.BeforeUpgrade返回的身份信息
+	identity interface{}
 }
 
 func newWSConn(conn *websocket.Conn) *WSConn {
@@ -49,7 +56,9 @@ func newWSConn(conn *websocket.Conn) *WSConn {
 				wsConn.buf_lock <- err
 				break
 			} else {
+				wsConn.buf_mu.Lock()
 				wsConn.buffer.Write(b)
+				wsConn.buf_mu.Unlock()
 				wsConn.readfirst = true
 				wsConn.buf_lock <- nil
 			}
@@ -90,29 +99,55 @@ func (wsConn *WSConn) Close() error {
 }
 
 func (wsConn *WSConn) Write(p []byte) (int, error) {
-	err := wsConn.conn.WriteMessage(websocket.BinaryMessage, p)
+	err := wsConn.WriteMessage(websocket.BinaryMessage, p)
 	if err != nil {
 		return 0, err
 	}
 	return len(p), nil
 }
 
+/**
+以websocket消息为单位写入,messageType为websocket.TextMessage或websocket.BinaryMessage
+*/
+func (wsConn *WSConn) WriteMessage(messageType int, p []byte) error {
+	if wsConn.compressThreshold > 0 {
+		wsConn.conn.EnableWriteCompression(len(p) >= wsConn.compressThreshold)
+	}
+	return wsConn.conn.WriteMessage(messageType, p)
+}
+
 // goroutine not safe
 func (wsConn *WSConn) Read(p []byte) (n int, err error) {
-	err = <-wsConn.buf_lock //等待写入数据
-	if err != nil {
-		//读取数据出现异常了
-		return
-	}
-	if wsConn.buffer.Len() == 0 {
-		//再等一次
+	for {
+		wsConn.buf_mu.Lock()
+		if wsConn.buffer.Len() > 0 {
+			//上一条消息还没有读完
+			n, err = wsConn.buffer.Read(p)
+			wsConn.buf_mu.Unlock()
+			return
+		}
+		wsConn.buf_mu.Unlock()
 		err = <-wsConn.buf_lock //等待写入数据
 		if err != nil {
 			//读取数据出现异常了
 			return
 		}
 	}
-	return wsConn.buffer.Read(p)
+}
+
+//协商的websocket子协议,没有协商时为空
+func (wsConn *WSConn) Subprotocol() string {
+	return wsConn.conn.Subprotocol()
+}
+
+//WSServer.BeforeUpgrade返回的身份信息
+func (wsConn *WSConn) Identity() interface{} {
+	return wsConn.identity
+}
+
+//mTLS时已验证的客户端证书主题
+func (wsConn *WSConn) PeerSubject() string {
+	return peerSubject(wsConn.conn.UnderlyingConn())
 }
 
 func (wsConn *WSConn) LocalAddr() net.Addr {
@@ -120,6 +155,9 @@ func (wsConn *WSConn) LocalAddr() net.Addr {
 }
 
 func (wsConn *WSConn) RemoteAddr() net.Addr {
+	if wsConn.remoteAddr != nil {
+		return wsConn.remoteAddr
+	}
 	return wsConn.conn.RemoteAddr()
 }
 
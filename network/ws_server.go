@@ -15,8 +15,11 @@ package network
 
 import (
 	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,25 +28,49 @@ import (
 )
 
 type WSServer struct {
-	Addr        string
-	Tls         bool //是否支持tls
-	CertFile    string
-	KeyFile     string
-	MaxConnNum  int
-	MaxMsgLen   uint32
-	HTTPTimeout time.Duration
-	NewAgent    func(*WSConn) Agent
-	ln          net.Listener
-	handler     *WSHandler
+	Addr         string
+	Tls          bool //是否支持tls
+	CertFile     string
+	KeyFile      string
+	MaxConnNum   int
+	MaxConnPerIP int //每个IP最多同时建立的连接数,0表示不限制
+	MaxMsgLen    uint32
+	HTTPTimeout  time.Duration
+	NewAgent     func(*WSConn) Agent
+	//客户端证书的CA,不为空时开启mTLS
+	ClientCAFile      string
+	RequireClientCert bool
+	ln                net.Listener
+	certs             io.Closer
+	handler           *WSHandler
+	//permessage-deflate压缩,客户端也支持时才会启用
+	EnableCompression bool
+	CompressionLevel  int //flate压缩级别,0表示使用默认级别
+	CompressThreshold int //小于这个字节数的消息不压缩
+	//可信代理(IP或CIDR),来自这些地址的连接使用X-Forwarded-For中的客户端地址
+	TrustedProxies []string
+	//允许的Origin,支持完整的Origin,域名和*.example.com,为空时不检查
+	AllowedOrigins []string
+	//支持的子协议,按优先级排列,为nil时使用mqttv3.1
+	Subprotocols []string
+	//升级之前调用,可以读取cookie或query中的令牌,返回错误时拒绝连接(401)
+	//返回的identity可以通过WSConn.Identity()取得
+	BeforeUpgrade func(r *http.Request) (identity interface{}, err error)
 }
 
 type WSHandler struct {
-	maxConnNum int
-	maxMsgLen  uint32
-	newAgent   func(*WSConn) Agent
-	upgrader   websocket.Upgrader
-	mutexConns sync.Mutex
-	wg         sync.WaitGroup
+	maxConnNum        int
+	maxMsgLen         uint32
+	compressionLevel  int
+	compressThreshold int
+	trustedProxies    *trustedProxies
+	allowedOrigins    []string
+	beforeUpgrade     func(r *http.Request) (interface{}, error)
+	ipConns           *ipConnLimiter
+	newAgent          func(*WSConn) Agent
+	upgrader          websocket.Upgrader
+	mutexConns        sync.Mutex
+	wg                sync.WaitGroup
 }
 
 func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -51,17 +78,50 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
+	if !handler.checkOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		log.Warnf("origin %s not allowed", r.Header.Get("Origin"))
+		return
+	}
+	ip := hostOf(r.RemoteAddr)
+	forwarded := forwardedFor(r.RemoteAddr, r.Header.Get("X-Forwarded-For"), handler.trustedProxies)
+	if forwarded != "" {
+		ip = forwarded
+	}
+	if !handler.ipConns.acquire(ip) {
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		log.Warnf("too many connections from %s", ip)
+		return
+	}
+	defer handler.ipConns.release(ip)
+	var identity interface{}
+	if handler.beforeUpgrade != nil {
+		var err error
+		identity, err = handler.beforeUpgrade(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
 	conn, err := handler.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Warnf("upgrade error: %v", err)
 		return
 	}
 	conn.SetReadLimit(int64(handler.maxMsgLen))
+	if handler.compressionLevel != 0 {
+		conn.SetCompressionLevel(handler.compressionLevel)
+	}
 
 	handler.wg.Add(1)
 	defer handler.wg.Done()
 
 	wsConn := newWSConn(conn)
+	wsConn.compressThreshold = handler.compressThreshold
+	wsConn.identity = identity
+	if forwarded != "" {
+		wsConn.remoteAddr = &net.TCPAddr{IP: net.ParseIP(forwarded)}
+	}
 	agent := handler.newAgent(wsConn)
 	agent.Run()
 
@@ -72,6 +132,35 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	agent.OnClose()
 }
 
+func (handler *WSHandler) checkOrigin(r *http.Request) bool {
+	if len(handler.allowedOrigins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		//不是浏览器发起的连接
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	for _, allowed := range handler.allowedOrigins {
+		switch {
+		case allowed == "*":
+			return true
+		case strings.HasPrefix(allowed, "*."):
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		case strings.EqualFold(allowed, origin), strings.EqualFold(allowed, host):
+			return true
+		}
+	}
+	return false
+}
+
 func (server *WSServer) Start() {
 	ln, err := net.Listen("tcp", server.Addr)
 	if err != nil {
@@ -86,10 +175,9 @@ func (server *WSServer) Start() {
 		log.Warnf("NewAgent must not be nil")
 	}
 	if server.Tls {
-		tlsConf := new(tls.Config)
-		tlsConf.Certificates = make([]tls.Certificate, 1)
-		tlsConf.Certificates[0], err = tls.LoadX509KeyPair(server.CertFile, server.KeyFile)
+		tlsConf, certs, err := NewTLSConfig(server.CertFile, server.KeyFile, server.ClientCAFile, server.RequireClientCert)
 		if err == nil {
+			server.certs = certs
 			ln = tls.NewListener(ln, tlsConf)
 			log.Info("WS Listen TLS load success")
 		} else {
@@ -97,14 +185,24 @@ func (server *WSServer) Start() {
 		}
 	}
 	server.ln = ln
+	if server.Subprotocols == nil {
+		server.Subprotocols = []string{"mqttv3.1"}
+	}
 	server.handler = &WSHandler{
-		maxConnNum: server.MaxConnNum,
-		maxMsgLen:  server.MaxMsgLen,
-		newAgent:   server.NewAgent,
+		maxConnNum:        server.MaxConnNum,
+		maxMsgLen:         server.MaxMsgLen,
+		compressionLevel:  server.CompressionLevel,
+		compressThreshold: server.CompressThreshold,
+		trustedProxies:    newTrustedProxies(server.TrustedProxies),
+		allowedOrigins:    server.AllowedOrigins,
+		beforeUpgrade:     server.BeforeUpgrade,
+		ipConns:           newIPConnLimiter(server.MaxConnPerIP),
+		newAgent:          server.NewAgent,
 		upgrader: websocket.Upgrader{
-			HandshakeTimeout: server.HTTPTimeout,
-			Subprotocols:     []string{"mqttv3.1"},
-			CheckOrigin:      func(_ *http.Request) bool { return true },
+			HandshakeTimeout:  server.HTTPTimeout,
+			Subprotocols:      server.Subprotocols,
+			CheckOrigin:       func(_ *http.Request) bool { return true }, //ServeHTTP中已经检查
+			EnableCompression: server.EnableCompression,
 		},
 	}
 
@@ -119,8 +217,20 @@ func (server *WSServer) Start() {
 	go httpServer.Serve(ln)
 }
 
+/**
+关闭监听,不再接受新的连接,已经升级的websocket连接不受影响
+*/
+func (server *WSServer) StopAccept() {
+	if server.ln != nil {
+		server.ln.Close()
+	}
+}
+
 func (server *WSServer) Close() {
 	server.ln.Close()
 
 	server.handler.wg.Wait()
+	if server.certs != nil {
+		server.certs.Close()
+	}
 }
@@ -0,0 +1,76 @@
+// Copyright 2014 mqant Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package network
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWSHandshake(t *testing.T) {
+	identities := make(chan interface{}, 1)
+	server := &WSServer{
+		Addr:           "127.0.0.1:0",
+		HTTPTimeout:    time.Second,
+		MaxMsgLen:      4096,
+		AllowedOrigins: []string{"*.example.com"},
+		Subprotocols:   []string{"mqttv3.1", "json.mqant"},
+		BeforeUpgrade: func(r *http.Request) (interface{}, error) {
+			token := r.URL.Query().Get("token")
+			if token == "" {
+				return nil, fmt.Errorf("token required")
+			}
+			return token, nil
+		},
+		NewAgent: func(conn *WSConn) Agent {
+			identities <- conn.Identity()
+			if conn.Subprotocol() != "json.mqant" {
+				t.Errorf("subprotocol got %q", conn.Subprotocol())
+			}
+			return &echoAgent{conn: conn}
+		},
+	}
+	server.Start()
+	defer server.Close()
+	url := "ws://" + server.ln.Addr().String() + "/"
+	dialer := websocket.Dialer{Subprotocols: []string{"json.mqant"}}
+
+	_, resp, err := dialer.Dial(url+"?token=abc", http.Header{"Origin": {"https://evil.com"}})
+	if err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("origin not allowed should be rejected, got %v", err)
+	}
+	_, resp, err = dialer.Dial(url, http.Header{"Origin": {"https://game.example.com"}})
+	if err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("missing token should be rejected, got %v", err)
+	}
+	conn, _, err := dialer.Dial(url+"?token=abc", http.Header{"Origin": {"https://game.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if identity := <-identities; identity != "abc" {
+		t.Fatalf("identity got %v", identity)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_, b, err := conn.ReadMessage()
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("echo got %q %v", b, err)
+	}
+}
@@ -0,0 +1,214 @@
+package selector
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/leonlau/mqant/v2/registry"
+)
+
+// Rendezvous picks the node for key by rendezvous (highest random weight)
+// hashing: every node is scored by a hash of its id and the key, and the
+// highest score wins.
+//
+// The result only depends on the key and the set of node ids, so every
+// process that sees the same nodes routes a key to the same node without
+// keeping or sharing any assignment state. Adding a node only moves the keys
+// it now wins, and removing a node only moves the keys it owned.
+func Rendezvous(key string, nodes []*registry.Node) (*registry.Node, error) {
+	var best *registry.Node
+	var bestScore uint64
+	for _, node := range nodes {
+		score := rendezvousScore(key, node.Id)
+		if best == nil || score > bestScore || (score == bestScore && node.Id < best.Id) {
+			best, bestScore = node, score
+		}
+	}
+	if best == nil {
+		return nil, ErrNoneAvailable
+	}
+	return best, nil
+}
+
+func rendezvousScore(key string, id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	//fnv的高位分布不均匀,用splitmix64的finalizer打散
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// rank orders nodes by their rendezvous score for key, best first.
+func rank(key string, nodes []*registry.Node) []*registry.Node {
+	ranked := make([]*registry.Node, len(nodes))
+	copy(ranked, nodes)
+	scores := make(map[*registry.Node]uint64, len(nodes))
+	for _, node := range nodes {
+		scores[node] = rendezvousScore(key, node.Id)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		si, sj := scores[ranked[i]], scores[ranked[j]]
+		if si != sj {
+			return si > sj
+		}
+		return ranked[i].Id < ranked[j].Id
+	})
+	return ranked
+}
+
+// HashBalancer is rendezvous hashing with bounded loads.
+//
+// A key is assigned to the highest ranked node whose load (number of keys
+// of the service assigned to it) is below ceil(factor * average load), and
+// stays on that node until it has been idle for the idle timeout or the node
+// leaves. A hot spot of keys therefore spills over to the next ranked nodes
+// instead of piling up on one node.
+//
+// Loads are counted by the process owning the balancer. Balancers in
+// different processes agree on a key's node as long as no node has reached
+// its bound, because below the bound the result is plain rendezvous hashing.
+type HashBalancer struct {
+	factor float64
+	idle   time.Duration
+
+	mtx       sync.Mutex
+	services  map[string]*hashLoad
+	lastSweep time.Time
+}
+
+type hashLoad struct {
+	keys map[string]*hashKey
+	load map[string]int
+}
+
+type hashKey struct {
+	node string
+	used time.Time
+}
+
+// NewHashBalancer creates a balancer with the given load factor (>= 1) and
+// idle timeout. Zero values use the defaults 1.25 and 30 minutes.
+func NewHashBalancer(factor float64, idle time.Duration) *HashBalancer {
+	if factor < 1 {
+		factor = 1.25
+	}
+	if idle <= 0 {
+		idle = 30 * time.Minute
+	}
+	return &HashBalancer{
+		factor:    factor,
+		idle:      idle,
+		services:  map[string]*hashLoad{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *hashLoad) release(key string) {
+	if k, ok := l.keys[key]; ok {
+		delete(l.keys, key)
+		if l.load[k.node]--; l.load[k.node] <= 0 {
+			delete(l.load, k.node)
+		}
+	}
+}
+
+func (b *HashBalancer) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < b.idle/2 {
+		return
+	}
+	b.lastSweep = now
+	for name, l := range b.services {
+		for key, k := range l.keys {
+			if now.Sub(k.used) >= b.idle {
+				l.release(key)
+			}
+		}
+		if len(l.keys) == 0 {
+			delete(b.services, name)
+		}
+	}
+}
+
+// Get returns the node of service for key among nodes, assigning it if
+// needed. Keys and loads are counted per service, so one balancer can be
+// shared by several services.
+func (b *HashBalancer) Get(service string, key string, nodes []*registry.Node) (*registry.Node, error) {
+	if len(nodes) == 0 {
+		return nil, ErrNoneAvailable
+	}
+	now := time.Now()
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.sweep(now)
+	l, ok := b.services[service]
+	if !ok {
+		l = &hashLoad{keys: map[string]*hashKey{}, load: map[string]int{}}
+		b.services[service] = l
+	}
+	if k, ok := l.keys[key]; ok {
+		for _, node := range nodes {
+			if node.Id == k.node {
+				k.used = now
+				return node, nil
+			}
+		}
+		//节点已经离开
+		l.release(key)
+	}
+	total := 0
+	for _, node := range nodes {
+		total += l.load[node.Id]
+	}
+	limit := int(math.Ceil(b.factor * float64(total+1) / float64(len(nodes))))
+	ranked := rank(key, nodes)
+	node := ranked[0]
+	for _, n := range ranked {
+		if l.load[n.Id] < limit {
+			node = n
+			break
+		}
+	}
+	l.keys[key] = &hashKey{node: node.Id, used: now}
+	l.load[node.Id]++
+	return node, nil
+}
+
+// Release unassigns key of service, e.g. when the room it names is closed.
+func (b *HashBalancer) Release(service string, key string) {
+	b.mtx.Lock()
+	if l, ok := b.services[service]; ok {
+		l.release(key)
+	}
+	b.mtx.Unlock()
+}
+
+// ConsistentHash is a strategy that picks the node for key from balancer,
+// or by plain rendezvous hashing when balancer is nil.
+func ConsistentHash(balancer *HashBalancer, key string) Strategy {
+	return func(services []*registry.Service) Next {
+		var nodes []*registry.Node
+		name := ""
+
+		for _, service := range services {
+			name = service.Name
+			nodes = append(nodes, service.Nodes...)
+		}
+
+		return func() (*registry.Node, error) {
+			if balancer == nil {
+				return Rendezvous(key, nodes)
+			}
+			return balancer.Get(name, key, nodes)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package selector
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/leonlau/mqant/v2/registry"
+)
+
+func testNodes(n int) []*registry.Node {
+	var nodes []*registry.Node
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, &registry.Node{Id: fmt.Sprintf("room@%d", i)})
+	}
+	return nodes
+}
+
+func TestRendezvous(t *testing.T) {
+	nodes := testNodes(4)
+	assigned := map[string]string{}
+	load := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		key := fmt.Sprintf("r%d", i)
+		node, err := Rendezvous(key, nodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assigned[key] = node.Id
+		load[node.Id]++
+	}
+	for id, n := range load {
+		if n < 800 || n > 1200 {
+			t.Errorf("node %s has %d of 4000 keys", id, n)
+		}
+	}
+
+	//与节点的顺序无关,不同的进程得到相同的结果
+	reversed := testNodes(4)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	for key, id := range assigned {
+		if node, _ := Rendezvous(key, reversed); node.Id != id {
+			t.Fatalf("key %s routed to %s and %s", key, id, node.Id)
+		}
+	}
+
+	//扩容只把key移动到新节点
+	moved := 0
+	for key, id := range assigned {
+		node, _ := Rendezvous(key, testNodes(5))
+		if node.Id != id {
+			if node.Id != "room@4" {
+				t.Fatalf("key %s moved from %s to %s after adding a node", key, id, node.Id)
+			}
+			moved++
+		}
+	}
+	if moved < 600 || moved > 1000 {
+		t.Errorf("%d of 4000 keys moved to the new node", moved)
+	}
+
+	//缩容只移动离开的节点上的key
+	for key, id := range assigned {
+		node, _ := Rendezvous(key, testNodes(3))
+		if id != "room@3" && node.Id != id {
+			t.Fatalf("key %s moved from %s to %s after removing another node", key, id, node.Id)
+		}
+	}
+
+	if _, err := Rendezvous("r1", nil); err != ErrNoneAvailable {
+		t.Fatalf("expected ErrNoneAvailable, got %v", err)
+	}
+}
+
+func TestHashBalancerBoundedLoad(t *testing.T) {
+	b := NewHashBalancer(1.25, 0)
+	nodes := testNodes(4)
+	assigned := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("r%d", i)
+		node, err := b.Get("room", key, nodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assigned[key] = node.Id
+	}
+	limit := int(math.Ceil(1.25 * 1000 / 4))
+	for id, load := range b.services["room"].load {
+		if load > limit {
+			t.Errorf("node %s has %d keys, bound is %d", id, load, limit)
+		}
+	}
+	//没有超过上限的key与rendezvous的结果相同,不同的进程得到相同的结果
+	same := 0
+	for key, id := range assigned {
+		if node, _ := Rendezvous(key, nodes); node.Id == id {
+			same++
+		}
+		if node, _ := b.Get("room", key, nodes); node.Id != id {
+			t.Fatalf("key %s moved from %s to %s", key, id, node.Id)
+		}
+	}
+	if same < 900 {
+		t.Errorf("only %d of 1000 keys follow rendezvous hashing", same)
+	}
+
+	//扩容不移动已分配的key
+	for key, id := range assigned {
+		if node, _ := b.Get("room", key, testNodes(5)); node.Id != id {
+			t.Fatalf("key %s moved from %s to %s after adding a node", key, id, node.Id)
+		}
+	}
+	//缩容只移动离开的节点上的key
+	for key, id := range assigned {
+		node, _ := b.Get("room", key, testNodes(3))
+		if id != "room@3" && node.Id != id {
+			t.Fatalf("key %s moved from %s to %s after removing another node", key, id, node.Id)
+		}
+		if node.Id == "room@3" {
+			t.Fatalf("key %s still on removed node", key)
+		}
+	}
+}
+
+func TestHashBalancerHotNode(t *testing.T) {
+	//所有key在rendezvous中都排在同一个节点时,超过上限的key分到排名靠后的节点
+	nodes := testNodes(4)
+	keys := make([]string, 0)
+	for i := 0; len(keys) < 100; i++ {
+		key := fmt.Sprintf("r%d", i)
+		if node, _ := Rendezvous(key, nodes); node.Id == "room@0" {
+			keys = append(keys, key)
+		}
+	}
+	b := NewHashBalancer(1.25, 0)
+	for _, key := range keys {
+		b.Get("room", key, nodes)
+	}
+	limit := int(math.Ceil(1.25 * 100 / 4))
+	if load := b.services["room"].load["room@0"]; load > limit {
+		t.Fatalf("hot node has %d keys, bound is %d", load, limit)
+	}
+	//不同服务分别计算负载
+	if node, _ := b.Get("chat", keys[0], nodes); node.Id != "room@0" {
+		t.Fatalf("chat key routed to %s", node.Id)
+	}
+}
+
+func TestHashBalancerRelease(t *testing.T) {
+	b := NewHashBalancer(0, 20*time.Millisecond)
+	nodes := testNodes(2)
+	b.Get("room", "a", nodes)
+	b.Release("room", "a")
+	if l := b.services["room"]; len(l.keys) != 0 || len(l.load) != 0 {
+		t.Fatalf("released key still counted: %v %v", l.keys, l.load)
+	}
+	b.Get("room", "b", nodes)
+	time.Sleep(30 * time.Millisecond)
+	b.Get("room", "c", nodes)
+	if _, ok := b.services["room"].keys["b"]; ok {
+		t.Fatal("idle key should be released")
+	}
+	if _, err := b.Get("room", "d", nil); err != ErrNoneAvailable {
+		t.Fatalf("expected ErrNoneAvailable, got %v", err)
+	}
+}
+
+func TestConsistentHashStrategy(t *testing.T) {
+	services := []*registry.Service{{Name: "room", Nodes: testNodes(3)}}
+	for _, b := range []*HashBalancer{nil, NewHashBalancer(0, 0)} {
+		first, err := ConsistentHash(b, "r1")(services)()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if node, _ := ConsistentHash(b, "r1")(services)(); node.Id != first.Id {
+				t.Fatalf("r1 routed to %s and %s", first.Id, node.Id)
+			}
+		}
+	}
+}
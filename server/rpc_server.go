@@ -25,6 +25,9 @@ type rpcServer struct {
 	id         string
 	// graceful exit
 	wg sync.WaitGroup
+
+	// 注销之后不再重新注册,例如网关排空时
+	deregistered bool
 }
 
 func newRpcServer(opts ...Option) Server {
@@ -83,6 +86,12 @@ func (s *rpcServer) RegisterGO(id string, f interface{}) {
 }
 
 func (s *rpcServer) ServiceRegister() error {
+	s.RLock()
+	deregistered := s.deregistered
+	s.RUnlock()
+	if deregistered {
+		return nil
+	}
 	// parse address for host, port
 	config := s.Options()
 	var advt, host string
@@ -208,6 +217,7 @@ func (s *rpcServer) ServiceDeregister() error {
 	}
 
 	s.Lock()
+	s.deregistered = true
 
 	if !s.registered {
 		s.Unlock()
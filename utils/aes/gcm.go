@@ -0,0 +1,85 @@
+// Copyright 2014 mqantserver Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+/**
+AES-GCM 加密,nonce为递增的64位计数器,一个密钥只能用于一个方向
+密文格式为 计数器(8字节,大端)+密文+认证标签
+Open只接受计数器大于上一条消息的密文,重放和乱序的消息会被拒绝
+*/
+type GcmEncrypt struct {
+	aead     cipher.AEAD
+	lock     sync.Mutex
+	sent     uint64
+	received uint64
+}
+
+//key的长度必须为16,24或32
+func NewGcmEncrypt(key []byte) (*GcmEncrypt, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &GcmEncrypt{aead: aead}, nil
+}
+
+func (this *GcmEncrypt) nonce(counter uint64) []byte {
+	nonce := make([]byte, this.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+//加密,additionalData不加密但参与认证
+func (this *GcmEncrypt) Seal(plaintext []byte, additionalData []byte) ([]byte, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.sent == ^uint64(0) {
+		return nil, fmt.Errorf("nonce counter exhausted")
+	}
+	this.sent++
+	dst := make([]byte, 8, 8+len(plaintext)+this.aead.Overhead())
+	binary.BigEndian.PutUint64(dst, this.sent)
+	return this.aead.Seal(dst, this.nonce(this.sent), plaintext, additionalData), nil
+}
+
+//解密并校验
+func (this *GcmEncrypt) Open(ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < 8+this.aead.Overhead() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	counter := binary.BigEndian.Uint64(ciphertext)
+	if counter <= this.received {
+		return nil, fmt.Errorf("replayed ciphertext")
+	}
+	b, err := this.aead.Open(nil, this.nonce(counter), ciphertext[8:], additionalData)
+	if err != nil {
+		return nil, err
+	}
+	this.received = counter
+	return b, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2014 mqantserver Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aes
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGcmEncrypt(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	sender, err := NewGcmEncrypt(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, _ := NewGcmEncrypt(key)
+	plaintext := []byte("hello mqant")
+	c1, err := sender.Seal(plaintext, []byte("topic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, _ := sender.Seal(plaintext, []byte("topic"))
+	if bytes.Equal(c1, c2) {
+		t.Fatal("the same plaintext must not produce the same ciphertext")
+	}
+	if _, err := receiver.Open(c1, []byte("other")); err == nil {
+		t.Fatal("additional data mismatch must fail")
+	}
+	tampered := append([]byte(nil), c1...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := receiver.Open(tampered, []byte("topic")); err == nil {
+		t.Fatal("tampered ciphertext must fail")
+	}
+	b, err := receiver.Open(c1, []byte("topic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, plaintext) {
+		t.Fatalf("got %q want %q", b, plaintext)
+	}
+	if _, err := receiver.Open(c1, []byte("topic")); err == nil {
+		t.Fatal("replayed ciphertext must fail")
+	}
+	c3, _ := sender.Seal(plaintext, []byte("topic"))
+	if _, err := receiver.Open(c3, []byte("topic")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Open(c2, []byte("topic")); err == nil {
+		t.Fatal("out of order ciphertext must fail")
+	}
+}